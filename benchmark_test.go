@@ -72,6 +72,81 @@ func BenchmarkDyconfGet(b *testing.B) {
 	ensure.Nil(b, err)
 }
 
+func BenchmarkDyconfGetLockFree(b *testing.B) {
+	// Setup
+	tmpFile, err := ioutil.TempFile("", "dyconf-BenchMarkDyconfGetLockFree")
+	ensure.Nil(b, err)
+	tmpFileName := tmpFile.Name()
+	tmpFile.Close()
+	os.Remove(tmpFileName)
+
+	// Set the keys first.
+	wc, err := NewManager(tmpFileName, WithLockFreeReads())
+	ensure.Nil(b, err)
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		val := fmt.Sprintf("value-%d", i)
+		err = wc.Set(key, []byte(val))
+		if err != nil {
+			break
+		}
+	}
+	ensure.Nil(b, err)
+
+	// Now reset the timer and start reading the keys.
+	conf, err := New(tmpFileName, WithLockFreeReads())
+	ensure.Nil(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err = conf.Get(key)
+		if err != nil {
+			break
+		}
+	}
+	ensure.Nil(b, err)
+}
+
+func BenchmarkDyconfGetView(b *testing.B) {
+	// Setup
+	tmpFile, err := ioutil.TempFile("", "dyconf-BenchMarkDyconfGetView")
+	ensure.Nil(b, err)
+	tmpFileName := tmpFile.Name()
+	tmpFile.Close()
+	os.Remove(tmpFileName)
+
+	// Set the keys first.
+	wc, err := NewManager(tmpFileName)
+	ensure.Nil(b, err)
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		val := fmt.Sprintf("value-%d", i)
+		err = wc.Set(key, []byte(val))
+		if err != nil {
+			break
+		}
+	}
+	ensure.Nil(b, err)
+
+	// Now reset the timer and start reading the keys.
+	conf, err := New(tmpFileName)
+	ensure.Nil(b, err)
+	size := 0
+	view := func(value []byte) error {
+		size += len(value)
+		return nil
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		err = conf.GetView(key, view)
+		if err != nil {
+			break
+		}
+	}
+	ensure.Nil(b, err)
+}
+
 func BenchmarkSimpleMapGet(b *testing.B) {
 	kvMap := make(map[string]string)
 	// Set the keys first.
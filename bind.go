@@ -0,0 +1,441 @@
+package dyconf
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// Unmarshal and Marshal bind the fields of a struct to keys, so the schema of a config can be kept in Go
+// types. The key of a field is given by its dyconf tag, followed by options:
+//
+//	type Service struct {
+//		Timeout time.Duration `dyconf:"timeout,default=5s"`
+//		Hosts   []string      `dyconf:"hosts,required"`
+//	}
+//	type Config struct {
+//		Service Service `dyconf:"service"`
+//	}
+//
+// The fields of a tagged struct field are bound to the keys under its key, like service.timeout above.
+// The fields of an untagged embedded struct are bound as if they were fields of the outer struct. Other
+// untagged fields and fields tagged with "-" are left alone.
+//
+// The fields may be strings, []byte, bools, integers, floats, time.Duration and time.Time, or slices of
+// them. The elements of a slice are bound to the keys key.0, key.1 and so on.
+//
+// The default option gives the value of a missing key, in the text format described in Unmarshal. It
+// takes the rest of the tag, so it must come last. The default of a slice is a comma separated list. The
+// required option makes Unmarshal fail if the key is missing and there is no default.
+
+// BindError is returned by Unmarshal and Marshal when a field can't be bound to its key. Err is the
+// reason, like the KeyError of a missing required key or the TypeError of a value of another type.
+type BindError struct {
+	Field string // Path of the field, like Service.Timeout.
+	Key   string
+	Err   error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("dyconf: cannot bind the field [%s] to the key [%s]. error: [%s]", e.Field, e.Key, e.Err.Error())
+}
+
+// Unwrap returns the reason of the error.
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// bindTag is the parsed dyconf tag of a field.
+type bindTag struct {
+	key        string
+	def        string
+	hasDefault bool
+	required   bool
+}
+
+func parseBindTag(tag string) bindTag {
+	parts := strings.SplitN(tag, ",", 2)
+	t := bindTag{key: parts[0]}
+	if len(parts) == 1 {
+		return t
+	}
+	opts := parts[1]
+	for opts != "" {
+		if strings.HasPrefix(opts, "default=") {
+			t.def, t.hasDefault = strings.TrimPrefix(opts, "default="), true
+			break
+		}
+		parts = strings.SplitN(opts, ",", 2)
+		if parts[0] == "required" {
+			t.required = true
+		}
+		opts = ""
+		if len(parts) == 2 {
+			opts = parts[1]
+		}
+	}
+	return t
+}
+
+// boundField is a field of a struct that is bound to a key.
+type boundField struct {
+	value reflect.Value
+	path  string
+	key   string
+	tag   bindTag
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+// boundFields calls fn with each of the fields of the given struct that are bound to a key, including
+// those of the nested structs. See Unmarshal.
+func boundFields(rv reflect.Value, prefix, path string, fn func(f boundField) error) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		tag, tagged := sf.Tag.Lookup("dyconf")
+		if tag == "-" || (sf.PkgPath != "" && !sf.Anonymous) {
+			continue
+		}
+		fv := rv.Field(i)
+		fieldPath := path + sf.Name
+		if !tagged {
+			if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+				if err := boundFields(fv, prefix, path, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		t := parseBindTag(tag)
+		key := prefix + t.key
+		if sf.Type.Kind() == reflect.Struct && sf.Type != timeType {
+			if err := boundFields(fv, key+".", fieldPath+".", fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(boundField{value: fv, path: fieldPath, key: key, tag: t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structValue returns the struct v points to, or v itself if it is a struct and it doesn't have to be
+// settable.
+func structValue(v interface{}, settable bool) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	} else if settable {
+		return rv, false
+	}
+	return rv, rv.Kind() == reflect.Struct
+}
+
+// isSlice returns true if the field is bound to a list of keys rather than a single key.
+func isSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t != bytesType
+}
+
+// Unmarshal fills the struct v points to with the values of the keys its fields are bound to. See the
+// dyconf tag above. The fields of missing keys are set to their default, if any, and left as they are
+// otherwise.
+//
+// The values are read with the typed getter of the field's type, like GetDuration for a time.Duration,
+// so a value set as another type fails with a TypeError. A value set with Set is parsed from text
+// instead: integers and floats as by strconv, durations as by time.ParseDuration and times in the
+// RFC 3339 format.
+func Unmarshal(cfg Config, v interface{}) error {
+	rv, ok := structValue(v, true)
+	if !ok {
+		return stackerr.Newf("dyconf: Unmarshal needs a non-nil pointer to a struct. Got [%T]", v)
+	}
+	return boundFields(rv, "", "", func(f boundField) error {
+		var err error
+		if isSlice(f.value.Type()) {
+			err = unmarshalSlice(cfg, f)
+		} else {
+			err = unmarshalField(cfg, f)
+		}
+		if err != nil {
+			if _, ok := err.(*BindError); !ok {
+				err = &BindError{Field: f.path, Key: f.key, Err: err}
+			}
+		}
+		return err
+	})
+}
+
+func unmarshalField(cfg Config, f boundField) error {
+	err := getValue(cfg, f.key, f.value)
+	if !isNotFound(err) {
+		return err
+	}
+	switch {
+	case f.tag.hasDefault:
+		return parseValue(f.value, f.tag.def)
+	case f.tag.required:
+		return err
+	}
+	return nil
+}
+
+func unmarshalSlice(cfg Config, f boundField) error {
+	elems := reflect.MakeSlice(f.value.Type(), 0, 0)
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s.%d", f.key, i)
+		elem := reflect.New(f.value.Type().Elem()).Elem()
+		err := getValue(cfg, key, elem)
+		if isNotFound(err) {
+			break
+		}
+		if err != nil {
+			return &BindError{Field: fmt.Sprintf("%s[%d]", f.path, i), Key: key, Err: err}
+		}
+		elems = reflect.Append(elems, elem)
+	}
+	if elems.Len() > 0 {
+		f.value.Set(elems)
+		return nil
+	}
+
+	switch {
+	case f.tag.hasDefault:
+		for _, s := range strings.Split(f.tag.def, ",") {
+			elem := reflect.New(f.value.Type().Elem()).Elem()
+			if err := parseValue(elem, s); err != nil {
+				return err
+			}
+			elems = reflect.Append(elems, elem)
+		}
+		f.value.Set(elems)
+	case f.tag.required:
+		return &KeyError{Key: f.key + ".0", Reason: "is required but was not found", Err: ErrNotFound}
+	}
+	return nil
+}
+
+// unsupportedTypeError is the error of binding a value of a type that has no getter or setter.
+type unsupportedTypeError struct {
+	t reflect.Type
+}
+
+func (e *unsupportedTypeError) Error() string {
+	return fmt.Sprintf("unsupported type [%s]", e.t)
+}
+
+func isNotFound(err error) bool {
+	keyErr, ok := err.(*KeyError)
+	return ok && keyErr.Err == ErrNotFound
+}
+
+// getValue sets the given value to the value of the given key, read with the getter of its type. Values
+// set with Set are parsed with parseValue.
+func getValue(cfg Config, key string, v reflect.Value) error {
+	err := getTypedValue(cfg, key, v)
+	if typeErr, ok := err.(*TypeError); ok && typeErr.Saved == TypeBytes {
+		s, err := cfg.GetString(key)
+		if err != nil {
+			return err
+		}
+		return parseValue(v, s)
+	}
+	return err
+}
+
+func getTypedValue(cfg Config, key string, v reflect.Value) error {
+	switch v.Type() {
+	case durationType:
+		d, err := cfg.GetDuration(key)
+		if err == nil {
+			v.SetInt(int64(d))
+		}
+		return err
+	case timeType:
+		t, err := cfg.GetTime(key)
+		if err == nil {
+			v.Set(reflect.ValueOf(t))
+		}
+		return err
+	case bytesType:
+		data, err := cfg.Get(key)
+		if err == nil {
+			v.SetBytes(data)
+		}
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, err := cfg.GetString(key)
+		if err == nil {
+			v.SetString(s)
+		}
+		return err
+	case reflect.Bool:
+		b, err := cfg.GetBool(key)
+		if err == nil {
+			v.SetBool(b)
+		}
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := cfg.GetInt64(key)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("value [%d] overflows [%s]", i, v.Type())
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := cfg.GetUint64(key)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("value [%d] overflows [%s]", u, v.Type())
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := cfg.GetFloat64(key)
+		if err != nil {
+			return err
+		}
+		if v.OverflowFloat(f) {
+			return fmt.Errorf("value [%g] overflows [%s]", f, v.Type())
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return &unsupportedTypeError{v.Type()}
+}
+
+// parseValue sets the given value to the one parsed from the given text. See Unmarshal for the formats.
+func parseValue(v reflect.Value, s string) error {
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err == nil {
+			v.SetInt(int64(d))
+		}
+		return err
+	case timeType:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err == nil {
+			v.Set(reflect.ValueOf(t))
+		}
+		return err
+	case bytesType:
+		v.SetBytes([]byte(s))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err == nil {
+			v.SetBool(b)
+		}
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err == nil {
+			v.SetInt(i)
+		}
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err == nil {
+			v.SetUint(u)
+		}
+		return err
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err == nil {
+			v.SetFloat(f)
+		}
+		return err
+	}
+	return &unsupportedTypeError{v.Type()}
+}
+
+// Marshal sets the keys the fields of the struct v (or the struct v points to) are bound to, to the
+// values of the fields. See the dyconf tag above. Each value is set with the setter of its type, like
+// SetDuration for a time.Duration, and []byte with Set. The keys of the elements a slice no longer has
+// are deleted. The keys are set one by one, so readers may see some of them changed before the others.
+func Marshal(mgr ConfigManager, v interface{}) error {
+	rv, ok := structValue(v, false)
+	if !ok {
+		return stackerr.Newf("dyconf: Marshal needs a struct or a non-nil pointer to one. Got [%T]", v)
+	}
+	return boundFields(rv, "", "", func(f boundField) error {
+		if isSlice(f.value.Type()) {
+			return marshalSlice(mgr, f)
+		}
+		if err := setValue(mgr, f.key, f.value); err != nil {
+			return &BindError{Field: f.path, Key: f.key, Err: err}
+		}
+		return nil
+	})
+}
+
+func marshalSlice(mgr ConfigManager, f boundField) error {
+	for i := 0; i < f.value.Len(); i++ {
+		key := fmt.Sprintf("%s.%d", f.key, i)
+		if err := setValue(mgr, key, f.value.Index(i)); err != nil {
+			return &BindError{Field: fmt.Sprintf("%s[%d]", f.path, i), Key: key, Err: err}
+		}
+	}
+	// Delete the elements left from a longer slice.
+	for i := f.value.Len(); ; i++ {
+		key := fmt.Sprintf("%s.%d", f.key, i)
+		found, err := mgr.Has(key)
+		if err != nil || !found {
+			return err
+		}
+		if err := mgr.Delete(key); err != nil {
+			return &BindError{Field: f.path, Key: key, Err: err}
+		}
+	}
+}
+
+// setValue sets the given key to the given value, with the setter of its type.
+func setValue(mgr ConfigManager, key string, v reflect.Value) error {
+	switch v.Type() {
+	case durationType:
+		return mgr.SetDuration(key, time.Duration(v.Int()))
+	case timeType:
+		return mgr.SetTime(key, v.Interface().(time.Time))
+	case bytesType:
+		return mgr.Set(key, v.Bytes())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return mgr.SetString(key, v.String())
+	case reflect.Bool:
+		return mgr.SetBool(key, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return mgr.SetInt64(key, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return mgr.SetUint64(key, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return mgr.SetFloat64(key, v.Float())
+	}
+	return &unsupportedTypeError{v.Type()}
+}
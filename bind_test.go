@@ -0,0 +1,210 @@
+package dyconf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+type bindServer struct {
+	Host    string        `dyconf:"host,required"`
+	Port    uint16        `dyconf:"port,default=8080"`
+	Timeout time.Duration `dyconf:"timeout,default=5s"`
+}
+
+type bindCommon struct {
+	Name string `dyconf:"name"`
+}
+
+type bindConfig struct {
+	bindCommon
+	Server   bindServer `dyconf:"server"`
+	Ratio    float32    `dyconf:"ratio"`
+	Enabled  bool       `dyconf:"enabled"`
+	Retries  int8       `dyconf:"retries"`
+	Tags     []string   `dyconf:"tags,default=a,b"`
+	Weights  []int64    `dyconf:"weights"`
+	Blob     []byte     `dyconf:"blob"`
+	Started  time.Time  `dyconf:"started"`
+	Skipped  string     `dyconf:"-"`
+	Untagged string
+	internal string
+}
+
+// TestBindRoundTrip tests that a struct is read back by Unmarshal as Marshal wrote it.
+func TestBindRoundTrip(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestBindRoundTrip-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+
+	in := bindConfig{
+		bindCommon: bindCommon{Name: "svc"},
+		Server:     bindServer{Host: "localhost", Port: 9090, Timeout: time.Minute},
+		Ratio:      0.5,
+		Enabled:    true,
+		Retries:    -3,
+		Tags:       []string{"x", "y", "z"},
+		Weights:    []int64{1, 2},
+		Blob:       []byte{0x00, 0xFF},
+		Started:    time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+		Skipped:    "skipped",
+		Untagged:   "untagged",
+		internal:   "internal",
+	}
+	ensure.Nil(t, Marshal(m, &in))
+	for _, key := range []string{"name", "server.host", "server.port", "server.timeout", "tags.2", "weights.1", "blob"} {
+		found, err := m.Has(key)
+		ensure.Nil(t, err, key)
+		ensure.True(t, found, key)
+	}
+	d, err := m.GetDuration("server.timeout")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, d, time.Minute)
+
+	var out bindConfig
+	ensure.Nil(t, Unmarshal(m, &out))
+	in.Skipped, in.Untagged, in.internal = "", "", ""
+	ensure.DeepEqual(t, out, in)
+
+	// A shorter slice deletes the keys of the elements it no longer has.
+	in.Tags = []string{"x"}
+	ensure.Nil(t, Marshal(m, in))
+	found, err := m.Has("tags.1")
+	ensure.Nil(t, err)
+	ensure.False(t, found)
+	out = bindConfig{}
+	ensure.Nil(t, Unmarshal(m, &out))
+	ensure.DeepEqual(t, out.Tags, []string{"x"})
+}
+
+// TestBindUnmarshal tests the defaults, the required fields and the values set with Set.
+func TestBindUnmarshal(t *testing.T) {
+	cases := []struct {
+		kv       map[string][]byte
+		expected bindConfig
+	}{
+		{ // Case-0: Missing keys take the defaults.
+			kv: map[string][]byte{"server.host": []byte("example.com")},
+			expected: bindConfig{
+				Server: bindServer{Host: "example.com", Port: 8080, Timeout: 5 * time.Second},
+				Tags:   []string{"a", "b"},
+			},
+		},
+		{ // Case-1: Values set with Set are parsed from text.
+			kv: map[string][]byte{
+				"name":           []byte("svc"),
+				"server.host":    []byte("example.com"),
+				"server.port":    []byte("0x50"),
+				"server.timeout": []byte("1m30s"),
+				"ratio":          []byte("0.25"),
+				"enabled":        []byte("true"),
+				"retries":        []byte("-7"),
+				"tags.0":         []byte("t"),
+				"weights.0":      []byte("10"),
+				"weights.1":      []byte("20"),
+				"blob":           []byte("raw"),
+				"started":        []byte("2017-03-04T05:06:07Z"),
+			},
+			expected: bindConfig{
+				bindCommon: bindCommon{Name: "svc"},
+				Server:     bindServer{Host: "example.com", Port: 0x50, Timeout: 90 * time.Second},
+				Ratio:      0.25,
+				Enabled:    true,
+				Retries:    -7,
+				Tags:       []string{"t"},
+				Weights:    []int64{10, 20},
+				Blob:       []byte("raw"),
+				Started:    time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		tmpFileName := setupTempFile(t, "TestBindUnmarshal-")
+		defer os.Remove(tmpFileName)
+		m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		for k, v := range tc.kv {
+			ensure.Nil(t, m.Set(k, v), fmt.Sprintf("Case: [%d]", i))
+		}
+		var out bindConfig
+		ensure.Nil(t, Unmarshal(m, &out), fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, out, tc.expected, fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Close(), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestBindErrors tests the errors of Unmarshal and Marshal.
+func TestBindErrors(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestBindErrors-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+
+	cases := []struct {
+		kv             map[string][]byte
+		setInt64       map[string]int64
+		v              interface{}
+		expectedErrStr string
+	}{
+		{ // Case-0: The required key is missing.
+			v:              &bindConfig{},
+			expectedErrStr: `^dyconf: cannot bind the field \[Server.Host\] to the key \[server.host\]. error: \[dyconf: the key was not found`,
+		},
+		{ // Case-1: The value doesn't fit the field.
+			kv:             map[string][]byte{"server.host": []byte("h")},
+			setInt64:       map[string]int64{"retries": 300},
+			v:              &bindConfig{},
+			expectedErrStr: `^dyconf: cannot bind the field \[Retries\] to the key \[retries\]. error: \[value \[300\] overflows \[int8\]\]`,
+		},
+		{ // Case-2: The value is of another type.
+			setInt64:       map[string]int64{"server.host": 1},
+			v:              &bindConfig{},
+			expectedErrStr: `^dyconf: cannot bind the field \[Server.Host\] to the key \[server.host\]. error: \[dyconf: key \[server.host\] holds a \[int64\] value. It cannot be read as \[string\]`,
+		},
+		{ // Case-3: The text can't be parsed.
+			kv:             map[string][]byte{"server.host": []byte("h"), "weights.0": []byte("1"), "weights.1": []byte("heavy")},
+			v:              &bindConfig{},
+			expectedErrStr: `^dyconf: cannot bind the field \[Weights\[1\]\] to the key \[weights.1\]. error: \[strconv.ParseInt: parsing "heavy": invalid syntax\]`,
+		},
+		{ // Case-4: The fields of unsupported types are reported.
+			kv: map[string][]byte{"ch": []byte("c")},
+			v: &struct {
+				Ch chan int `dyconf:"ch"`
+			}{},
+			expectedErrStr: `^dyconf: cannot bind the field \[Ch\] to the key \[ch\]. error: \[unsupported type \[chan int\]\]`,
+		},
+		{ // Case-5: Unmarshal needs a pointer.
+			v:              bindConfig{},
+			expectedErrStr: `^dyconf: Unmarshal needs a non-nil pointer to a struct. Got \[dyconf.bindConfig\]`,
+		},
+	}
+
+	for i, tc := range cases {
+		for k, v := range tc.kv {
+			ensure.Nil(t, m.Set(k, v), fmt.Sprintf("Case: [%d]", i))
+		}
+		for k, v := range tc.setInt64 {
+			ensure.Nil(t, m.SetInt64(k, v), fmt.Sprintf("Case: [%d]", i))
+		}
+		ensure.Err(t, Unmarshal(m, tc.v), regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+		for k := range tc.kv {
+			ensure.Nil(t, m.Delete(k), fmt.Sprintf("Case: [%d]", i))
+		}
+		for k := range tc.setInt64 {
+			ensure.Nil(t, m.Delete(k), fmt.Sprintf("Case: [%d]", i))
+		}
+	}
+
+	err = Marshal(m, (*bindConfig)(nil))
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: Marshal needs a struct or a non-nil pointer to one. Got \[\*dyconf.bindConfig\]`))
+}
@@ -0,0 +1,121 @@
+package dyconf
+
+import (
+	"context"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// Compact reduces the fragmentation of the data block, without holding the write lock for long like
+// Defrag does. The records of every bucket chain are moved into free chunks before them, one chain per
+// lock hold. Then the free chunks at the end of the data block are given back to its contiguous free
+// space. Compact does nothing if the fragmentation, the share of the used part of the data block that is
+// not taken by live records, is below the given threshold. It stops early with the context's error if
+// the context is done.
+func (c *configManager) Compact(ctx context.Context, threshold float64) error {
+	if threshold < 0 || threshold > 1 {
+		return stackerr.Newf("dyconf: invalid fragmentation threshold [%v]. It should be between [0 - 1]", threshold)
+	}
+	fragmentation, err := c.fragmentation()
+	if err != nil {
+		return err
+	}
+	if fragmentation == 0 || fragmentation < threshold {
+		return nil
+	}
+
+	for slot, done := uint32(0), false; !done; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if slot, done, err = c.compactNextChain(slot); err != nil {
+			return err
+		}
+	}
+
+	// write lock the file
+	if err := c.wlock(); err != nil {
+		return err
+	}
+	defer c.unlock()
+	return c.mutate(func(h *headerBlock) error {
+		return c.data(h).trim()
+	})
+}
+
+// RunCompactor runs Compact with the given threshold every interval, until the context is done. It
+// returns the context's error then, or the first error of Compact. It is meant to be run in its own
+// goroutine, which can share the ConfigManager with the others.
+func (c *configManager) RunCompactor(ctx context.Context, threshold float64, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := c.Compact(ctx, threshold); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+		}
+	}
+}
+
+// compactNextChain compacts the first bucket chain in the index starting from the given slot. It returns
+// the slot to continue from, and true if there are no more chains.
+func (c *configManager) compactNextChain(slot uint32) (uint32, bool, error) {
+	// write lock the file
+	if err := c.wlock(); err != nil {
+		return 0, false, err
+	}
+	defer c.unlock()
+
+	done := true
+	err := c.mutate(func(h *headerBlock) error {
+		index := c.index(h)
+		db := c.data(h)
+		// Skip the empty slots in the same lock hold.
+		for ; slot < index.size; slot++ {
+			start, err := index.offset(slot)
+			if err != nil {
+				return err
+			}
+			if start == 0 {
+				continue
+			}
+			newStart, _, err := db.compactChain(start)
+			if err != nil {
+				return err
+			}
+			if newStart != start {
+				if err := index.setOffset(slot, newStart); err != nil {
+					return err
+				}
+			}
+			slot++
+			done = false
+			return nil
+		}
+		return nil
+	})
+	return slot, done, err
+}
+
+// fragmentation returns the fragmentation of the data block. See Compact.
+func (c *configManager) fragmentation() (float64, error) {
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return 0, err
+	}
+	defer c.unlock()
+
+	h, err := c.header()
+	if err != nil {
+		return 0, err
+	}
+	return c.data(h).fragmentation()
+}
@@ -0,0 +1,138 @@
+package dyconf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+// setupFragmentedFile creates a config file in which most of the early records have been deleted. It
+// returns the manager and the key-values left in it.
+func setupFragmentedFile(t *testing.T, fileName string) (ConfigManager, map[string][]byte) {
+	m, err := NewManager(fileName, WithIndexSlots(4), WithDataBlockSize(0x2000))
+	ensure.Nil(t, err)
+	expected := make(map[string][]byte)
+	for i := 0; i < 64; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		val := []byte(fmt.Sprintf("value-%d", i))
+		ensure.Nil(t, m.Set(key, val))
+		expected[key] = val
+	}
+	for i := 0; i < 48; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		ensure.Nil(t, m.Delete(key))
+		delete(expected, key)
+	}
+	return m, expected
+}
+
+func TestDyconfCompact(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfCompact-")
+	defer os.Remove(tmpFileName)
+	m, expected := setupFragmentedFile(t, tmpFileName)
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	before, err := m.(*configManager).fragmentation()
+	ensure.Nil(t, err)
+	contiguous, reclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.True(t, before > 0.5, before)
+
+	ensure.Nil(t, m.Compact(context.Background(), 0.5))
+
+	after, err := m.(*configManager).fragmentation()
+	ensure.Nil(t, err)
+	ensure.True(t, after < before, fmt.Sprintf("before: [%v], after: [%v]", before, after))
+	newContiguous, newReclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.True(t, newContiguous > contiguous)
+	ensure.True(t, newReclaimable < reclaimable)
+
+	kv, err := m.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, kv, expected)
+	for key, val := range expected {
+		actual, err := conf.Get(key)
+		ensure.Nil(t, err, key)
+		ensure.DeepEqual(t, actual, val, key)
+	}
+
+	// The freed space is usable.
+	ensure.Nil(t, m.Set("key-0", []byte("value-0")))
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfCompactBelowThreshold tests that nothing is moved if the fragmentation is below the threshold.
+func TestDyconfCompactBelowThreshold(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfCompactBelowThreshold-")
+	defer os.Remove(tmpFileName)
+	m, _ := setupFragmentedFile(t, tmpFileName)
+
+	contiguous, reclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Compact(context.Background(), 0.99))
+	newContiguous, newReclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, newContiguous, contiguous)
+	ensure.DeepEqual(t, newReclaimable, reclaimable)
+	ensure.Nil(t, m.Close())
+}
+
+func TestDyconfCompactErrors(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfCompactErrors-")
+	defer os.Remove(tmpFileName)
+	m, _ := setupFragmentedFile(t, tmpFileName)
+
+	// Case-0: Invalid threshold.
+	err := m.Compact(context.Background(), 1.5)
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: invalid fragmentation threshold \[1.5\]. It should be between \[0 - 1\]`))
+
+	// Case-1: Canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ensure.DeepEqual(t, m.Compact(ctx, 0), context.Canceled)
+	ensure.Nil(t, m.Close())
+}
+
+func TestDyconfRunCompactor(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfRunCompactor-")
+	defer os.Remove(tmpFileName)
+	m, expected := setupFragmentedFile(t, tmpFileName)
+	_, reclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+
+	// The compactor gets a manager of its own.
+	compactor, err := NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- compactor.RunCompactor(ctx, 0.5, time.Millisecond)
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		_, newReclaimable, err := m.freeDataByteCount()
+		ensure.Nil(t, err)
+		if newReclaimable < reclaimable {
+			break
+		}
+	}
+	cancel()
+	ensure.DeepEqual(t, <-done, context.Canceled)
+
+	_, newReclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.True(t, newReclaimable < reclaimable)
+	kv, err := m.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, kv, expected)
+	ensure.Nil(t, compactor.Close())
+	ensure.Nil(t, m.Close())
+}
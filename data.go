@@ -4,29 +4,93 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/facebookgo/stackerr"
 )
 
+// The fields of the data block header are as wide as the offsets of the file. The positions below are
+// those in a file with 4 byte offsets. They are twice as far in a file with 8 byte offsets. See
+// dataBlock.fieldOffset.
 const (
 	dataBlockHeaderSize = uint32(0x10)       // 16 bytes
 	maxKeySize          = uint32(0x01 << 16) // 65 KB
 	maxDataSize         = uint32(0x01 << 27) // 128 MB
 
-	dataWriteOffset = 0x00 // write offset is saved here.
-	dataSizeOffset  = 0x04 // total used size is saved here.
+	dataWriteOffset       = 0x00 // write offset is saved here.
+	dataSizeOffset        = 0x04 // total used size is saved here.
+	dataFreeListOffset    = 0x08 // offset of the free list directory is saved here. See freelist.go.
+	dataReclaimableOffset = 0x0C // number of bytes in the free lists is saved here.
 )
 
+// crcTable is used to compute the record checksums (CRC-32C).
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError is returned when a record in the data block is unreadable or fails its checksum. It
+// is an ErrCorrupt.
+type CorruptionError struct {
+	FileName string
+	Offset   uint64 // Offset of the record within the data block.
+	KeyHash  uint32 // Hash of the record's key. It is 0 if the key itself could not be read.
+	Reason   string
+
+	window string // hex dump of the bytes around the record, for the logs. See hexWindow.
+}
+
+func (e *CorruptionError) Error() string {
+	msg := fmt.Sprintf("dataBlock: corrupt record at offset [%#x] (key hash [%#x]). %s", e.Offset, e.KeyHash, e.Reason)
+	if e.FileName == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s. File: [%s]", msg, e.FileName)
+}
+
+// Is returns true for ErrCorrupt.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
 type dataStore interface {
-	save(key string, data []byte) (dataOffset, error)
-	update(start dataOffset, key string, data []byte) (dataOffset, error)
+	save(key string, data []byte, kind ValueType) (dataOffset, error)
+	update(start dataOffset, key string, data []byte, kind ValueType) (dataOffset, error)
 	fetch(start dataOffset, key string) ([]byte, bool, error)
 	reset() error
 }
 
 type dataBlock struct {
 	block []byte
+	base  dataOffset // offset of the data block in the file.
+	j     *journal   // journal of the change in progress, if any.
+	hash  hashFunc   // hash function of the file. defaultHashFunc is used if it is nil.
+	wide  bool       // the offsets in the block are 8 bytes instead of 4. See offsetSize.
+}
+
+// preserve saves the given bytes of the block in the journal before they are overwritten.
+func (db *dataBlock) preserve(offset dataOffset, size uint32) error {
+	return db.j.preserve(db.base+offset, size)
+}
+
+// fieldOffset returns the position of the given data block header field in this block.
+func (db *dataBlock) fieldOffset(field dataOffset) dataOffset {
+	if db.wide {
+		return 2 * field
+	}
+	return field
+}
+
+// headerField returns the value of the given data block header field.
+func (db *dataBlock) headerField(field dataOffset) uint64 {
+	return uint64(getOffset(db.block[db.fieldOffset(field):], db.wide))
+}
+
+// setHeaderField saves the value of the given data block header field.
+func (db *dataBlock) setHeaderField(field dataOffset, value uint64) error {
+	offset := db.fieldOffset(field)
+	if err := db.preserve(offset, offsetSize(db.wide)); err != nil {
+		return err
+	}
+	putOffset(db.block[offset:], dataOffset(value), db.wide)
+	return nil
 }
 
 func (db *dataBlock) reset() error {
@@ -34,111 +98,159 @@ func (db *dataBlock) reset() error {
 		return err
 	}
 	db.updateSize(0)
-	return nil
+	if err := db.setHeaderField(dataFreeListOffset, 0); err != nil {
+		return err
+	}
+	return db.setHeaderField(dataReclaimableOffset, 0)
 }
 
 func (db *dataBlock) updateWriteOffset(offset dataOffset) error {
-	// First 4 bytes of the header is reserved for write offset.
-	buf := &writeBuffer{buf: db.block[dataWriteOffset : dataWriteOffset+sizeOfUint32]}
-	binary.Write(buf, binary.LittleEndian, offset)
-	if buf.err != nil {
-		return stackerr.Newf("dataBlock: unable to update write offset. Err: [%s]", buf.err.Error())
-	}
-	return nil
+	return db.setHeaderField(dataWriteOffset, uint64(offset))
 }
 
 func (db *dataBlock) getWriteOffset() (dataOffset, error) {
-	buf := bytes.NewReader(db.block[:sizeOfUint32])
-	var offset dataOffset
-	if err := binary.Read(buf, binary.LittleEndian, &offset); err != nil {
-		return 0, stackerr.Newf("dataBlock: unable to fetch current write offset. Err: [%s]", err.Error())
-	}
+	offset := dataOffset(db.headerField(dataWriteOffset))
 	if offset == 0x00 {
-		return dataOffset(dataBlockHeaderSize), nil
+		return db.headerSize(), nil
 	}
 	if offset > 0x00 && offset < db.headerSize() {
-		return 0, stackerr.Newf("dataBlock: invalid write offset [%#v]. It falls within header area [0x00 - %#v]", offset, db.headerSize())
+		return 0, &FileError{
+			Offset: uint64(offset),
+			Reason: fmt.Sprintf("dataBlock: invalid write offset [%#v]. It falls within header area [0x00 - %#v]", offset, db.headerSize()),
+			Err:    ErrCorrupt,
+		}
 	}
 	return offset, nil
 }
 
-func (db *dataBlock) size() (uint32, error) {
-	buf := bytes.NewReader(db.block[dataSizeOffset : dataSizeOffset+sizeOfUint32])
-	var size uint32
-	if err := binary.Read(buf, binary.LittleEndian, &size); err != nil {
-		return 0, stackerr.Newf("dataBlock: unable to fetch total size. Err: [%s]", err.Error())
-	}
-	return size, nil
+func (db *dataBlock) size() (uint64, error) {
+	return db.headerField(dataSizeOffset), nil
 }
 
-// freeByteCount returns the number of bytes available for writing in the data block.
-// This is simply the difference between the data block length and the current write offset.
-func (db *dataBlock) freeByteCount() (uint32, error) {
+// freeByteCount returns the number of contiguous bytes available for writing at the end of the data
+// block. This is simply the difference between the data block length and the current write offset. The
+// bytes in the free lists are not included. See reclaimable.
+func (db *dataBlock) freeByteCount() (uint64, error) {
 	writeOffset, err := db.getWriteOffset()
 	if err != nil {
-		return 0, stackerr.Wrap(err)
+		return 0, err
 	}
-	return uint32(len(db.block)) - uint32(writeOffset), nil
+	return uint64(len(db.block)) - uint64(writeOffset), nil
 }
 
-func (db *dataBlock) incrSize(inc uint32) (uint32, error) {
-	size, err := db.size()
+// required returns the number of contiguous free bytes needed to store the key-value pair in the list
+// starting at the given offset. Updating an existing record in place needs no free space (see inPlace),
+// neither does a new record that fits in a free chunk. Everything else appends a new record.
+func (db *dataBlock) required(start dataOffset, key string, data []byte) (uint32, error) {
+	rec := &dataRecord{key: []byte(key), data: data, wide: db.wide}
+	if start == 0 {
+		return rec.size(), nil
+	}
+	existing, _, _, err := db.find(start, key)
 	if err != nil {
 		return 0, err
 	}
-	if err := db.updateSize(size + inc); err != nil {
+	if existing != nil && db.inPlace(existing, data) {
+		return 0, nil
+	}
+	return db.placementSize(rec)
+}
+
+// placementSize returns the number of contiguous free bytes needed to place the given record.
+func (db *dataBlock) placementSize(rec *dataRecord) (uint32, error) {
+	ok, err := db.canAllocate(rec.size())
+	if err != nil {
 		return 0, err
 	}
-	return size + inc, nil
+	if ok {
+		return 0, nil
+	}
+	return rec.size(), nil
 }
 
-func (db *dataBlock) decrSize(dec uint32) (uint32, error) {
+// place writes the given record in a free chunk that fits it, or else at the write offset. It returns
+// the offset where the record was written.
+func (db *dataBlock) place(rec *dataRecord) (dataOffset, error) {
+	offset, err := db.allocate(rec.size())
+	if err != nil {
+		return 0, err
+	}
+	if offset != 0 {
+		return offset, db.writeRecordTo(offset, rec)
+	}
+
+	offset, err = db.getWriteOffset()
+	if err != nil {
+		return 0, err
+	}
+	if err := db.writeRecordTo(offset, rec); err != nil {
+		return 0, err
+	}
+	// advance the write offset.
+	if err := db.updateWriteOffset(offset + dataOffset(rec.size())); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// inPlace returns true if the given record can be updated with the given data in place. That needs
+// data of the same size, and room in the journal to save the old record.
+func (db *dataBlock) inPlace(rec *dataRecord, data []byte) bool {
+	return len(rec.data) == len(data) && db.j.canPreserve(rec.size())
+}
+
+func (db *dataBlock) incrSize(inc uint32) (uint64, error) {
 	size, err := db.size()
 	if err != nil {
 		return 0, err
 	}
-	if err := db.updateSize(size - dec); err != nil {
+	if err := db.updateSize(size + uint64(inc)); err != nil {
 		return 0, err
 	}
-	return size - dec, nil
+	return size + uint64(inc), nil
 }
 
-func (db *dataBlock) updateSize(size uint32) error {
-	buf := &writeBuffer{buf: db.block[dataSizeOffset : dataSizeOffset+sizeOfUint32]}
-	binary.Write(buf, binary.LittleEndian, size)
-	if buf.err != nil {
-		return stackerr.Newf("dataBlock: unable to update total size. Err: [%s]", buf.err.Error())
+func (db *dataBlock) decrSize(dec uint32) (uint64, error) {
+	size, err := db.size()
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if err := db.updateSize(size - uint64(dec)); err != nil {
+		return 0, err
+	}
+	return size - uint64(dec), nil
+}
+
+func (db *dataBlock) updateSize(size uint64) error {
+	return db.setHeaderField(dataSizeOffset, size)
 }
 
 func (db *dataBlock) headerSize() dataOffset {
-	return sizeOfUint32 * 4 // reserve 16 bytes for header use.
+	return db.fieldOffset(dataOffset(dataBlockHeaderSize)) // reserve 4 fields for header use.
 }
 
-// save saves a new record and returns the offset where the record was saved.
-func (db *dataBlock) save(key string, data []byte) (dataOffset, error) {
-	if len(key) == 0 || len(data) == 0 {
-		return 0, stackerr.Newf("dataBlock: save failed. key [%s] and data [% x] must be non-zero length", key, data)
+// save saves a new record and returns the offset where the record was saved. The data may be empty.
+func (db *dataBlock) save(key string, data []byte, kind ValueType) (dataOffset, error) {
+	if len(key) == 0 {
+		return 0, stackerr.Newf("dataBlock: save failed. key [%s] must be non-zero length", key)
+	}
+	if err := checkRecordSize(key, data); err != nil {
+		return 0, err
 	}
 
 	rec := &dataRecord{
 		key:  []byte(key),
 		data: data,
+		kind: kind,
+		wide: db.wide,
 	}
-	offset, err := db.getWriteOffset()
+	offset, err := db.place(rec)
 	if err != nil {
 		return 0, err
 	}
-	if err := db.writeRecordTo(offset, rec); err != nil {
+	if _, err := db.incrSize(rec.size()); err != nil {
 		return 0, err
 	}
-
-	// advance the write offset.
-	if err := db.updateWriteOffset(offset + dataOffset(rec.size())); err != nil {
-		return 0, err
-	}
-	db.incrSize(rec.size())
 	return offset, nil
 }
 
@@ -176,18 +288,138 @@ func (db *dataBlock) fetchAll(start dataOffset) (map[string][]byte, error) {
 	return kv, nil
 }
 
+// chainLength returns the number of records in the list starting at the given offset.
+func (db *dataBlock) chainLength(start dataOffset) (uint32, error) {
+	var n uint32
+	for offset := start; offset != 0; n++ {
+		rec, err := db.readRecordFrom(offset)
+		if err != nil {
+			return 0, err
+		}
+		offset = rec.next
+	}
+	return n, nil
+}
+
+// view calls fn with the type and the data of the given key in the list starting at the given offset.
+// The records are read in place, so nothing is allocated, and the data passed to fn is a slice of the
+// data block. It returns false without calling fn if the key is not in the list.
+func (db *dataBlock) view(start dataOffset, key string, fn func(kind ValueType, data []byte) error) (bool, error) {
+	for offset := start; offset != 0; {
+		kind, recKey, data, next, err := db.recordAt(offset)
+		if err != nil {
+			return false, err
+		}
+		if string(recKey) == key {
+			return true, fn(kind, data)
+		}
+		offset = next
+	}
+	return false, nil
+}
+
+// recordAt returns the value type, the key, the data and the next pointer of the record at the given
+// offset. The key and the data are slices of the data block. The record is checked like readRecordFrom
+// does, and if it fails the checks readRecordFrom is used to report why. Only then is anything
+// allocated.
+func (db *dataBlock) recordAt(start dataOffset) (ValueType, []byte, []byte, dataOffset, error) {
+	blockSize := uint64(len(db.block))
+	keyStart := uint64(start) + 2*sizeOfUint32
+	if start < db.headerSize() || keyStart > blockSize {
+		return 0, nil, nil, 0, db.recordError(start)
+	}
+	kind, keySize := splitKeyField(binary.LittleEndian.Uint32(db.block[start:]))
+	dataSize := binary.LittleEndian.Uint32(db.block[start+sizeOfUint32:])
+	if !kind.known() || keySize > maxKeySize || dataSize > maxDataSize {
+		return 0, nil, nil, 0, db.recordError(start)
+	}
+	dataStart := keyStart + uint64(keySize)
+	nextStart := dataStart + uint64(dataSize)
+	checksumStart := nextStart + uint64(offsetSize(db.wide))
+	if checksumStart+sizeOfUint32 > blockSize {
+		return 0, nil, nil, 0, db.recordError(start)
+	}
+	checksum := binary.LittleEndian.Uint32(db.block[checksumStart:])
+	if crc32.Checksum(db.block[start:checksumStart], crcTable) != checksum {
+		return 0, nil, nil, 0, db.recordError(start)
+	}
+	return kind, db.block[keyStart:dataStart], db.block[dataStart:nextStart], getOffset(db.block[nextStart:], db.wide), nil
+}
+
+// recordError returns the error of reading the record at the given offset, which failed the checks of
+// recordAt.
+func (db *dataBlock) recordError(start dataOffset) error {
+	if _, err := db.readRecordFrom(start); err != nil {
+		return err
+	}
+	return &CorruptionError{
+		Offset: uint64(start),
+		Reason: "The record doesn't fit in the block or fails its checksum",
+		window: hexWindow(db.block, int(start)),
+	}
+}
+
+// checkRecordSize returns an error if a record can't hold the given key or data.
+func checkRecordSize(key string, data []byte) error {
+	if uint64(len(key)) > uint64(maxKeySize) {
+		return &KeyError{
+			Key:    key,
+			Reason: fmt.Sprintf("is too large. Its size [%#x] exceeds [%#x]", len(key), maxKeySize),
+			Err:    ErrKeyTooLarge,
+		}
+	}
+	if uint64(len(data)) > uint64(maxDataSize) {
+		return &KeyError{
+			Key:    key,
+			Reason: fmt.Sprintf("has a value too large to save. Its size [%#x] exceeds [%#x]", len(data), maxDataSize),
+			Err:    ErrNoSpace,
+		}
+	}
+	return nil
+}
+
 func (db *dataBlock) readRecordFrom(start dataOffset) (*dataRecord, error) {
 	if start < db.headerSize() {
-		return nil, stackerr.Newf(
-			"dataBlock: invalid start offset [%#v]. Offsets between [%#v - %#v] is reserved for data block header",
-			start,
-			0,
-			db.headerSize())
+		return nil, &FileError{
+			Offset: uint64(start),
+			Reason: fmt.Sprintf(
+				"dataBlock: invalid start offset [%#v]. Offsets between [%#v - %#v] is reserved for data block header",
+				start,
+				0,
+				db.headerSize()),
+			Err: ErrCorrupt,
+		}
 	}
 	if start >= dataOffset(len(db.block)) {
-		return nil, stackerr.Newf("dataBlock: Cannot read out of bound offset [%#v]. Block size: [%#v]", start, dataOffset(len(db.block)))
+		return nil, &FileError{
+			Offset: uint64(start),
+			Reason: fmt.Sprintf("dataBlock: Cannot read out of bound offset [%#v]. Block size: [%#v]", start, dataOffset(len(db.block))),
+			Err:    ErrCorrupt,
+		}
 	}
-	return (&dataRecord{}).read(db.block[start:])
+	rec, err := (&dataRecord{wide: db.wide}).read(db.block[start:])
+	if err != nil {
+		underlying := stackerr.Underlying(err)
+		return nil, &CorruptionError{
+			Offset: uint64(start),
+			Reason: underlying[len(underlying)-1].Error(),
+			window: hexWindow(db.block, int(start)),
+		}
+	}
+	if checksum := rec.computeChecksum(db.block[start:]); checksum != rec.checksum {
+		hash := db.hash
+		if hash == nil {
+			hash = defaultHashFunc
+		}
+		keyHash, _ := hash(string(rec.key))
+		return nil, &CorruptionError{
+			Offset:  uint64(start),
+			KeyHash: keyHash,
+			Reason:  fmt.Sprintf("Checksum mismatch. stored: [%#x], computed: [%#x]", rec.checksum, checksum),
+			window:  hexWindow(db.block, int(start)),
+		}
+	}
+	return rec, nil
 }
 
 func (db *dataBlock) writeRecordTo(start dataOffset, rec *dataRecord) error {
@@ -199,21 +431,29 @@ func (db *dataBlock) writeRecordTo(start dataOffset, rec *dataRecord) error {
 			db.headerSize())
 	}
 	if start >= dataOffset(len(db.block)) {
-		return stackerr.Newf("dataBlock: Cannot write to offset [%#v]. Block size: [%#v]", start, dataOffset(len(db.block)))
+		return &FileError{
+			Offset: uint64(start),
+			Reason: fmt.Sprintf("dataBlock: Cannot write to offset [%#v]. Block size: [%#v]", start, dataOffset(len(db.block))),
+			Err:    ErrNoSpace,
+		}
 	}
 
 	end := start + dataOffset(rec.size())
 	if end > dataOffset(len(db.block)) {
-		return stackerr.Newf(
-			"dataBlock: Cannot write to offset [%#v]. Record [%#v bytes] exceeds data block boundary [%#v]",
-			start,
-			rec.size(),
-			dataOffset(len(db.block)),
-		)
+		return &FileError{
+			Offset: uint64(start),
+			Reason: fmt.Sprintf(
+				"dataBlock: Cannot write to offset [%#v]. Record [%#v bytes] exceeds data block boundary [%#v]",
+				start,
+				rec.size(),
+				dataOffset(len(db.block)),
+			),
+			Err: ErrNoSpace,
+		}
 	}
 	err := rec.write(db.block[start:end])
 	if err != nil {
-		return stackerr.Newf("dataBlock[NEW]: Cannot write to offset [%#v]. Block state: \n%s\n Err: [%s]", start, spew.Sdump(db.block), err.Error())
+		return stackerr.Newf("dataBlock[NEW]: Cannot write to offset [%#v]. Block state: %s\n Err: [%s]", start, hexWindow(db.block, int(start)), err.Error())
 	}
 	return nil
 }
@@ -247,7 +487,7 @@ func (db *dataBlock) find(start dataOffset, key string) (*dataRecord, dataOffset
 	return nil, 0, prevOffset, nil
 }
 
-func (db *dataBlock) update(start dataOffset, key string, data []byte) (dataOffset, error) {
+func (db *dataBlock) update(start dataOffset, key string, data []byte, kind ValueType) (dataOffset, error) {
 	rec, offset, prevOffset, err := db.find(start, key)
 	if err != nil {
 		return 0, err
@@ -256,7 +496,7 @@ func (db *dataBlock) update(start dataOffset, key string, data []byte) (dataOffs
 	// Case-1: The record is nil (not found). Just save a new record and adjust the previous record
 	// to point to the newly added record. There will always be a previous record.
 	if rec == nil {
-		offset, err := db.save(key, data)
+		offset, err := db.save(key, data, kind)
 		if err != nil {
 			return 0, err
 		}
@@ -266,38 +506,36 @@ func (db *dataBlock) update(start dataOffset, key string, data []byte) (dataOffs
 		if err != nil {
 			return 0, err
 		}
-		prevRec.next = offset
-		err = db.writeRecordTo(prevOffset, prevRec)
-		if err != nil {
+		if err := db.setNext(prevOffset, prevRec, offset); err != nil {
 			return 0, err
 		}
 
 		return start, nil
 	}
 
-	// Case-2. Record was found. But The new data is not an exact fit. So, add a new record and adjust
-	// previous record if required.
-	if len(rec.data) != len(data) {
-		recOldSize := rec.size()
-		// Save the new data in the record and rewrite it at the current write offset
-		rec.data = data
-		offset, err := db.getWriteOffset()
+	// Case-2. Record was found. But The new data is not an exact fit, or the old record is too large to
+	// be journaled. So, add a new record and adjust previous record if required.
+	if !db.inPlace(rec, data) {
+		oldOffset, recOldSize := offset, rec.size()
+		// Save the new data in the record and rewrite it in a free chunk or at the current write offset.
+		rec.data, rec.kind = data, kind
+		offset, err := db.place(rec)
 		if err != nil {
 			return 0, err
 		}
+		// The old record is free now.
+		if err := db.free(oldOffset, recOldSize); err != nil {
+			return 0, err
+		}
 
-		if err := db.writeRecordTo(offset, rec); err != nil {
+		// update total size used.
+		if _, err := db.incrSize(rec.size()); err != nil {
 			return 0, err
 		}
-		// advance the write pointer.
-		if err := db.updateWriteOffset(offset + dataOffset(rec.size())); err != nil {
+		if _, err := db.decrSize(recOldSize); err != nil {
 			return 0, err
 		}
 
-		// update total size used.
-		db.incrSize(rec.size())
-		db.decrSize(recOldSize)
-
 		// If there was no previous record, then this was the first record.
 		// It was moved because it didn't fit in it's previous offset. Return it's new offset.
 		if prevOffset == 0 {
@@ -310,16 +548,17 @@ func (db *dataBlock) update(start dataOffset, key string, data []byte) (dataOffs
 		if err != nil {
 			return 0, err
 		}
-		prevRec.next = offset
-		err = db.writeRecordTo(prevOffset, prevRec)
-		if err != nil {
+		if err := db.setNext(prevOffset, prevRec, offset); err != nil {
 			return 0, err
 		}
 		return start, nil
 	}
 
 	// Case-3: The record was found and the new data is an exact fit in the current space.
-	rec.data = data
+	rec.data, rec.kind = data, kind
+	if err := db.preserve(offset, rec.size()); err != nil {
+		return 0, err
+	}
 	if err := db.writeRecordTo(offset, rec); err != nil {
 		return 0, err
 	}
@@ -327,8 +566,35 @@ func (db *dataBlock) update(start dataOffset, key string, data []byte) (dataOffs
 	return start, nil
 }
 
+// setNext points the record saved at the given offset to the next offset. Only the next pointer and
+// the checksum of the record are rewritten.
+func (db *dataBlock) setNext(start dataOffset, rec *dataRecord, next dataOffset) error {
+	end := start + dataOffset(rec.size())
+	if end > dataOffset(len(db.block)) {
+		return &FileError{
+			Offset: uint64(start),
+			Reason: fmt.Sprintf(
+				"dataBlock: Cannot update the record at offset [%#v]. Record [%#v bytes] exceeds data block boundary [%#v]",
+				start,
+				rec.size(),
+				dataOffset(len(db.block)),
+			),
+			Err: ErrCorrupt,
+		}
+	}
+	nextOffset := end - dataOffset(offsetSize(rec.wide)+sizeOfUint32)
+	if err := db.preserve(nextOffset, offsetSize(rec.wide)+sizeOfUint32); err != nil {
+		return err
+	}
+	rec.next = next
+	putOffset(db.block[nextOffset:], next, rec.wide)
+	rec.checksum = rec.computeChecksum(db.block[start:end])
+	binary.LittleEndian.PutUint32(db.block[end-sizeOfUint32:], rec.checksum)
+	return nil
+}
+
 func (db *dataBlock) delete(start dataOffset, key string) (dataOffset, error) {
-	rec, _, prevOffset, err := db.find(start, key)
+	rec, offset, prevOffset, err := db.find(start, key)
 	if err != nil {
 		return 0, err
 	}
@@ -337,9 +603,16 @@ func (db *dataBlock) delete(start dataOffset, key string) (dataOffset, error) {
 		return start, nil
 	}
 
+	// The record is free now.
+	if err := db.free(offset, rec.size()); err != nil {
+		return 0, err
+	}
+
 	// rec is at the start of the list.
 	if prevOffset == 0 {
-		db.decrSize(rec.size())
+		if _, err := db.decrSize(rec.size()); err != nil {
+			return 0, err
+		}
 		return rec.next, nil
 	}
 
@@ -349,37 +622,89 @@ func (db *dataBlock) delete(start dataOffset, key string) (dataOffset, error) {
 	if err != nil {
 		return 0, err
 	}
-	prevRec.next = rec.next
-	err = db.writeRecordTo(prevOffset, prevRec)
-	if err != nil {
+	if err := db.setNext(prevOffset, prevRec, rec.next); err != nil {
 		return 0, err
 	}
 
-	db.decrSize(rec.size())
+	if _, err := db.decrSize(rec.size()); err != nil {
+		return 0, err
+	}
 	return start, nil
 }
 
+// compactChain moves the records of the list starting at the given offset into free chunks before them.
+// It returns the new start of the list, which changes if the first record is moved, and whether any
+// record was moved.
+func (db *dataBlock) compactChain(start dataOffset) (dataOffset, bool, error) {
+	var prevOffset dataOffset
+	var prevRec *dataRecord
+	moved := false
+	for offset := start; offset != 0; {
+		rec, err := db.readRecordFrom(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		newOffset, err := db.allocateBelow(rec.size(), offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if newOffset != 0 {
+			if err := db.writeRecordTo(newOffset, rec); err != nil {
+				return 0, false, err
+			}
+			if prevRec == nil {
+				start = newOffset
+			} else if err := db.setNext(prevOffset, prevRec, newOffset); err != nil {
+				return 0, false, err
+			}
+			if err := db.free(offset, rec.size()); err != nil {
+				return 0, false, err
+			}
+			offset, moved = newOffset, true
+		}
+		prevOffset, prevRec = offset, rec
+		offset = rec.next
+	}
+	return start, moved, nil
+}
+
 type record interface {
 	read([]byte) (*dataRecord, error)
 	write([]byte)
 	size() uint32
 }
 
+// dataRecord is saved in the data block as below. The checksum is a CRC-32C of all the preceding fields.
+//
+//	key size  4 bytes (the top byte holds the value type in files with featureValueTypes)
+//	data size 4 bytes
+//	key       (key size) bytes
+//	data      (data size) bytes
+//	next      4 bytes (8 bytes in files with featureWideOffsets)
+//	checksum  4 bytes
 type dataRecord struct {
-	key  []byte
-	data []byte
-	next dataOffset
+	key      []byte
+	data     []byte
+	kind     ValueType
+	next     dataOffset
+	checksum uint32
+	wide     bool // the next pointer is 8 bytes instead of 4. See offsetSize.
 }
 
 func (r *dataRecord) read(block []byte) (*dataRecord, error) {
 	buf := bytes.NewReader(block)
 
 	// read key size.
-	var keySize uint32
-	err := binary.Read(buf, binary.LittleEndian, &keySize)
+	var keyField uint32
+	err := binary.Read(buf, binary.LittleEndian, &keyField)
 	if err != nil {
 		return nil, stackerr.Newf("dataRecord: failed to read the key size. error: [%s]", err.Error())
 	}
+	var keySize uint32
+	r.kind, keySize = splitKeyField(keyField)
+	if !r.kind.known() {
+		return nil, stackerr.Newf("dataRecord: failed to read the key. Unknown value type [%d]", r.kind)
+	}
 	if keySize > maxKeySize {
 		return nil, stackerr.Newf("dataRecord: failed to read the key (size=%#v). It exceeds max size [%#v]", keySize, maxKeySize)
 	}
@@ -388,7 +713,7 @@ func (r *dataRecord) read(block []byte) (*dataRecord, error) {
 	var dataSize uint32
 	err = binary.Read(buf, binary.LittleEndian, &dataSize)
 	if err != nil {
-		return nil, stackerr.Newf("dataRecord: failed to read the data size. error: [%s]. Block: \n%s\n", err.Error(), spew.Sdump(block))
+		return nil, stackerr.Newf("dataRecord: failed to read the data size. error: [%s]. Block: %s", err.Error(), hexWindow(block, int(buf.Size())-buf.Len()))
 	}
 	if dataSize > maxDataSize {
 		return nil, stackerr.Newf("dataRecord: failed to read the data (size=%#v). It exceeds max size [%#v]", dataSize, maxDataSize)
@@ -398,41 +723,60 @@ func (r *dataRecord) read(block []byte) (*dataRecord, error) {
 	r.key = make([]byte, keySize)
 	err = binary.Read(buf, binary.LittleEndian, &r.key)
 	if err != nil {
-		return nil, stackerr.Newf("dataRecord: failed to read the key. error: [%s]. Block: \n%s\n", err.Error(), spew.Sdump(block))
+		return nil, stackerr.Newf("dataRecord: failed to read the key. error: [%s]. Block: %s", err.Error(), hexWindow(block, int(buf.Size())-buf.Len()))
 	}
 
 	// allocate data and then read into it.
 	r.data = make([]byte, dataSize)
 	err = binary.Read(buf, binary.LittleEndian, &r.data)
 	if err != nil {
-		return nil, stackerr.Newf("dataRecord: failed to read the data. error: [%s]. Block: \n%s\n", err.Error(), spew.Sdump(block))
+		return nil, stackerr.Newf("dataRecord: failed to read the data. error: [%s]. Block: %s", err.Error(), hexWindow(block, int(buf.Size())-buf.Len()))
 	}
 
 	// Finally read the next pointer.
-	err = binary.Read(buf, binary.LittleEndian, &r.next)
+	next := make([]byte, offsetSize(r.wide))
+	err = binary.Read(buf, binary.LittleEndian, next)
 	if err != nil {
-		return nil, stackerr.Newf("dataRecord: failed to read the next pointer. error: [%s]. Block: \n%s\n", err.Error(), spew.Sdump(block))
+		return nil, stackerr.Newf("dataRecord: failed to read the next pointer. error: [%s]. Block: %s", err.Error(), hexWindow(block, int(buf.Size())-buf.Len()))
+	}
+	r.next = getOffset(next, r.wide)
+
+	// And the checksum.
+	err = binary.Read(buf, binary.LittleEndian, &r.checksum)
+	if err != nil {
+		return nil, stackerr.Newf("dataRecord: failed to read the checksum. error: [%s]. Block: %s", err.Error(), hexWindow(block, int(buf.Size())-buf.Len()))
 	}
 
 	return r, nil
 }
 
+// computeChecksum returns the checksum of the record saved at the start of the given block. It covers
+// everything except the checksum field itself.
+func (r *dataRecord) computeChecksum(block []byte) uint32 {
+	return crc32.Checksum(block[:r.size()-sizeOfUint32], crcTable)
+}
+
 func (r *dataRecord) write(block []byte) error {
 	if r.size() > uint32(len(block)) {
 		return stackerr.Newf("Unable to write the key [%s]. bytes available: [%d], needed: [%d].", string(r.key), len(block), r.size())
 	}
 	buf := &writeBuffer{buf: block}
 	// Just write in one order. The error if any will be caught and cached in buf.Write
-	binary.Write(buf, binary.LittleEndian, r.keySize())
+	binary.Write(buf, binary.LittleEndian, r.keyField())
 	binary.Write(buf, binary.LittleEndian, r.dataSize())
 	binary.Write(buf, binary.LittleEndian, r.key)
 	binary.Write(buf, binary.LittleEndian, r.data)
-	binary.Write(buf, binary.LittleEndian, r.next)
+	next := make([]byte, offsetSize(r.wide))
+	putOffset(next, r.next, r.wide)
+	binary.Write(buf, binary.LittleEndian, next)
 
 	// Check if there any error in writing.
 	if buf.err != nil {
 		return stackerr.Newf("Unable to write the key [%s]. Total space needed: [%d]. Details: %s", string(r.key), r.size(), buf.err.Error())
 	}
+
+	r.checksum = r.computeChecksum(block)
+	binary.LittleEndian.PutUint32(block[r.size()-sizeOfUint32:], r.checksum)
 	return nil
 }
 
@@ -442,7 +786,8 @@ func (r *dataRecord) size() uint32 {
 	size += sizeOfUint32        // dataSize field
 	size += uint32(len(r.key))  // key field
 	size += uint32(len(r.data)) // data field
-	size += sizeOfUint32        // next field
+	size += offsetSize(r.wide)  // next field
+	size += sizeOfUint32        // checksum field
 	return size
 }
 
@@ -450,6 +795,16 @@ func (r *dataRecord) keySize() uint32 {
 	return uint32(len(r.key))
 }
 
+// keyField returns the key size field of the record, which holds the value type in its top byte.
+func (r *dataRecord) keyField() uint32 {
+	return uint32(r.kind)<<24 | r.keySize()
+}
+
+// splitKeyField returns the value type and the key size saved in the key size field of a record.
+func splitKeyField(field uint32) (ValueType, uint32) {
+	return ValueType(field >> 24), field & 0x00FFFFFF
+}
+
 func (r *dataRecord) dataSize() uint32 {
 	return uint32(len(r.data))
 }
@@ -1,7 +1,9 @@
 package dyconf
 
 import (
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"regexp"
 	"testing"
 
@@ -9,7 +11,7 @@ import (
 )
 
 const (
-	recordOverheadBytes = 12
+	recordOverheadBytes = 16
 )
 
 func concatBytes(slices ...[]byte) []byte {
@@ -20,6 +22,12 @@ func concatBytes(slices ...[]byte) []byte {
 	return ret
 }
 
+// withChecksum appends the checksum to the given record bytes.
+func withChecksum(rec ...byte) []byte {
+	sum := crc32.Checksum(rec, crcTable)
+	return append(rec, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24))
+}
+
 func headerBytes(b ...byte) []byte {
 	l := uint32(len(b))
 	b = append(b, make([]byte, dataBlockHeaderSize-l)...)
@@ -37,13 +45,13 @@ func TestDataBlockFetch(t *testing.T) {
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(),
-					[]byte{
+					withChecksum(
 						0x07, 0x00, 0x00, 0x00, // key size
 						0x09, 0x00, 0x00, 0x00, // data size
 						0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 						0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
 						0x00, 0x00, 0x00, 0x00, // next (0)
-					},
+					),
 				),
 			},
 			startOffset:   0x10,
@@ -54,19 +62,21 @@ func TestDataBlockFetch(t *testing.T) {
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(),
-					[]byte{ // record-1
+					withChecksum( // record-1
 						0x04, 0x00, 0x00, 0x00, // key size
 						0x04, 0x00, 0x00, 0x00, // data size
 						0x44, 0x44, 0x44, 0x44, // key (Junk)
 						0x44, 0x44, 0x44, 0x44, // data (Junk)
-						0x24, 0x00, 0x00, 0x00, // next (0x20)
-
+						0x28, 0x00, 0x00, 0x00, // next (0x28)
+					),
+					withChecksum(
 						0x07, 0x00, 0x00, 0x00, // key size
 						0x09, 0x00, 0x00, 0x00, // data size
 						0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 						0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
 						0xFF, 0xFF, 0xFF, 0xFF, // next (0xFFFFFFFF). This should not be read.
-
+					),
+					[]byte{
 						0x44, 0x44, 0x44, 0x44, // Junk
 						0x44, 0x44, 0x44, 0x44, // Junk
 					},
@@ -113,10 +123,10 @@ func TestDataBlockFetchErrors(t *testing.T) {
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(),
-					[]byte{
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
 						0x41, 0x41, 0x31, 0x31, 0xFF, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0xFF)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
@@ -127,29 +137,48 @@ func TestDataBlockFetchErrors(t *testing.T) {
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(),
-					[]byte{
+					withChecksum(
 						0x01, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (0x10001), data size (2)
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x00)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
 			key:            "NonExistingKey",
-			expectedErrStr: `^dataRecord: failed to read the key \(size=0x10001\). It exceeds max size \[0x10000\]*`,
+			expectedErrStr: `^dataBlock: corrupt record at offset \[0x10\] \(key hash \[0x0\]\). dataRecord: failed to read the key \(size=0x10001\). It exceeds max size \[0x10000\]*`,
 		},
 		{ // Case-4: data size exceeds max data size
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(),
-					[]byte{
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x08, // key size (0x10001), data size (0x0800000)
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x00)
+					),
+				),
+			},
+			startOffset:    0x10,
+			key:            "NonExistingKey",
+			expectedErrStr: `^dataBlock: corrupt record at offset \[0x10\] \(key hash \[0x0\]\). dataRecord: failed to read the data \(size=0x8000001\). It exceeds max size \[0x8000000\]`,
+		},
+		{ // Case-5: checksum mismatch in the second record.
+			db: &dataBlock{
+				block: concatBytes(
+					headerBytes(),
+					withChecksum(
+						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
+						0x41, 0x41, 0x31, 0x31, 0x24, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x24)
+					),
+					[]byte{
+						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
+						0x42, 0x42, 0x32, 0x32, 0x00, 0x00, 0x00, 0x00, // key (BB), Data (22), next(0x00)
+						0xDD, 0xCC, 0xBB, 0xAA, // checksum (0xAABBCCDD)
 					},
 				),
 			},
 			startOffset:    0x10,
 			key:            "NonExistingKey",
-			expectedErrStr: `^dataRecord: failed to read the data \(size=0x8000001\). It exceeds max size \[0x8000000\]`,
+			expectedErrStr: `^dataBlock: corrupt record at offset \[0x24\] \(key hash \[0x[0-9a-f]+\]\). Checksum mismatch. stored: \[0xaabbccdd\], computed: \[0x[0-9a-f]+\]`,
 		},
 	}
 
@@ -161,6 +190,24 @@ func TestDataBlockFetchErrors(t *testing.T) {
 	}
 }
 
+// TestDataBlockCorruption tests that a corrupted record is reported with its offset and key hash.
+func TestDataBlockCorruption(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x40)}
+	ensure.Nil(t, db.reset())
+	offset, err := db.save("key", []byte("value"), TypeBytes)
+	ensure.Nil(t, err)
+
+	// Flip a bit of the data.
+	db.block[int(offset)+recordOverheadBytes-sizeOfUint32*2+len("key")] ^= 0x01
+	_, _, err = db.fetch(offset, "key")
+	corruptionErr, ok := err.(*CorruptionError)
+	ensure.True(t, ok, err)
+	expectedKeyHash, err := defaultHashFunc("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, corruptionErr.Offset, uint64(offset))
+	ensure.DeepEqual(t, corruptionErr.KeyHash, expectedKeyHash)
+}
+
 func TestDataBlockFetchNonExisting(t *testing.T) {
 	cases := []struct {
 		db             *dataBlock
@@ -172,10 +219,10 @@ func TestDataBlockFetchNonExisting(t *testing.T) {
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(),
-					[]byte{
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x00)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
@@ -192,6 +239,117 @@ func TestDataBlockFetchNonExisting(t *testing.T) {
 	}
 }
 
+func TestDataBlockView(t *testing.T) {
+	db := &dataBlock{
+		block: concatBytes(
+			headerBytes(),
+			withChecksum( // record-1
+				0x04, 0x00, 0x00, 0x00, // key size
+				0x04, 0x00, 0x00, 0x00, // data size
+				0x44, 0x44, 0x44, 0x44, // key (DDDD)
+				0x44, 0x44, 0x44, 0x44, // data (DDDD)
+				0x28, 0x00, 0x00, 0x00, // next (0x28)
+			),
+			withChecksum(
+				0x07, 0x00, 0x00, 0x00, // key size
+				0x09, 0x00, 0x00, 0x00, // data size
+				0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
+				0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
+				0x00, 0x00, 0x00, 0x00, // next (0)
+			),
+		),
+	}
+	cases := []struct {
+		key           string
+		expectedFound bool
+		expectedBytes []byte
+	}{
+		{ // Case-0: Key is at the head of the list.
+			key:           "DDDD",
+			expectedFound: true,
+			expectedBytes: []byte("DDDD"),
+		},
+		{ // Case-1: Key is at the end of the list.
+			key:           "TestKey",
+			expectedFound: true,
+			expectedBytes: []byte("TestValue"),
+		},
+		{ // Case-2: Key is not in the list.
+			key:           "NonExistingKey",
+			expectedFound: false,
+		},
+	}
+
+	for i, tc := range cases {
+		var data []byte
+		found, err := db.view(0x10, tc.key, func(_ ValueType, d []byte) error {
+			data = d
+			return nil
+		})
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, found, tc.expectedFound, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, data, tc.expectedBytes, fmt.Sprintf("Case: [%d]", i))
+	}
+
+	// The error of fn is returned as is.
+	fnErr := errors.New("fn failed")
+	_, err := db.view(0x10, "TestKey", func(ValueType, []byte) error { return fnErr })
+	ensure.True(t, err == fnErr, err)
+
+	// Nothing is allocated to find a key, or to find that it doesn't exist.
+	allocs := testing.AllocsPerRun(100, func() {
+		db.view(0x10, "TestKey", func(ValueType, []byte) error { return nil })
+		db.view(0x10, "NonExistingKey", func(ValueType, []byte) error { return nil })
+	})
+	ensure.DeepEqual(t, allocs, float64(0))
+}
+
+// TestDataBlockViewErrors tests that view reports the same errors as fetch.
+func TestDataBlockViewErrors(t *testing.T) {
+	cases := []*dataBlock{
+		{ // Case-0: out of bound access while traversing.
+			block: concatBytes(
+				headerBytes(),
+				withChecksum(
+					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
+					0x41, 0x41, 0x31, 0x31, 0xFF, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0xFF)
+				),
+			),
+		},
+		{ // Case-1: record is truncated.
+			block: concatBytes(
+				headerBytes(),
+				[]byte{
+					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
+					0x41, 0x41, 0x31, // key (AA), Data (1 of 2 bytes)
+				},
+			),
+		},
+		{ // Case-2: checksum mismatch in the second record.
+			block: concatBytes(
+				headerBytes(),
+				withChecksum(
+					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
+					0x41, 0x41, 0x31, 0x31, 0x24, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x24)
+				),
+				[]byte{
+					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
+					0x42, 0x42, 0x32, 0x32, 0x00, 0x00, 0x00, 0x00, // key (BB), Data (22), next(0x00)
+					0xDD, 0xCC, 0xBB, 0xAA, // checksum (0xAABBCCDD)
+				},
+			),
+		},
+	}
+
+	for i, db := range cases {
+		_, _, expectedErr := db.fetch(0x10, "NonExistingKey")
+		ensure.NotNil(t, expectedErr, fmt.Sprintf("Case: [%d]", i))
+		found, err := db.view(0x10, "NonExistingKey", func(ValueType, []byte) error { return nil })
+		ensure.False(t, found, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, err.Error(), expectedErr.Error(), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
 func TestDataBlockUpdates(t *testing.T) {
 	cases := []struct {
 		db                 *dataBlock
@@ -205,12 +363,12 @@ func TestDataBlockUpdates(t *testing.T) {
 			db: &dataBlock{
 				block: concatBytes(
 					headerBytes(0x10, 0x00, 0x00, 0x00), // write offset (0x10)
-					[]byte{
+					withChecksum(
 						0x07, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, // data size and key size
 						0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 						0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
 						0x00, 0x00, 0x00, 0x00, // next (0)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
@@ -218,63 +376,59 @@ func TestDataBlockUpdates(t *testing.T) {
 			data:           []byte("TESTTEST1"),
 			expectedOffset: 0x10,
 			expectedBlockState: concatBytes(
-				headerBytes(0x10, 0x00, 0x00, 0x00), // write offset (0x24)
-				[]byte{
+				headerBytes(0x10, 0x00, 0x00, 0x00), // write offset (0x10)
+				withChecksum(
 					0x07, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, // data size and key size
 					0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 					0x54, 0x45, 0x53, 0x54, 0x54, 0x45, 0x53, 0x54, 0x31, // data (TESTTEST1)
 					0x00, 0x00, 0x00, 0x00, // next (0)
-				},
+				),
 			),
 		},
 		{ // Case-1: Key is at the head of the list and the new data size is different from previous one.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x20, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00), // write offset (0x20), total size (0x10)
-					[]byte{
+					headerBytes(0x24, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00), // write offset (0x24), total size (0x14)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
-						0x41, 0x41, 0x31, 0x31, 0x20, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x20)
-
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-					},
+						0x41, 0x41, 0x31, 0x31, 0x24, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x24)
+					),
+					make([]byte, 0x1C), // buffer
 				),
 			},
 			startOffset:    0x10,
 			key:            "AA",
 			data:           []byte("NewData"),
-			expectedOffset: 0x20,
+			expectedOffset: 0x24,
 			expectedBlockState: concatBytes(
-				headerBytes(0x35, 0x00, 0x00, 0x00, 0x15, 0x00, 0x00, 0x00), // write offset (0x35), total size (0x15)
-				[]byte{
-					// Abandoned record.
+				headerBytes(0x3D, 0x00, 0x00, 0x00, 0x19, 0x00, 0x00, 0x00), // write offset (0x3D), total size (0x19)
+				// Abandoned record.
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
-					0x41, 0x41, 0x31, 0x31, 0x20, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x20)
-
-					// new record.
+					0x41, 0x41, 0x31, 0x31, 0x24, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x24)
+				),
+				// new record.
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, // key size (2), data size (7)
 					0x41, 0x41, 0x4E, 0x65, 0x77, 0x44, 0x61, 0x74, 0x61, // key (AA), Data (NewData)
-					0x20, 0x00, 0x00, 0x00, // next(0x20)
-					0x00, 0x00, 0x00, // buffer
-				},
+					0x24, 0x00, 0x00, 0x00, // next(0x24)
+				),
+				[]byte{0x00, 0x00, 0x00}, // buffer
 			),
 		},
 		{ // Case-2: Key is at the middle of the list and the new data size is different from previous one.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x30, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00), // write offset (0x30), total size (0x20)
-					[]byte{
+					headerBytes(0x38, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00), // write offset (0x38), total size (0x28)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
-						0x41, 0x41, 0x31, 0x31, 0x20, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x20)
-
+						0x41, 0x41, 0x31, 0x31, 0x24, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x24)
+					),
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
 						0x42, 0x42, 0x32, 0x32, 0xF0, 0xE0, 0xD0, 0xC0, // key (BB), Data (22), next(0xC0D0E0F0)
-
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-					},
+					),
+					make([]byte, 0x1C), // buffer
 				),
 			},
 			startOffset:    0x10,
@@ -282,35 +436,34 @@ func TestDataBlockUpdates(t *testing.T) {
 			data:           []byte("NewData"),
 			expectedOffset: 0x10,
 			expectedBlockState: concatBytes(
-				headerBytes(0x45, 0x00, 0x00, 0x00, 0x25, 0x00, 0x00, 0x00), // write offset (0x45), total size (0x25)
-				[]byte{
+				headerBytes(0x51, 0x00, 0x00, 0x00, 0x2D, 0x00, 0x00, 0x00), // write offset (0x51), total size (0x2D)
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
-					0x41, 0x41, 0x31, 0x31, 0x30, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x30)
-
-					// abandoned record.
+					0x41, 0x41, 0x31, 0x31, 0x38, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x38)
+				),
+				// abandoned record.
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size (2), data size (2)
 					0x42, 0x42, 0x32, 0x32, 0xF0, 0xE0, 0xD0, 0xC0, // key (BB), Data (22), next(0xC0D0E0F0)
-
-					// New record.
+				),
+				// New record.
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00, // key size (2), data size (7)
 					0x42, 0x42, 0x4E, 0x65, 0x77, 0x44, 0x61, 0x74, 0x61, // key (BB), Data (NewData)
 					0xF0, 0xE0, 0xD0, 0xC0, //  next(0xC0D0E0F0)
-
-					0x00, 0x00, 0x00, // buffer
-				},
+				),
+				[]byte{0x00, 0x00, 0x00}, // buffer
 			),
 		},
 		{ // Case-3: Key was not found.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x20, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00), // write offset (0x20), total size (0x10)
-					[]byte{
+					headerBytes(0x24, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00), // write offset (0x24), total size (0x14)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x00)
-
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-					},
+					),
+					make([]byte, 0x14), // buffer
 				),
 			},
 			startOffset:    0x10,
@@ -318,21 +471,22 @@ func TestDataBlockUpdates(t *testing.T) {
 			data:           []byte("22"),
 			expectedOffset: 0x10,
 			expectedBlockState: concatBytes(
-				headerBytes(0x30, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00), // write offset (0x30), total size (0x20)
-				[]byte{
+				headerBytes(0x38, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00), // write offset (0x38), total size (0x28)
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
-					0x41, 0x41, 0x31, 0x31, 0x20, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x20)
-
-					// new record.
+					0x41, 0x41, 0x31, 0x31, 0x24, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0x24)
+				),
+				// new record.
+				withChecksum(
 					0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
-					0x42, 0x42, 0x32, 0x32, 0x00, 0x00, 0x00, 0x00, // key (BB), Data (22), next(0x20)
-				},
+					0x42, 0x42, 0x32, 0x32, 0x00, 0x00, 0x00, 0x00, // key (BB), Data (22), next(0x00)
+				),
 			),
 		},
 	}
 
 	for i, tc := range cases {
-		offset, err := tc.db.update(tc.startOffset, tc.key, tc.data)
+		offset, err := tc.db.update(tc.startOffset, tc.key, tc.data, TypeBytes)
 		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
 		ensure.DeepEqual(t, offset, tc.expectedOffset, fmt.Sprintf("Case: [%d]", i))
 		ensure.DeepEqual(t, tc.db.block, tc.expectedBlockState, fmt.Sprintf("Case: [%d]", i))
@@ -357,43 +511,42 @@ func TestDataBlockUpdateErrors(t *testing.T) {
 		{ // case-1: No space to update the list with a new key.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x20, 0x00, 0x00, 0x00), // write offset (0x20)
-					[]byte{
+					headerBytes(0x24, 0x00, 0x00, 0x00), // write offset (0x24)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
 			key:            "key",
 			data:           []byte("value"),
-			expectedErrStr: `^dataBlock: Cannot write to offset \[0x20\]. Block size: \[0x20\]*`,
+			expectedErrStr: `^dataBlock: Cannot write to offset \[0x24\]. Block size: \[0x24\]*`,
 		},
 		{ // case-2: No space to update the list. Key exists but the data doesn't fit.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x20, 0x00, 0x00, 0x00), // write offset (0x20)
-					[]byte{
+					headerBytes(0x24, 0x00, 0x00, 0x00), // write offset (0x24)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0)
-
-						0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // buffer
-					},
+					),
+					make([]byte, 0x08), // buffer
 				),
 			},
 			startOffset:    0x10,
 			key:            "AA",
 			data:           []byte("value"),
-			expectedErrStr: `^dataBlock: Cannot write to offset \[0x20\]. Record \[0x13 bytes\] exceeds data block boundary \[0x28\]`,
+			expectedErrStr: `^dataBlock: Cannot write to offset \[0x24\]. Record \[0x17 bytes\] exceeds data block boundary \[0x2c\]`,
 		},
 		{ // case-3: It's an existing key with bigger data. Cannot be added because of a bad write offset.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x05, 0x00, 0x00, 0x00), // write offset (0x20)
-					[]byte{
+					headerBytes(0x05, 0x00, 0x00, 0x00), // write offset (0x05)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
@@ -404,11 +557,11 @@ func TestDataBlockUpdateErrors(t *testing.T) {
 		{ // case-3: It's a new key but cannot be added because of a bad write offset.
 			db: &dataBlock{
 				block: concatBytes(
-					headerBytes(0x05, 0x00, 0x00, 0x00), // write offset (0x20)
-					[]byte{
+					headerBytes(0x05, 0x00, 0x00, 0x00), // write offset (0x05)
+					withChecksum(
 						0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
 						0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0)
-					},
+					),
 				),
 			},
 			startOffset:    0x10,
@@ -419,12 +572,68 @@ func TestDataBlockUpdateErrors(t *testing.T) {
 	}
 
 	for i, tc := range cases {
-		offset, err := tc.db.update(tc.startOffset, tc.key, tc.data)
+		offset, err := tc.db.update(tc.startOffset, tc.key, tc.data, TypeBytes)
 		ensure.True(t, (offset == 0), fmt.Sprintf("Case: [%d]. offset [%#v] should be 0", i, offset))
 		ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
 	}
 }
 
+// TestDataBlockRequired tests the computation of free space needed to store a key-value pair.
+func TestDataBlockRequired(t *testing.T) {
+	db := &dataBlock{
+		block: concatBytes(
+			headerBytes(0x24, 0x00, 0x00, 0x00), // write offset (0x24)
+			withChecksum(
+				0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, // key size, data size
+				0x41, 0x41, 0x31, 0x31, 0x00, 0x00, 0x00, 0x00, // key (AA), Data (11), next(0)
+			),
+		),
+	}
+	cases := []struct {
+		startOffset dataOffset
+		key         string
+		data        []byte
+		expected    uint32
+	}{
+		{ // Case-0: empty list.
+			startOffset: 0,
+			key:         "AA",
+			data:        []byte("22"),
+			expected:    0x14,
+		},
+		{ // Case-1: existing key with same size data is updated in place.
+			startOffset: 0x10,
+			key:         "AA",
+			data:        []byte("22"),
+			expected:    0,
+		},
+		{ // Case-2: existing key with bigger data.
+			startOffset: 0x10,
+			key:         "AA",
+			data:        []byte("222"),
+			expected:    0x15,
+		},
+		{ // Case-3: new key in an existing list.
+			startOffset: 0x10,
+			key:         "BB",
+			data:        []byte("22"),
+			expected:    0x14,
+		},
+	}
+
+	for i, tc := range cases {
+		required, err := db.required(tc.startOffset, tc.key, tc.data)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, required, tc.expected, fmt.Sprintf("Case: [%d]", i))
+	}
+
+	// A record that doesn't fit in the journal is not updated in place.
+	db.j = newJournal(&headerBlock{journalSize: 0x20}, make([]byte, 0x40))
+	required, err := db.required(0x10, "AA", []byte("22"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, required, uint32(0x14))
+}
+
 // TestDataBlockSave tests successful saving of key value pairs in a given data block.
 func TestDataBlockSave(t *testing.T) {
 	cases := []struct {
@@ -436,12 +645,12 @@ func TestDataBlockSave(t *testing.T) {
 			kvPairs: map[string][]byte{"key": []byte("value")},
 			order:   []string{"key"},
 			expectedBlock: concatBytes(
-				headerBytes(0x24, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00), // write offset (0x24), total size (0x14)
-				[]byte{
+				headerBytes(0x28, 0x00, 0x00, 0x00, 0x18, 0x00, 0x00, 0x00), // write offset (0x28), total size (0x18)
+				withChecksum(
 					0x03, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, // key size (3), data size (5)
 					0x6b, 0x65, 0x79, 0x76, 0x61, 0x6C, 0x75, 0x65, // Key (key), data (value)
 					0x00, 0x00, 0x00, 0x00, // next (0)
-				},
+				),
 			),
 		},
 		{ // Case-1
@@ -452,20 +661,34 @@ func TestDataBlockSave(t *testing.T) {
 			},
 			order: []string{"key1", "key3", "key2"},
 			expectedBlock: concatBytes(
-				headerBytes(0x52, 0x00, 0x00, 0x00, 0x42, 0x00, 0x00, 0x00), // write offset (0x52), total size (0x42)
-				[]byte{
+				headerBytes(0x5E, 0x00, 0x00, 0x00, 0x4E, 0x00, 0x00, 0x00), // write offset (0x5E), total size (0x4E)
+				withChecksum(
 					0x04, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, // key size (4), data size (6)
 					0x6b, 0x65, 0x79, 0x31, 0x76, 0x61, 0x6C, 0x75, 0x65, 0x31, // key (key1), data (value1)
 					0x00, 0x00, 0x00, 0x00, // next (0)
-
+				),
+				withChecksum(
 					0x04, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, // key size (4), data size (6)
-					0x6b, 0x65, 0x79, 0x33, 0x76, 0x61, 0x6C, 0x75, 0x65, 0x33, // key (key1), data (value1)
+					0x6b, 0x65, 0x79, 0x33, 0x76, 0x61, 0x6C, 0x75, 0x65, 0x33, // key (key3), data (value3)
 					0x00, 0x00, 0x00, 0x00, // next (0)
-
+				),
+				withChecksum(
 					0x04, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, // key size (4), data size (6)
-					0x6b, 0x65, 0x79, 0x32, 0x76, 0x61, 0x6C, 0x75, 0x65, 0x32, // key (key1), data (value1)
+					0x6b, 0x65, 0x79, 0x32, 0x76, 0x61, 0x6C, 0x75, 0x65, 0x32, // key (key2), data (value2)
 					0x00, 0x00, 0x00, 0x00, // next (0)
-				},
+				),
+			),
+		},
+		{ // Case-2: empty value.
+			kvPairs: map[string][]byte{"key": {}},
+			order:   []string{"key"},
+			expectedBlock: concatBytes(
+				headerBytes(0x23, 0x00, 0x00, 0x00, 0x13, 0x00, 0x00, 0x00), // write offset (0x23), total size (0x13)
+				withChecksum(
+					0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // key size (3), data size (0)
+					0x6b, 0x65, 0x79, // Key (key)
+					0x00, 0x00, 0x00, 0x00, // next (0)
+				),
 			),
 		},
 	}
@@ -476,7 +699,7 @@ func TestDataBlockSave(t *testing.T) {
 		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
 		for _, key := range tc.order {
 			val := tc.kvPairs[key]
-			offset, err := db.save(key, val)
+			offset, err := db.save(key, val, TypeBytes)
 			ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
 			ensure.True(t, (offset > 0), fmt.Sprintf("Case: [%d]. Offset must not be 0. Got [%x]", i, offset))
 		}
@@ -495,25 +718,19 @@ func TestDataBlockSaveErrors(t *testing.T) {
 			keys:           []string{""},
 			values:         [][]byte{[]byte("123")},
 			blockSize:      320,
-			expectedErrStr: `^dataBlock: save failed. key \[\] and data \[31 32 33\] must be non-zero length*`,
-		},
-		{ // Case-1: empty values.
-			keys:           []string{"key"},
-			values:         [][]byte{{}},
-			blockSize:      320,
-			expectedErrStr: `^dataBlock: save failed. key \[key\] and data \[\] must be non-zero length*`,
+			expectedErrStr: `^dataBlock: save failed. key \[\] must be non-zero length*`,
 		},
-		{ // Case-2: Test saving when the block is completely full.
+		{ // Case-1: Test saving when the block is completely full.
 			keys:           []string{"key1", "key2", "key3", "key4"},
 			values:         [][]byte{[]byte("val1"), []byte("val2"), []byte("val3"), []byte("val4")},
-			blockSize:      60,
-			expectedErrStr: `^dataBlock: Cannot write to offset \[0x4c\]. Block size: \[0x4c\]*`,
+			blockSize:      72,
+			expectedErrStr: `^dataBlock: Cannot write to offset \[0x58\]. Block size: \[0x58\]*`,
 		},
-		{ // Case-3: Test saving when the free space is not sufficient to save a new record.
+		{ // Case-2: Test saving when the free space is not sufficient to save a new record.
 			keys:           []string{"key1", "key2", "key3", "key4"},
 			values:         [][]byte{[]byte("val1"), []byte("val2"), []byte("val3"), []byte("val4")},
-			blockSize:      65,
-			expectedErrStr: `^dataBlock: Cannot write to offset \[0x4c\]. Record \[0x14 bytes\] exceeds data block boundary \[0x51\]*`,
+			blockSize:      77,
+			expectedErrStr: `^dataBlock: Cannot write to offset \[0x58\]. Record \[0x18 bytes\] exceeds data block boundary \[0x5d\]*`,
 		},
 	}
 
@@ -525,7 +742,7 @@ func TestDataBlockSaveErrors(t *testing.T) {
 			),
 		}
 		for j, key := range tc.keys {
-			_, err := db.save(key, tc.values[j])
+			_, err := db.save(key, tc.values[j], TypeBytes)
 			// expect an error only while saving the last record.
 			if j == len(tc.keys)-1 {
 				ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
@@ -543,22 +760,37 @@ func TestDataRecordWrite(t *testing.T) {
 		rec      *dataRecord
 		expected []byte
 	}{
-		{ // Case-0: Empty records are 12 bytes.
+		{ // Case-0: Empty records are 16 bytes.
 			rec:      &dataRecord{},
-			expected: make([]byte, 12),
+			expected: withChecksum(make([]byte, 12)...),
 		},
 		{ // Case-1: Should be able to write data into bigger buffer.
 			rec:      &dataRecord{},
-			expected: make([]byte, 32),
+			expected: concatBytes(withChecksum(make([]byte, 12)...), make([]byte, 16)),
 		},
 		{ // Case-2
 			rec: &dataRecord{key: []byte("TestKey"), data: []byte("TestValue")},
-			expected: []byte{
+			expected: withChecksum(
 				0x07, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, // key size (7), data size (9)
 				0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 				0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
 				0x00, 0x00, 0x00, 0x00, // next (0)
-			},
+			),
+		},
+		{ // Case-3: The next pointer of a wide record is 8 bytes.
+			rec: &dataRecord{key: []byte("K"), data: []byte("V"), next: 0x0102030405060708, wide: true},
+			expected: withChecksum(
+				0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // key size (1), data size (1)
+				0x4b, 0x56, // key (K), data (V)
+				0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, // next (0x0102030405060708)
+			),
+		}, { // Case-4: The value type is saved in the top byte of the key size field.
+			rec: &dataRecord{key: []byte("K"), data: []byte{0x01}, kind: TypeBool},
+			expected: withChecksum(
+				0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00, 0x00, // value type (bool), key size (1), data size (1)
+				0x4b, 0x01, // key (K), data (true)
+				0x00, 0x00, 0x00, 0x00, // next (0)
+			),
 		},
 	}
 
@@ -572,7 +804,7 @@ func TestDataRecordWrite(t *testing.T) {
 
 // TestDataRecordWriteErrors tests errors encountered while writing dataRecord.
 func TestDataRecordWriteErrors(t *testing.T) {
-	err := (&dataRecord{key: []byte("TEST")}).write(make([]byte, 11))
+	err := (&dataRecord{key: []byte("TEST")}).write(make([]byte, 15))
 	ensure.Err(t, err, regexp.MustCompile("Unable to write the key [TEST]*"))
 }
 
@@ -583,7 +815,7 @@ func TestDataRecordRead(t *testing.T) {
 		expectedRec *dataRecord
 	}{
 		{ // Case-0: Empty records.
-			block:       make([]byte, 12),
+			block:       make([]byte, 16),
 			expectedRec: &dataRecord{key: []byte{}, data: []byte{}},
 		},
 		{ // Case-1: Reading an empty record from a bigger block of data.
@@ -596,24 +828,44 @@ func TestDataRecordRead(t *testing.T) {
 				0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 				0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
 				0x00, 0x00, 0x00, 0x00, // next (0)
+				0xDD, 0xCC, 0xBB, 0xAA, // checksum (0xAABBCCDD). It is not verified here.
 			},
-			expectedRec: &dataRecord{key: []byte("TestKey"), data: []byte("TestValue")},
+			expectedRec: &dataRecord{key: []byte("TestKey"), data: []byte("TestValue"), checksum: 0xAABBCCDD},
 		},
 		{ // Case-3: Reading a non-empty record from a bigger block of data.
 			block: []byte{
 				0x07, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, // key size (7),  data size (9)
 				0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
 				0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
-				0x04, 0x03, 0x02, 0x01, // next (0)
+				0x04, 0x03, 0x02, 0x01, // next (0x01020304)
+				0xDD, 0xCC, 0xBB, 0xAA, // checksum (0xAABBCCDD)
 
 				0x99, 0x99, 0x99, 0x99, 0x99, 0x99, 0x99, 0x99, // junk
 			},
-			expectedRec: &dataRecord{key: []byte("TestKey"), data: []byte("TestValue"), next: 0x01020304},
+			expectedRec: &dataRecord{key: []byte("TestKey"), data: []byte("TestValue"), next: 0x01020304, checksum: 0xAABBCCDD},
+		},
+		{ // Case-4: Reading a wide record.
+			block: []byte{
+				0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, // key size (1),  data size (1)
+				0x4b, 0x56, // key (K), data (V)
+				0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, // next (0x0102030405060708)
+				0xDD, 0xCC, 0xBB, 0xAA, // checksum (0xAABBCCDD)
+			},
+			expectedRec: &dataRecord{key: []byte("K"), data: []byte("V"), next: 0x0102030405060708, checksum: 0xAABBCCDD, wide: true},
+		}, { // Case-5: The top byte of the key size field holds the value type.
+			block: []byte{
+				0x01, 0x00, 0x00, 0x02, 0x08, 0x00, 0x00, 0x00, // value type (int64), key size (1), data size (8)
+				0x4b,                                           // key (K)
+				0x2A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // data (42)
+				0x00, 0x00, 0x00, 0x00, // next (0)
+				0xDD, 0xCC, 0xBB, 0xAA, // checksum (0xAABBCCDD)
+			},
+			expectedRec: &dataRecord{key: []byte("K"), data: []byte{0x2A, 0, 0, 0, 0, 0, 0, 0}, kind: TypeInt64, checksum: 0xAABBCCDD},
 		},
 	}
 
 	for i, tc := range cases {
-		rec, err := (&dataRecord{}).read(tc.block)
+		rec, err := (&dataRecord{wide: tc.expectedRec.wide}).read(tc.block)
 		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
 		ensure.DeepEqual(t, rec, tc.expectedRec, fmt.Sprintf("Case: [%d]", i))
 	}
@@ -656,6 +908,20 @@ func TestDataRecordReadErrors(t *testing.T) {
 			},
 			expectedErrStr: "^dataRecord: failed to read the next pointer*",
 		},
+		{ // Case-5
+			block: []byte{
+				0x07, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, // key size (7), data size (9)
+				0x54, 0x65, 0x73, 0x74, 0x4b, 0x65, 0x79, // key (TestKey)
+				0x54, 0x65, 0x73, 0x74, 0x56, 0x61, 0x6C, 0x75, 0x65, // data (TestValue)
+				0x00, 0x00, 0x00, 0x00, // next (0)
+			},
+			expectedErrStr: "^dataRecord: failed to read the checksum*",
+		}, { // Case-6
+			block: []byte{
+				0x07, 0x00, 0x00, 0x7F, 0x09, 0x00, 0x00, 0x00, // value type (0x7F), key size (7), data size (9)
+			},
+			expectedErrStr: `^dataRecord: failed to read the key. Unknown value type \[127\]`,
+		},
 	}
 
 	for i, tc := range cases {
@@ -663,3 +929,20 @@ func TestDataRecordReadErrors(t *testing.T) {
 		ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
 	}
 }
+
+// TestDataBlockSizeNotJournaled tests that a change fails if the journal can't save the total size it
+// updates, so that the change is rolled back rather than committed with a wrong size.
+func TestDataBlockSizeNotJournaled(t *testing.T) {
+	file := concatBytes(
+		headerBytes(0x10, 0x00, 0x00, 0x00), // write offset (0x10)
+		make([]byte, 0x40),
+	)
+	db := &dataBlock{block: file}
+	// The journal has room for the write offset only.
+	db.j = newJournal(&headerBlock{journalSize: journalHeaderSize + journalEntryHeaderSize + sizeOfUint32}, make([]byte, 0x40))
+	db.j.file = file
+	db.j.begin(dataOffset(dataBlockHeaderSize))
+
+	_, err := db.save("key", []byte("value"), TypeBytes)
+	ensure.Err(t, err, regexp.MustCompile(`^journal: cannot save the bytes \[0x4 \+0x4\]`))
+}
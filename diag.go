@@ -0,0 +1,77 @@
+package dyconf
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Logger receives the diagnostics of a config, like the details of a corrupt record or the rollback of
+// an interrupted change. *log.Logger satisfies it. See WithLogger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// hexWindowRadius is the number of bytes shown on each side of the offset by hexWindow.
+const hexWindowRadius = 32
+
+// hexWindow returns a hex dump of the bytes of the block around the given offset. The blocks are as big
+// as the file, so errors show this window rather than the whole block. The lines are labeled with their
+// offset in the block, and the byte at the given offset is marked.
+func hexWindow(block []byte, offset int) string {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(block) {
+		offset = len(block)
+	}
+	// The lines are aligned to 16 bytes, like those of hexdump.
+	start := (offset - hexWindowRadius) &^ 0x0F
+	if start < 0 {
+		start = 0
+	}
+	end := offset + hexWindowRadius
+	if end > len(block) {
+		end = len(block)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%#x] bytes around offset [%#x] of [%#x]:", end-start, offset, len(block))
+	for line := start; line < end; line += 16 {
+		fmt.Fprintf(&buf, "\n%08x ", line)
+		for i := line; i < line+16 && i < end; i++ {
+			sep := ' '
+			if i == offset {
+				sep = '>'
+			}
+			fmt.Fprintf(&buf, "%c%02x", sep, block[i])
+		}
+	}
+	return buf.String()
+}
+
+// logf sends the given diagnostic to the logger of the config, if it has one.
+func (c *config) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+	}
+}
+
+// report prepares an error of a block to be returned by the config. It sets the file name of the
+// error, and logs it if it is about corruption.
+func (c *config) report(err error) error {
+	err = withFileName(err, c.fileName)
+	switch e := err.(type) {
+	case *CorruptionError:
+		c.logf("%s\n%s", e.Error(), e.window)
+	case *FileError:
+		if e.Err != ErrCorrupt {
+			break
+		}
+		if e.window == "" {
+			c.logf("%s", e.Error())
+		} else {
+			c.logf("%s\n%s", e.Error(), e.window)
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package dyconf
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestHexWindow(t *testing.T) {
+	block := make([]byte, 0x100)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	cases := []struct {
+		block    []byte
+		offset   int
+		expected string
+	}{
+		{ // Case-0: block smaller than the window.
+			block:    block[:4],
+			offset:   0,
+			expected: "[0x4] bytes around offset [0x0] of [0x4]:\n00000000 >00 01 02 03",
+		},
+		{ // Case-1: window in the middle of the block.
+			block:  block,
+			offset: 0x45,
+			expected: "[0x45] bytes around offset [0x45] of [0x100]:\n" +
+				"00000020  20 21 22 23 24 25 26 27 28 29 2a 2b 2c 2d 2e 2f\n" +
+				"00000030  30 31 32 33 34 35 36 37 38 39 3a 3b 3c 3d 3e 3f\n" +
+				"00000040  40 41 42 43 44>45 46 47 48 49 4a 4b 4c 4d 4e 4f\n" +
+				"00000050  50 51 52 53 54 55 56 57 58 59 5a 5b 5c 5d 5e 5f\n" +
+				"00000060  60 61 62 63 64",
+		},
+		{ // Case-2: offset at the end of the block.
+			block:  block,
+			offset: 0x100,
+			expected: "[0x20] bytes around offset [0x100] of [0x100]:\n" +
+				"000000e0  e0 e1 e2 e3 e4 e5 e6 e7 e8 e9 ea eb ec ed ee ef\n" +
+				"000000f0  f0 f1 f2 f3 f4 f5 f6 f7 f8 f9 fa fb fc fd fe ff",
+		},
+		{ // Case-3: offset out of the block.
+			block:    nil,
+			offset:   3,
+			expected: "[0x0] bytes around offset [0x0] of [0x0]:",
+		},
+	}
+	for i, tc := range cases {
+		ensure.DeepEqual(t, hexWindow(tc.block, tc.offset), tc.expected, fmt.Sprintf("Case: [%d]", i))
+	}
+}
@@ -1,60 +1,198 @@
 package dyconf
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/facebookgo/stackerr"
 )
 
-// Config provides methods to access the config values.
+// Config provides methods to access the config values. It is safe for concurrent use by multiple
+// goroutines.
 type Config interface {
+	// Get returns a copy of the value of the given key. It allocates only the copy. If the key doesn't
+	// exist, it returns a KeyError that wraps ErrNotFound. The same error is returned for every key that
+	// doesn't exist, and doesn't name the key, so that a miss allocates nothing. GetView and the typed
+	// getters return it too.
 	Get(key string) ([]byte, error)
+	// GetView calls fn with the value of the given key, without copying it. The value is a slice of the
+	// mapped file, so it must not be modified or used after fn returns. The file stays read locked while
+	// fn runs, so fn should be quick and must not use the config. The error of fn is returned as is.
+	GetView(key string, fn func(value []byte) error) error
+	// Has returns true if the given key exists. The value is not read, so it is cheaper than Get for
+	// checking whether a key exists, especially one with an empty value. It allocates nothing.
+	Has(key string) (bool, error)
+	// GetString, GetInt64 and the other typed getters return the value of the given key as the type it was
+	// set as with the matching setter of ConfigManager. A value set as another type can't be read, and a
+	// TypeError is returned. GetString can also read the values set with Set.
+	GetString(key string) (string, error)
+	GetInt64(key string) (int64, error)
+	GetUint64(key string) (uint64, error)
+	GetFloat64(key string) (float64, error)
+	GetBool(key string) (bool, error)
+	GetDuration(key string) (time.Duration, error)
+	GetTime(key string) (time.Time, error)
+	// Generation returns a number that changes whenever the config data changes. Comparing it with a
+	// previously returned value is a cheap way to find out whether anything changed in between.
+	Generation() (uint64, error)
+	// Watch sends the changes of the given key, and of the keys under it, on the returned channel until
+	// the context is done. See Event.
+	Watch(ctx context.Context, keyOrPrefix string) <-chan Event
+	// Changes returns the keys set and deleted after the given generation, along with the current
+	// generation. See Change.
+	Changes(since uint64) ([]Change, uint64, error)
+	// Wait returns the generation of the file once it differs from the given one. See WithNotifications.
+	Wait(ctx context.Context, generation uint64) (uint64, error)
 	Close() error
 }
 
-// ConfigManager provides methods to manage the config data.
+// ConfigManager provides methods to manage the config data. It is safe for concurrent use by multiple
+// goroutines.
 type ConfigManager interface {
 	Get(key string) ([]byte, error)
+	GetView(key string, fn func(value []byte) error) error
+	Has(key string) (bool, error)
+	GetString(key string) (string, error)
+	GetInt64(key string) (int64, error)
+	GetUint64(key string) (uint64, error)
+	GetFloat64(key string) (float64, error)
+	GetBool(key string) (bool, error)
+	GetDuration(key string) (time.Duration, error)
+	GetTime(key string) (time.Time, error)
+	Generation() (uint64, error)
+	Watch(ctx context.Context, keyOrPrefix string) <-chan Event
+	Changes(since uint64) ([]Change, uint64, error)
+	Wait(ctx context.Context, generation uint64) (uint64, error)
 	Set(key string, value []byte) error
+	// SetString, SetInt64 and the other typed setters save the type of the value along with it, so that
+	// it can only be read back with the matching getter of Config.
+	SetString(key string, value string) error
+	SetInt64(key string, value int64) error
+	SetUint64(key string, value uint64) error
+	SetFloat64(key string, value float64) error
+	SetBool(key string, value bool) error
+	SetDuration(key string, value time.Duration) error
+	SetTime(key string, value time.Time) error
 	Delete(key string) error
 	Map() (map[string][]byte, error)
 	Defrag() error
+	Compact(ctx context.Context, threshold float64) error
+	RunCompactor(ctx context.Context, threshold float64, interval time.Duration) error
 	Close() error
 
 	// unexported
-	freeDataByteCount() (uint32, error)
-	dataBlockSize() (uint32, error)
+	freeDataByteCount() (contiguous uint64, reclaimable uint64, err error)
+	dataBlockSize() (uint64, error)
 }
 
+// defragFileSuffix is appended to the config file name to name the new file built by Defrag.
+const defragFileSuffix = ".defrag"
+
+// A config is used by several goroutines at once as below. The flock of the file belongs to the open
+// file, so the goroutines of a process share it, and they are kept apart by mu as well. The readers hold
+// mu for reading and share a single shared flock, and the writers hold mu for writing along with the
+// exclusive flock. Every locked operation also holds a reference to the config, so that Close waits for
+// the operations in flight, and the ones that come after it fail with ErrClosed. See rlock and acquire.
 type config struct {
 	fileName string
 	file     *os.File
 	block    []byte
-	initOnce sync.Once
+	prot     int      // protection flags the file is mapped with.
+	locked   int      // flock operation the file is currently locked with.
+	tx       *journal // journal of the change in progress, if any.
+	cache    *headerCache
+	logger   Logger // receives the diagnostics, if set. See WithLogger.
+
+	mu        sync.RWMutex
+	exclusive bool       // mu is held for writing.
+	flockMu   sync.Mutex // guards readers and the shared flock.
+	readers   int        // number of goroutines sharing the shared flock.
+
+	refMu    sync.Mutex // guards closed and watchers.
+	closed   bool
+	refs     sync.WaitGroup                 // operations in flight.
+	watchers map[*config]context.CancelFunc // stops the watchers started by Watch. See Close.
+
+	// watchInterval is how often Watch checks the file for changes.
+	watchInterval time.Duration
+	notFound      *KeyError     // returned for every key that doesn't exist. See Get.
+	sub           *subscription // socket the writers notify the changes on, if any. See WithNotifications.
+	lockFree      bool          // reads without locking the file when it can. See WithLockFreeReads.
+	initOnce      sync.Once
 }
 
-// New initializes and returns a new config that can be used to get the config values.
-func New(fileName string) (Config, error) {
-	c := &config{}
-	err := c.init(fileName)
+// headerCache holds the parsed header and the blocks it describes for the read path, so a lookup doesn't
+// parse the header again unless it changed. Every change of the config data bumps the generation, so the
+// cache lasts for a generation. See cachedHeader.
+type headerCache struct {
+	raw   [headerBlockSize]byte // header bytes the cache was built from.
+	h     *headerBlock
+	index *indexBlock
+	data  *dataBlock
+}
+
+// New initializes and returns a new config that can be used to get the config values. Only the options
+// that apply to reading the file, like WithLogger, take effect. See Option. The config subscribes to the
+// changes of the file, unless WithoutNotifications is given. See WithNotifications.
+func New(fileName string, opts ...Option) (Config, error) {
+	o, err := newOptions(opts)
 	if err != nil {
 		return nil, err
 	}
+	c := &config{logger: o.logger, watchInterval: o.watchInterval, lockFree: o.lockFreeReads}
+	// Subscribe before reading the file, so that no change made after it is read goes unnoticed.
+	if !o.noNotify {
+		if c.sub, err = subscribe(fileName); err != nil {
+			if o.notify {
+				return nil, err
+			}
+			c.logf("dyconf: failed to subscribe to the changes of the file [%s]. It is checked every watch interval instead. error: [%s]", fileName, err.Error())
+		}
+	}
+	err = c.init(fileName)
+	if err != nil {
+		if c.sub != nil {
+			c.sub.close()
+		}
+		return nil, err
+	}
 	return c, nil
 }
 
 type configManager struct {
 	config
+	opts *options
+	// rehashRetryAt is the key count a rehash that failed is tried again at. See rehashIfNeeded.
+	rehashRetryAt uint64
 }
 
 // NewManager initializes and returns a new ConfigManager that can be used to manage the config data.
-func NewManager(fileName string) (ConfigManager, error) {
-	w := &configManager{}
-	err := w.writeInit(fileName)
+// The options are used to lay out the file if it doesn't exist yet. See Option.
+func NewManager(fileName string, opts ...Option) (ConfigManager, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &configManager{opts: o}
+	w.logger, w.watchInterval, w.lockFree = o.logger, o.watchInterval, o.lockFreeReads
+	if o.notify {
+		if w.sub, err = subscribe(fileName); err != nil {
+			return nil, err
+		}
+	}
+	err = w.writeInit(fileName)
 	if err != nil {
+		if w.sub != nil {
+			w.sub.close()
+		}
 		return nil, err
 	}
 	return w, nil
@@ -64,8 +202,49 @@ func (c *config) Get(key string) ([]byte, error) {
 	return c.getBytes(key)
 }
 
-func (c *config) init(fileName string) error {
+func (c *config) GetView(key string, fn func(value []byte) error) error {
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return err
+	}
+	defer c.unlock()
+
+	found, err := c.lookup(key, func(_ ValueType, value []byte) error { return fn(value) })
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.notFound
+	}
+	return nil
+}
+
+func (c *config) Has(key string) (bool, error) {
+	return c.read(key, func(ValueType, []byte) error { return nil })
+}
+
+func (c *config) Generation() (uint64, error) {
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return 0, err
+	}
+	defer c.unlock()
+
+	h, err := c.header()
+	if err != nil {
+		return 0, err
+	}
+	return h.generation, nil
+}
+
+// setFileName sets the name of the config file, and the error of the keys that don't exist in it.
+func (c *config) setFileName(fileName string) {
 	c.fileName = fileName
+	c.notFound = &KeyError{FileName: fileName, Reason: "was not found", Err: ErrNotFound}
+}
+
+func (c *config) init(fileName string) error {
+	c.setFileName(fileName)
 	var err error
 	c.file, err = os.Open(fileName)
 	if err != nil {
@@ -77,64 +256,296 @@ func (c *config) init(fileName string) error {
 	}
 	defer c.unlock()
 
-	// mmap
+	h, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	stat, err := c.file.Stat()
+	if err != nil {
+		return stackerr.Newf("dyconf: failed to stat the file [%s]. error: [%s]", fileName, err.Error())
+	}
+	if stat.Size() < int64(h.totalSize) {
+		return c.report(&FileError{
+			FileName: fileName,
+			Offset:   uint64(stat.Size()),
+			Reason: fmt.Sprintf(
+				"dyconf: the config file is truncated. The file size [%#x] is less than [%#x] recorded in its header",
+				stat.Size(),
+				h.totalSize,
+			),
+			Err: ErrCorrupt,
+		})
+	}
+
+	if err := c.mmap(h.totalSize, syscall.PROT_READ); err != nil {
+		return err
+	}
+	// The file may have been replaced by Defrag between opening and locking it.
+	_, err = c.header()
+	return err
+}
+
+// readHeader reads the header directly from the file. It is used before the file is mapped, to find out
+// how much of it needs to be mapped.
+func (c *config) readHeader() (*headerBlock, error) {
+	block := make([]byte, headerBlockSize)
+	if _, err := c.file.ReadAt(block, 0); err != nil {
+		return nil, stackerr.Newf("dyconf: failed to read the header of the file [%s]. error: [%s]", c.fileName, err.Error())
+	}
+	h, err := (&headerBlock{}).read(block)
+	if err != nil {
+		return nil, c.report(err)
+	}
+	if h.compatFeatures&featureSequence != 0 && h.journalOffset < sequenceOffset+sequenceSize {
+		return nil, c.report(&FileError{
+			FileName: c.fileName,
+			Offset:   sequenceOffset,
+			Reason:   fmt.Sprintf("dyconf: invalid header. The journal offset [%#x] overlaps the sequence number", h.journalOffset),
+			Err:      ErrCorrupt,
+		})
+	}
+	// The blocks must lie within the file described by the header.
+	if uint64(h.journalOffset)+uint64(h.journalSize) > uint64(h.totalSize) ||
+		uint64(h.feedOffset())+uint64(h.feedSize) > uint64(h.totalSize) ||
+		uint64(h.indexBlockOffset)+uint64(h.indexBlockSize) > uint64(h.totalSize) ||
+		uint64(h.dataBlockOffset)+uint64(h.dataBlockSize) > uint64(h.totalSize) {
+		return nil, c.report(&FileError{
+			FileName: c.fileName,
+			Reason: fmt.Sprintf(
+				"dyconf: invalid header. Journal [%#x +%#x], change feed [%#x +%#x], index block [%#x +%#x] or data block [%#x +%#x] exceeds the total size [%#x]",
+				h.journalOffset,
+				h.journalSize,
+				h.feedOffset(),
+				h.feedSize,
+				h.indexBlockOffset,
+				h.indexBlockSize,
+				h.dataBlockOffset,
+				h.dataBlockSize,
+				h.totalSize,
+			),
+			Err: ErrCorrupt,
+		})
+	}
+	return h, nil
+}
+
+func (c *config) mmap(size uint64, prot int) error {
+	if uint64(int(size)) != size {
+		return &FileError{
+			FileName: c.fileName,
+			Reason:   fmt.Sprintf("dyconf: cannot mmap the config file. Its size [%#x] is too big for this platform", size),
+			Err:      ErrMap,
+		}
+	}
+	var err error
+	c.prot = prot
 	c.block, err = syscall.Mmap(
 		int(c.file.Fd()),
 		0,
-		int(defaultTotalSize),
-		syscall.PROT_READ,
+		int(size),
+		prot,
 		syscall.MAP_SHARED,
 	)
 	if err != nil {
-		return stackerr.Newf("dyconf: failed to mmap the config file [%s]. error: [%s]", fileName, err.Error())
+		return c.mapError("failed to mmap the config file", err)
 	}
-
 	return nil
 }
 
-func (c *config) getBytes(key string) ([]byte, error) {
-	// read lock the file
-	if err := c.rlock(); err != nil {
+// header reads the header from the mapped file. If the file has been replaced by Defrag, the new file
+// is opened and locked first. If the file has been grown since it was mapped, it is remapped first. So
+// the returned header always describes the current mapping. The caller must hold the lock on the file.
+func (c *config) header() (*headerBlock, error) {
+	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+	if err != nil {
+		return nil, c.report(err)
+	}
+	if h.flags&headerFlagReplaced != 0 {
+		reopened, err := c.reopen()
+		if err != nil {
+			return nil, err
+		}
+		if reopened {
+			c.logf("dyconf: the file [%s] was replaced by Defrag. Switched to the new file", c.fileName)
+			return c.header()
+		}
+		// The path still refers to this file. The flag was left behind by a Defrag that died before
+		// renaming the new file into place, so it is ignored. Writers clear it.
+		if c.locked == syscall.LOCK_EX {
+			c.logf("dyconf: cleared the replaced flag left behind by an interrupted Defrag of the file [%s]", c.fileName)
+			if err := c.saveFlags(h, h.flags&^headerFlagReplaced); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if h.totalSize == uint64(len(c.block)) {
+		return h, nil
+	}
+	if err := c.remap(h.totalSize); err != nil {
 		return nil, err
 	}
-	defer c.unlock()
+	h, err = (&headerBlock{}).read(c.block[0:headerBlockSize])
+	return h, c.report(err)
+}
 
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+// cachedHeader returns the header cache, rebuilding it first if the header has changed since it was
+// built. It is meant for the read path only. The cached header must not be modified. The caller must hold
+// the lock on the file.
+func (c *config) cachedHeader() (*headerCache, error) {
+	if c.fresh() {
+		return c.cache, nil
+	}
+	c.cache = nil
+	h, err := c.header()
 	if err != nil {
 		return nil, err
 	}
+	hc := &headerCache{h: h, index: c.index(h), data: c.data(h)}
+	copy(hc.raw[:], c.block[:headerBlockSize])
+	// A file flagged as replaced is not cached, so that header checks whether to reopen it every time.
+	if h.flags&headerFlagReplaced == 0 {
+		c.cache = hc
+	}
+	return hc, nil
+}
 
-	index := &indexBlock{
-		size: defaultIndexCount,
-		data: c.block[h.indexBlockOffset : uint32(h.indexBlockOffset)+h.indexBlockSize],
+// fresh returns true if the header cache is up to date. The file is mapped as its header describes and
+// was not replaced then, so header and cachedHeader change nothing, and several goroutines can use them at
+// once. The caller must hold the lock on the file.
+func (c *config) fresh() bool {
+	hc := c.cache
+	return hc != nil && bytes.Equal(hc.raw[:], c.block[:headerBlockSize])
+}
+
+// reopen switches to the file at the config file path if it is not the open file anymore. The lock held
+// on the open file is released and the same lock is taken on the new file. It returns false if the path
+// still refers to the open file.
+func (c *config) reopen() (bool, error) {
+	current, err := c.file.Stat()
+	if err != nil {
+		return false, stackerr.Newf("dyconf: failed to stat the open config file [%s]. error: [%s]", c.fileName, err.Error())
 	}
-	offset, err := index.get(key)
+	latest, err := os.Stat(c.fileName)
 	if err != nil {
-		return nil, err
+		return false, stackerr.Newf("dyconf: failed to stat the file [%s]. error: [%s]", c.fileName, err.Error())
 	}
-	// Key was not found in the index.
-	if offset == 0 {
-		return nil, stackerr.Newf("dyconf: key [%s] was not found", key)
+	if os.SameFile(current, latest) {
+		return false, nil
+	}
+
+	flag := os.O_RDONLY
+	if c.prot&syscall.PROT_WRITE != 0 {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(c.fileName, flag, 0)
+	if err != nil {
+		return false, stackerr.Newf("dyconf: failed to reopen the file [%s]. error: [%s]", c.fileName, err.Error())
+	}
+	// Closing the old file releases the lock held on it.
+	c.cache = nil
+	if err := syscall.Munmap(c.block); err != nil {
+		file.Close()
+		return false, c.mapError("failed to unmap the replaced config file", err)
 	}
+	c.block = nil
+	c.file.Close()
+	c.file = file
 
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
-	data, found, err := db.fetch(offset, key)
+	if err := syscall.Flock(int(c.file.Fd()), c.locked); err != nil {
+		return false, c.lockError("failed to lock the reopened file", err)
+	}
+	h, err := c.readHeader()
+	if err != nil {
+		return false, err
+	}
+	if err := c.mmap(h.totalSize, c.prot); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// remap replaces the current mapping with a mapping of the given size.
+func (c *config) remap(size uint64) error {
+	c.cache = nil
+	if err := syscall.Munmap(c.block); err != nil {
+		return c.mapError("failed to unmap the config file", err)
+	}
+	c.block = nil
+	if err := c.mmap(size, c.prot); err != nil {
+		return err
+	}
+	// The journal of a change in progress refers to the mapping.
+	if c.tx != nil {
+		c.tx.block = c.block[c.tx.offset : c.tx.offset+dataOffset(len(c.tx.block))]
+		c.tx.file = c.block
+	}
+	return nil
+}
+
+// index returns the index block described by the given header.
+func (c *config) index(h *headerBlock) *indexBlock {
+	return &indexBlock{
+		size: h.indexSlotCount(),
+		data: c.block[h.indexBlockOffset : h.indexBlockOffset+dataOffset(h.indexBlockSize)],
+		base: h.indexBlockOffset,
+		j:    c.tx,
+		hash: h.hashFunc(),
+		wide: h.wide(),
+	}
+}
+
+// data returns the data block described by the given header.
+func (c *config) data(h *headerBlock) *dataBlock {
+	return &dataBlock{
+		block: c.block[h.dataBlockOffset : h.dataBlockOffset+dataOffset(h.dataBlockSize)],
+		base:  h.dataBlockOffset,
+		j:     c.tx,
+		hash:  h.hashFunc(),
+		wide:  h.wide(),
+	}
+}
+
+func (c *config) getBytes(key string) ([]byte, error) {
+	var data []byte
+	found, err := c.read(key, func(_ ValueType, value []byte) error {
+		data = make([]byte, len(value))
+		copy(data, value)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	// Key was not found in the data block.
 	if !found {
-		return nil, stackerr.Newf("dyconf: key [%s] was not found", key)
+		return nil, c.notFound
 	}
-
 	return data, nil
 }
 
+// lookup calls fn with the type and the value of the given key, read in place. It returns false if the key doesn't
+// exist. Apart from what fn does, it allocates nothing once the header is cached. The caller must hold
+// the lock on the file.
+func (c *config) lookup(key string, fn func(kind ValueType, value []byte) error) (bool, error) {
+	hc, err := c.cachedHeader()
+	if err != nil {
+		return false, err
+	}
+	offset, err := hc.index.get(key)
+	if err != nil {
+		return false, c.report(err)
+	}
+	// Key was not found in the index.
+	if offset == 0 {
+		return false, nil
+	}
+	found, err := hc.data.view(offset, key, fn)
+	return found, c.report(err)
+}
+
 func (c *configManager) createNew(fileName string) error {
-	c.fileName = fileName
+	c.setFileName(fileName)
 	var err error
 
-	c.file, err = os.Create(fileName)
+	c.file, err = os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.opts.fileMode)
 	if err != nil {
 		return stackerr.Newf("dyconf: failed to create the file [%s]. error: [%s]", fileName, err.Error())
 	}
@@ -147,22 +558,23 @@ func (c *configManager) createNew(fileName string) error {
 
 	// We now seek to the end of the file and write an empty byte. This is to bloat the file up to the
 	// size we expect to mmap. If we don't do this mmap fails with the error "unexpected fault address"
-	seekOffset, err := c.file.Seek(int64(defaultTotalSize-1), 0)
+	totalSize := c.opts.totalSize()
+	seekOffset, err := c.file.Seek(int64(totalSize-1), 0)
 	if err != nil {
 		return stackerr.Newf(
 			"dyconf: failed to initialize for writing. Unexpected error occured while seeking to the "+
 				"end [%#v] of the config file [%s]. error: [%s]",
-			defaultTotalSize,
+			totalSize,
 			fileName,
 			err.Error(),
 		)
 	}
-	if seekOffset != defaultTotalSize-1 {
+	if seekOffset != int64(totalSize-1) {
 		return stackerr.Newf(
 			"dyconf: failed to initialize for writing. Could not seek the file [%s] till the "+
 				"required number of bytes [%#v]. Current seek offset: [%#v]",
 			fileName,
-			defaultTotalSize,
+			totalSize,
 			seekOffset,
 		)
 	}
@@ -175,38 +587,45 @@ func (c *configManager) createNew(fileName string) error {
 			err.Error(),
 		)
 	}
-	// mmap
-	c.block, err = syscall.Mmap(
-		int(c.file.Fd()),
-		0,
-		int(defaultTotalSize),
-		syscall.PROT_WRITE,
-		syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return stackerr.Newf("dyconf: failed to mmap the config file [%s]. error: [%s]", fileName, err.Error())
+	if err = c.mmap(totalSize, syscall.PROT_WRITE); err != nil {
+		return err
 	}
 
 	// Save default header.
-	h := &headerBlock{
-		version:          123,
-		totalSize:        defaultTotalSize,
-		modifiedTime:     time.Now(),
-		indexBlockOffset: headerBlockSize,
-		indexBlockSize:   defaultIndexBlockSize,
-		dataBlockOffset:  headerBlockSize + defaultIndexBlockSize,
-		dataBlockSize:    defaultDataBlockSize,
-		block:            c.block[0:headerBlockSize],
+	h := newHeaderBlock(c.block[0:headerBlockSize])
+	h.totalSize = totalSize
+	h.modifiedTime = time.Now()
+	h.journalOffset = headerBlockSize
+	if c.opts.lockFreeReads {
+		h.compatFeatures |= featureSequence
+		h.journalOffset += sequenceSize
+	}
+	h.journalSize = journalBlockSize
+	h.feedSize = c.opts.changeFeedSize
+	h.indexBlockOffset = h.feedOffset() + dataOffset(h.feedSize)
+	h.indexBlockSize = c.opts.indexBlockSize()
+	h.dataBlockOffset = h.indexBlockOffset + dataOffset(h.indexBlockSize)
+	h.dataBlockSize = c.opts.dataBlockSize
+	h.compatFeatures |= featureKeyCount
+	if c.opts.wide {
+		h.incompatFeatures |= featureWideOffsets
+	}
+	h.hash = c.opts.hash
+	if h.hash.keyed() {
+		if _, err := rand.Read(h.hashKey[:]); err != nil {
+			return stackerr.Newf("dyconf: failed to generate the hash key of the file [%s]. error: [%s]", fileName, err.Error())
+		}
 	}
-	if err != h.save() {
+	if err := h.save(); err != nil {
 		return err
 	}
 
-	return nil
+	_, err = c.data(h).allocateFreeDirectory()
+	return err
 }
 
 func (c *configManager) writeInit(fileName string) error {
-	c.fileName = fileName
+	c.setFileName(fileName)
 	var err error
 	var existingFileSize int64
 
@@ -227,133 +646,423 @@ func (c *configManager) writeInit(fileName string) error {
 	}
 	defer c.unlock()
 
-	if existingFileSize != int64(defaultTotalSize) {
-		return stackerr.Newf(
-			"dyconf: failed to initialize the existing config file [%s]. The file size [%x] should be %x. "+
-				"Either fix the file or delete it to discard all data and try again.",
-			fileName,
-			existingFileSize,
-			defaultTotalSize,
-		)
+	h, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+	// A change interrupted by a crash is rolled back before anything else looks at the file. It may
+	// have changed the header too.
+	rolledBack, err := c.recover(h)
+	if err != nil {
+		return err
+	}
+	if rolledBack {
+		c.logf("dyconf: rolled back a change of the file [%s] that was interrupted", fileName)
+		if h, err = c.readHeader(); err != nil {
+			return err
+		}
+	}
+	// A file larger than the size in its header is left behind by a growth that was interrupted before
+	// the header was updated. The extra bytes were never used, so they are simply discarded.
+	if existingFileSize > int64(h.totalSize) {
+		if err := c.file.Truncate(int64(h.totalSize)); err != nil {
+			return stackerr.Newf(
+				"dyconf: failed to discard the unused bytes [%#x - %#x] of the config file [%s]. error: [%s]",
+				h.totalSize,
+				existingFileSize,
+				fileName,
+				err.Error(),
+			)
+		}
+		existingFileSize = int64(h.totalSize)
+	}
+	if existingFileSize != int64(h.totalSize) {
+		return c.report(&FileError{
+			FileName: fileName,
+			Offset:   uint64(existingFileSize),
+			Reason: fmt.Sprintf(
+				"dyconf: failed to initialize the existing config file. The file size [%x] should be %x. "+
+					"Either fix the file or delete it to discard all data and try again.",
+				existingFileSize,
+				h.totalSize,
+			),
+			Err: ErrCorrupt,
+		})
 	}
 
-	// mmap
-	c.block, err = syscall.Mmap(
-		int(c.file.Fd()),
-		0,
-		int(defaultTotalSize),
-		syscall.PROT_WRITE,
-		syscall.MAP_SHARED,
-	)
+	if err := c.mmap(h.totalSize, syscall.PROT_WRITE); err != nil {
+		return err
+	}
+	// The file may have been replaced by Defrag between opening and locking it.
+	if h, err = c.header(); err != nil {
+		return err
+	}
+	// A writer that died in the middle of a change left the sequence number odd.
+	if h.compatFeatures&featureSequence != 0 && atomic.LoadUint64(c.sequence())&1 != 0 {
+		c.bumpSequence(h)
+	}
+	if h.compatFeatures&featureKeyCount != 0 {
+		return nil
+	}
+	// Files created before the header had a key count have their keys counted once.
+	return c.mutate(func(h *headerBlock) error {
+		n, err := c.countKeys(h)
+		if err != nil {
+			return err
+		}
+		h.keyCount = n
+		h.compatFeatures |= featureKeyCount
+		return h.save()
+	})
+}
+
+// countKeys counts the keys described by the given header by walking all the lists in the data block.
+func (c *config) countKeys(h *headerBlock) (uint64, error) {
+	offsets, err := c.index(h).getAll()
 	if err != nil {
-		return stackerr.Newf("dyconf: failed to mmap the config file [%s]. error: [%s]", fileName, err.Error())
+		return 0, err
 	}
+	db := c.data(h)
+	var n uint64
+	for _, offset := range offsets {
+		length, err := db.chainLength(offset)
+		if err != nil {
+			return 0, err
+		}
+		n += uint64(length)
+	}
+	return n, nil
+}
 
-	return nil
+// recover rolls back the change recorded in the journal of the file, if the writer making it died
+// before it was complete. It works on the file directly since the file may not be mapped yet. It returns
+// true if there was a change to roll back.
+func (c *configManager) recover(h *headerBlock) (bool, error) {
+	if h.journalSize == 0 {
+		return false, nil // Files created before journaling was added don't have one.
+	}
+	j := &journal{block: make([]byte, h.journalSize), offset: h.journalOffset, wide: h.wide()}
+	if _, err := c.file.ReadAt(j.block, int64(h.journalOffset)); err != nil {
+		return false, stackerr.Newf("dyconf: failed to read the journal of the file [%s]. error: [%s]", c.fileName, err.Error())
+	}
+	if !j.active() {
+		return false, nil
+	}
+	if err := j.rollback(c.file); err != nil {
+		return false, err
+	}
+	if err := c.file.Sync(); err != nil {
+		return false, stackerr.Newf("dyconf: failed to sync the file [%s]. error: [%s]", c.fileName, err.Error())
+	}
+	return true, nil
 }
 
-func (c *configManager) Delete(key string) error {
-	// write lock the file
-	if err := c.wlock(); err != nil {
+// mutate makes the changes done by fn as a single change of the file. The in-place writes are journaled,
+// so that the change is undone if fn fails or if the process dies before it returns. In the latter case,
+// it is undone by the next NewManager, and readers may see the partial change until then. The caller
+// must hold the write lock.
+func (c *configManager) mutate(fn func(h *headerBlock) error) error {
+	h, err := c.header()
+	if err != nil {
 		return err
 	}
-	defer c.unlock()
-
-	var err error
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+	// Lock-free readers retry the reads that overlap the change. See WithLockFreeReads.
+	generation := h.generation
+	c.bumpSequence(h)
+	err = c.journaled(h, fn)
+	c.bumpSequence(h)
 	if err != nil {
 		return err
 	}
+	// Only the changes of the config data are worth waking the readers up for, not those of its layout
+	// like Compact's. fn may replace the header by growing the file, so it is read again.
+	if h, err = c.header(); err == nil && h.generation != generation {
+		c.notify()
+	}
+	return nil
+}
 
-	index := &indexBlock{
-		size: defaultIndexCount,
-		data: c.block[h.indexBlockOffset : uint32(h.indexBlockOffset)+h.indexBlockSize],
+// journaled runs fn with the in-place writes journaled. See mutate.
+func (c *configManager) journaled(h *headerBlock, fn func(h *headerBlock) error) error {
+	if h.journalSize == 0 {
+		// Files created before journaling was added don't have one.
+		return c.report(fn(h))
 	}
-	offset, err := index.get(key)
+
+	writeOffset, err := c.data(h).getWriteOffset()
 	if err != nil {
 		return err
 	}
-	if offset == 0 {
-		return nil // Key is not in the index. Nothing to delete.
+	c.tx = newJournal(h, c.block)
+	defer func() { c.tx = nil }()
+	c.tx.begin(h.dataBlockOffset + writeOffset)
+	// The header is saved at least once by every change.
+	if err := c.tx.preserve(0, headerBlockSize); err != nil {
+		return err
 	}
 
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
-	newOffset, err := db.delete(offset, key)
-	if err != nil {
+	if err := fn(h); err != nil {
+		if rollbackErr := c.tx.rollback(blockWriter(c.block)); rollbackErr != nil {
+			return rollbackErr
+		}
+		return c.report(err)
+	}
+	c.tx.commit()
+	return nil
+}
+
+func (c *configManager) Delete(key string) error {
+	// write lock the file
+	if err := c.wlock(); err != nil {
 		return err
 	}
+	defer c.unlock()
 
-	// Save the offset if it's changed.
-	if newOffset != offset {
-		err = index.set(key, newOffset)
+	return c.mutate(func(h *headerBlock) error {
+		index := c.index(h)
+		offset, err := index.get(key)
 		if err != nil {
 			return err
 		}
-	}
+		if offset == 0 {
+			return nil // Key is not in the index. Nothing to delete.
+		}
 
-	// Update when the time when the config was modified.
-	h.modifiedTime = time.Now()
-	if err := h.save(); err != nil {
-		return err
-	}
-	return nil
+		db := c.data(h)
+		rec, _, _, err := db.find(offset, key)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return nil // Key is not in the data block. Nothing to delete.
+		}
+		newOffset, err := db.delete(offset, key)
+		if err != nil {
+			return err
+		}
+		h.keyCount--
+
+		// Save the offset if it's changed.
+		if newOffset != offset {
+			err = index.set(key, newOffset)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Record the change in the header and in the change feed.
+		h.touch()
+		if err := c.recordChange(h, EventDelete, key); err != nil {
+			return err
+		}
+		return h.save()
+	})
 }
 
 func (c *configManager) Set(key string, value []byte) error {
+	return c.set(key, value, TypeBytes)
+}
+
+// set sets the key to the given value, saved as the given type.
+func (c *configManager) set(key string, value []byte, kind ValueType) error {
+	if err := checkRecordSize(key, value); err != nil {
+		return c.report(err)
+	}
 	// write lock the file
 	if err := c.wlock(); err != nil {
 		return err
 	}
 	defer c.unlock()
-	return c.setNoLock(key, value)
+	if err := c.setNoLock(key, value, kind); err != nil {
+		return err
+	}
+	// The value is set already, so a failed rehash doesn't fail the Set.
+	if err := c.rehashIfNeeded(key); err != nil {
+		c.logf("dyconf: failed to rehash the file [%s]. error: [%s]", c.fileName, err.Error())
+	}
+	return nil
 }
 
-// setNoLock is a helper method to set the key-value in the config. It does so without locking the file.
-// So, it should always be used in a method that locks the file.
-func (c *configManager) setNoLock(key string, value []byte) error {
-	var err error
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+// rehashIfNeeded rebuilds the file with an index of twice as many slots if there are too many keys per
+// slot, or if the list of the given key is too long. See WithMaxLoadFactor and WithMaxChainLength. A list
+// only gets longer when a key is added to it, so checking the list of every key that is set catches the
+// longest one. A rehash that failed is not tried again until the file has twice as many keys, so that
+// the changes after it don't copy the whole file only to fail again. The caller must hold the write lock.
+func (c *configManager) rehashIfNeeded(key string) error {
+	h, err := c.header()
 	if err != nil {
 		return err
 	}
-
-	index := &indexBlock{
-		size: defaultIndexCount,
-		data: c.block[h.indexBlockOffset : uint32(h.indexBlockOffset)+h.indexBlockSize],
+	if h.keyCount < c.rehashRetryAt {
+		return nil
 	}
-	offset, err := index.get(key)
-	if err != nil {
-		return err
+	slots, maxSlots := h.indexSlotCount(), maxIndexBlockSize/offsetSize(h.wide())
+	if slots >= maxSlots {
+		return nil // The index can't get any bigger.
 	}
-
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
-	var newOffset = offset
-	if offset == 0 { // index was not found
-		newOffset, err = db.save(key, value)
+	load := float64(h.keyCount) / float64(slots)
+	rehash := c.opts.maxLoadFactor > 0 && load > c.opts.maxLoadFactor
+	if !rehash && c.opts.maxChainLength > 0 && load > c.opts.maxLoadFactor/4 {
+		offset, err := c.index(h).get(key)
 		if err != nil {
 			return err
 		}
-	} else {
-		newOffset, err = db.update(offset, key, value)
+		length, err := c.data(h).chainLength(offset)
 		if err != nil {
 			return err
 		}
+		rehash = length > c.opts.maxChainLength
+	}
+	if !rehash {
+		return nil
 	}
+	newSlots := slots * 2
+	if newSlots > maxSlots {
+		newSlots = maxSlots
+	}
+	c.logf("dyconf: rehashing the file [%s] into [%d] index slots. Load factor: [%.2f]", c.fileName, newSlots, load)
+	if err := c.rebuild(h, newSlots); err != nil {
+		c.rehashRetryAt = 2 * h.keyCount
+		return err
+	}
+	return nil
+}
 
-	// Save the offset if it's changed.
-	if newOffset != offset {
-		err = index.set(key, newOffset)
+// setNoLock is a helper method to set the key-value in the config. It does so without locking the file.
+// So, it should always be used in a method that locks the file.
+func (c *configManager) setNoLock(key string, value []byte, kind ValueType) error {
+	return c.mutate(func(h *headerBlock) error {
+		index := c.index(h)
+		offset, err := index.get(key)
 		if err != nil {
 			return err
 		}
+
+		db := c.data(h)
+
+		// Grow the data block if the free space can't hold the new record.
+		required, err := db.required(offset, key, value)
+		if err != nil {
+			return err
+		}
+		free, err := db.freeByteCount()
+		if err != nil {
+			return err
+		}
+		if uint64(required) > free {
+			if h, err = c.grow(h, uint64(required)-free); err != nil {
+				return err
+			}
+			index, db = c.index(h), c.data(h)
+		}
+
+		var newOffset = offset
+		if offset == 0 { // index was not found
+			newOffset, err = db.save(key, value, kind)
+			if err != nil {
+				return err
+			}
+			h.keyCount++
+		} else {
+			rec, _, _, err := db.find(offset, key)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				h.keyCount++
+			}
+			newOffset, err = db.update(offset, key, value, kind)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Save the offset if it's changed.
+		if newOffset != offset {
+			err = index.set(key, newOffset)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Older readers can't read the type saved in the record, so the file is marked as using them.
+		if kind != TypeBytes {
+			h.incompatFeatures |= featureValueTypes
+		}
+
+		// Record the change in the header and in the change feed.
+		h.touch()
+		if err := c.recordChange(h, EventSet, key); err != nil {
+			return err
+		}
+		return h.save()
+	})
+}
+
+// grow extends the data block by at least the given number of bytes. The data block is the last block
+// in the file, so it is grown by extending the file and remapping it. The data block size is doubled
+// until it is large enough, but it never exceeds the limit of the file (see headerBlock.maxDataBlockSize).
+// It returns the updated header.
+func (c *configManager) grow(h *headerBlock, atLeast uint64) (*headerBlock, error) {
+	if uint64(h.dataBlockOffset)+uint64(h.dataBlockSize) != uint64(h.totalSize) {
+		return nil, stackerr.Newf(
+			"dyconf: cannot grow the config file [%s]. The data block [%#x +%#x] is not at the end of the file [%#x]",
+			c.fileName,
+			h.dataBlockOffset,
+			h.dataBlockSize,
+			h.totalSize,
+		)
 	}
 
-	// Update when the time when the config was modified.
-	h.modifiedTime = time.Now()
+	required := h.dataBlockSize + atLeast
+	if required > h.maxDataBlockSize() {
+		return nil, &FileError{
+			FileName: c.fileName,
+			Reason: fmt.Sprintf(
+				"dyconf: cannot grow the data block by [%#x] bytes. It would exceed [%#X]",
+				atLeast,
+				h.maxDataBlockSize(),
+			),
+			Err: ErrNoSpace,
+		}
+	}
+	newSize := h.dataBlockSize
+	for newSize < required {
+		newSize *= 2
+	}
+	if newSize > h.maxDataBlockSize() {
+		newSize = h.maxDataBlockSize()
+	}
+	newTotalSize := h.totalSize + newSize - h.dataBlockSize
+
+	// Extend the file before the header records the new size. If we crash in between, writeInit
+	// finds a file larger than its header says and discards the extra bytes.
+	if err := c.file.Truncate(int64(newTotalSize)); err != nil {
+		return nil, stackerr.Newf(
+			"dyconf: failed to grow the config file [%s] to [%#x] bytes. error: [%s]",
+			c.fileName,
+			newTotalSize,
+			err.Error(),
+		)
+	}
+	if err := c.remap(newTotalSize); err != nil {
+		return nil, err
+	}
+
+	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+	if err != nil {
+		return nil, err
+	}
+	h.totalSize = newTotalSize
+	h.dataBlockSize = newSize
 	if err := h.save(); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	c.logf("dyconf: grew the data block of the file [%s] to [%#x] bytes", c.fileName, newSize)
+	return h, nil
 }
 
 func (c *configManager) Map() (map[string][]byte, error) {
@@ -363,131 +1072,401 @@ func (c *configManager) Map() (map[string][]byte, error) {
 	}
 	defer c.unlock()
 
+	ret, _, err := c.keyValues(nil)
+	return ret, err
+}
+
+// keyValues returns the key-values of the keys match returns true for, or of all the keys if match is
+// nil, along with the generation they are of. The caller must hold the lock on the file.
+func (c *config) keyValues(match func(key string) bool) (map[string][]byte, uint64, error) {
 	ret := make(map[string][]byte)
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+	h, err := c.header()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	index := &indexBlock{
-		size: defaultIndexCount,
-		data: c.block[h.indexBlockOffset : uint32(h.indexBlockOffset)+h.indexBlockSize],
-	}
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
+	index := c.index(h)
+	db := c.data(h)
 
 	offsets, err := index.getAll()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	for _, offset := range offsets {
 		kv, err := db.fetchAll(offset)
 		if err != nil {
-			return nil, err
+			return nil, 0, c.report(err)
 		}
 		for key, val := range kv {
-			ret[key] = val
+			if match == nil || match(key) {
+				ret[key] = val
+			}
 		}
 	}
-	return ret, nil
+	return ret, h.generation, nil
 }
 
+// Defrag rewrites the config data into a new file, leaving out the space taken by deleted and
+// overwritten records. The new file is built next to the config file and renamed over it once it is
+// complete and synced, so a crash at any point leaves either the old or the new file in place. Processes
+// that have the old file open switch to the new one the next time they lock it.
 func (c *configManager) Defrag() error {
-	// Save the current values. Don't lock before calling Map() since it also takes a read lock.
-	kvMap, err := c.Map()
-	if err != nil {
+	// write lock the file
+	if err := c.wlock(); err != nil {
 		return err
 	}
+	defer c.unlock()
 
-	// now write lock the file
-	if err := c.wlock(); err != nil {
+	h, err := c.header()
+	if err != nil {
 		return err
 	}
-	defer c.unlock()
+	return c.rebuild(h, h.indexSlotCount())
+}
 
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+// rebuild copies the config data described by the given header into a new file with the given number
+// of index slots, and renames the new file over the config file. See Defrag. The caller must hold the
+// write lock.
+func (c *configManager) rebuild(h *headerBlock, indexCount uint32) error {
+	stat, err := c.file.Stat()
 	if err != nil {
+		return stackerr.Newf("dyconf: failed to stat the file [%s]. error: [%s]", c.fileName, err.Error())
+	}
+
+	// A stale file left behind by an earlier rebuild is truncated. Only one rebuild can run at a time
+	// since it holds the write lock.
+	shadowName := c.fileName + defragFileSuffix
+	shadow := &configManager{opts: &options{
+		indexCount:     indexCount,
+		dataBlockSize:  h.dataBlockSize,
+		fileMode:       stat.Mode().Perm(),
+		hash:           h.hash,
+		wide:           h.wide(),
+		changeFeedSize: h.feedSize,
+		lockFreeReads:  h.compatFeatures&featureSequence != 0,
+	}}
+	replaced := false
+	defer func() {
+		if replaced {
+			return
+		}
+		if shadow.block != nil {
+			syscall.Munmap(shadow.block)
+		}
+		if shadow.file != nil {
+			shadow.file.Close()
+		}
+		os.Remove(shadowName)
+	}()
+	if err := shadow.createNew(shadowName); err != nil {
+		return err
+	}
+	// Nobody else can open the new file before it's renamed, but it has to be locked by the time it is.
+	if err := shadow.wlock(); err != nil {
 		return err
 	}
+	if err := c.copyTo(shadow, h); err != nil {
+		return err
+	}
+	if err := shadow.file.Sync(); err != nil {
+		return stackerr.Newf("dyconf: failed to sync the file [%s]. error: [%s]", shadowName, err.Error())
+	}
 
-	index := &indexBlock{
-		size: defaultIndexCount,
-		data: c.block[h.indexBlockOffset : uint32(h.indexBlockOffset)+h.indexBlockSize],
+	// Flag the old file before renaming, so that it is flagged by the time anyone else can lock it.
+	if err := c.saveFlags(h, h.flags|headerFlagReplaced); err != nil {
+		return err
 	}
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
+	if err := os.Rename(shadowName, c.fileName); err != nil {
+		c.saveFlags(h, h.flags&^headerFlagReplaced)
+		return stackerr.Newf("dyconf: failed to replace the file [%s] with [%s]. error: [%s]", c.fileName, shadowName, err.Error())
+	}
+	replaced = true
 
-	// Reset the index and the data block.
-	if err := index.reset(); err != nil {
+	// Switch to the new file. Closing the old file releases the lock held on it.
+	c.cache = nil
+	if err := syscall.Munmap(c.block); err != nil {
+		return c.mapError("failed to unmap the replaced config file", err)
+	}
+	c.file.Close()
+	c.file, c.block = shadow.file, shadow.block
+
+	if err := syncDir(c.fileName); err != nil {
 		return err
 	}
-	if err := db.reset(); err != nil {
+	c.notify()
+	return nil
+}
+
+// copyTo copies all the key-values described by the given header to the given config. The caller must
+// hold the lock on both.
+func (c *configManager) copyTo(dst *configManager, h *headerBlock) error {
+	index := c.index(h)
+	db := c.data(h)
+
+	offsets, err := index.getAll()
+	if err != nil {
 		return err
 	}
+	for _, offset := range offsets {
+		// The records are copied one by one rather than with fetchAll, to keep their types.
+		for offset != 0 {
+			rec, err := db.readRecordFrom(offset)
+			if err != nil {
+				return err
+			}
+			if err := dst.setNoLock(string(rec.key), rec.data, rec.kind); err != nil {
+				return err
+			}
+			offset = rec.next
+		}
+	}
 
-	for k, v := range kvMap {
-		if err := c.Set(k, v); err != nil {
-			return stackerr.Wrap(err)
+	// The copy continues the generation of the original, counting the copy as one change.
+	dh, err := dst.header()
+	if err != nil {
+		return err
+	}
+	dh.generation = h.generation
+	dh.touch()
+	// The feed of the copy replaces the entries of the keys copied with those of the original.
+	if df := dst.feed(dh); df != nil {
+		if err := df.copyFrom(c.feed(h), dh.generation); err != nil {
+			return err
 		}
 	}
+	return dh.save()
+}
+
+// saveFlags saves the given flags in the header. The flags are changed outside of mutate, so the
+// sequence number is bumped here. The caller must hold the write lock.
+func (c *config) saveFlags(h *headerBlock, flags uint32) error {
+	c.bumpSequence(h)
+	defer c.bumpSequence(h)
+	h.flags = flags
+	return h.save()
+}
+
+// syncDir syncs the directory containing the given file, so that a rename into it survives a crash.
+func syncDir(fileName string) error {
+	dir, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return stackerr.Newf("dyconf: failed to open the directory of the file [%s]. error: [%s]", fileName, err.Error())
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return stackerr.Newf("dyconf: failed to sync the directory of the file [%s]. error: [%s]", fileName, err.Error())
+	}
 	return nil
 }
 
-func (c *configManager) freeDataByteCount() (uint32, error) {
+// freeDataByteCount returns the number of contiguous free bytes at the end of the data block and the
+// number of bytes in the free lists, which can be reused by records that fit in them.
+func (c *configManager) freeDataByteCount() (uint64, uint64, error) {
 	// read lock the file
 	if err := c.rlock(); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	defer c.unlock()
 
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+	h, err := c.header()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
-	return db.freeByteCount()
+	db := c.data(h)
+	contiguous, err := db.freeByteCount()
+	if err != nil {
+		return 0, 0, err
+	}
+	return contiguous, db.reclaimable(), nil
 }
 
-func (c *configManager) dataBlockSize() (uint32, error) {
+func (c *configManager) dataBlockSize() (uint64, error) {
 	// read lock the file
 	if err := c.rlock(); err != nil {
 		return 0, err
 	}
 	defer c.unlock()
 
-	h, err := (&headerBlock{}).read(c.block[0:headerBlockSize])
+	h, err := c.header()
 	if err != nil {
 		return 0, err
 	}
 
-	db := &dataBlock{block: c.block[h.dataBlockOffset : uint32(h.dataBlockOffset)+h.dataBlockSize]}
+	db := c.data(h)
 	return db.size()
 }
 
+// closedError returns the error of using the config after Close.
+func (c *config) closedError() error {
+	return &FileError{FileName: c.fileName, Reason: "dyconf: the config is closed", Err: ErrClosed}
+}
+
+// acquire takes a reference to the config for an operation, so that Close waits for it. It fails once
+// Close is called. Every acquire must be followed by a release.
+func (c *config) acquire() error {
+	c.refMu.Lock()
+	defer c.refMu.Unlock()
+	if c.closed {
+		return c.closedError()
+	}
+	c.refs.Add(1)
+	return nil
+}
+
+func (c *config) release() {
+	c.refs.Done()
+}
+
+// checkOpen returns an ErrClosed error if Close was called.
+func (c *config) checkOpen() error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	c.release()
+	return nil
+}
+
+// rlock read locks the file. The goroutines reading at once share the lock, as long as the header cache
+// is up to date. Otherwise the goroutine locks the config for itself and brings the cache up to date, since
+// that may remap or reopen the file.
 func (c *config) rlock() error {
-	if err := syscall.Flock(int(c.file.Fd()), syscall.LOCK_SH); err != nil {
-		return stackerr.Newf("dyconf: failed to acquire read lock for file [%s]. error: [%s]", c.file.Name(), err.Error())
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	c.mu.RLock()
+	if err := c.flockShared(); err != nil {
+		c.mu.RUnlock()
+		c.release()
+		return err
+	}
+	if c.fresh() {
+		return nil
+	}
+	c.funlockShared()
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	if err := c.flock(syscall.LOCK_SH); err != nil {
+		c.mu.Unlock()
+		c.release()
+		return err
+	}
+	c.exclusive = true
+	// The file isn't mapped yet while the config is initialized.
+	if c.block != nil {
+		if _, err := c.cachedHeader(); err != nil {
+			c.unlock()
+			return err
+		}
 	}
 	return nil
 }
+
 func (c *configManager) wlock() error {
-	if err := syscall.Flock(int(c.file.Fd()), syscall.LOCK_EX); err != nil {
-		return stackerr.Newf("dyconf: failed to acquire write lock for file [%s]. error: [%s]", c.file.Name(), err.Error())
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if err := c.flock(syscall.LOCK_EX); err != nil {
+		c.mu.Unlock()
+		c.release()
+		return err
 	}
+	c.exclusive = true
 	return nil
 }
+
 func (c *config) unlock() error {
+	defer c.release()
+	if c.exclusive {
+		c.exclusive = false
+		defer c.mu.Unlock()
+		return c.funlock()
+	}
+	defer c.mu.RUnlock()
+	return c.funlockShared()
+}
+
+// flockShared takes the shared flock for a reading goroutine, unless the other readers have it already.
+func (c *config) flockShared() error {
+	c.flockMu.Lock()
+	defer c.flockMu.Unlock()
+	if c.readers == 0 {
+		if err := c.flock(syscall.LOCK_SH); err != nil {
+			return err
+		}
+	}
+	c.readers++
+	return nil
+}
+
+// funlockShared releases the shared flock once the last reading goroutine is done with it.
+func (c *config) funlockShared() error {
+	c.flockMu.Lock()
+	defer c.flockMu.Unlock()
+	c.readers--
+	if c.readers > 0 {
+		return nil
+	}
+	return c.funlock()
+}
+
+func (c *config) flock(how int) error {
+	if err := syscall.Flock(int(c.file.Fd()), how); err != nil {
+		if how == syscall.LOCK_EX {
+			return c.lockError("failed to acquire write lock", err)
+		}
+		return c.lockError("failed to acquire read lock", err)
+	}
+	c.locked = how
+	return nil
+}
+
+func (c *config) funlock() error {
 	if err := syscall.Flock(int(c.file.Fd()), syscall.LOCK_UN); err != nil {
-		return stackerr.Newf("dyconf: failed to release the lock for file [%s]. error: [%s]", c.file.Name(), err.Error())
+		return c.lockError("failed to release the lock", err)
 	}
+	c.locked = 0
 	return nil
 }
 
+// lockError returns an ErrLock error about the given failure of locking the file.
+func (c *config) lockError(what string, err error) error {
+	return &FileError{FileName: c.fileName, Reason: fmt.Sprintf("dyconf: %s. error: [%s]", what, err.Error()), Err: ErrLock}
+}
+
+// mapError returns an ErrMap error about the given failure of mapping the file.
+func (c *config) mapError(what string, err error) error {
+	return &FileError{FileName: c.fileName, Reason: fmt.Sprintf("dyconf: %s. error: [%s]", what, err.Error()), Err: ErrMap}
+}
+
+// Close waits for the operations in flight to complete and releases the file. The operations started
+// after it is called fail with ErrClosed.
 func (c *config) Close() error {
-	c.rlock()
-	defer c.unlock()
+	c.refMu.Lock()
+	if c.closed {
+		c.refMu.Unlock()
+		return c.closedError()
+	}
+	c.closed = true
+	for _, cancel := range c.watchers {
+		cancel()
+	}
+	c.watchers = nil
+	c.refMu.Unlock()
+	// A Wait in progress doesn't hold a reference. Closing the subscription wakes it up.
+	if c.sub != nil {
+		c.sub.close()
+	}
+	c.refs.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache = nil
 	if err := syscall.Munmap(c.block); err != nil {
-		return err
+		return c.mapError("failed to unmap the config file", err)
 	}
 	return c.file.Close()
 }
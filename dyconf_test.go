@@ -1,11 +1,18 @@
 package dyconf
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/facebookgo/ensure"
 )
@@ -55,6 +62,195 @@ func TestDyconfSetGetClose(t *testing.T) {
 	}
 }
 
+func TestDyconfGetView(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfGetView-")
+	defer os.Remove(tmpFileName)
+
+	wc, err := NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.Nil(t, wc.Set("Key1", []byte("Value1")))
+	ensure.Nil(t, wc.Set("Key2", []byte("Value2")))
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	fnErr := errors.New("fn failed")
+	cases := []struct {
+		key            string
+		fnErr          error
+		expectedVal    []byte
+		expectedErrStr string
+	}{
+		{ // Case-0: existing key.
+			key:         "Key1",
+			expectedVal: []byte("Value1"),
+		},
+		{ // Case-1: missing key.
+			key:            "Key3",
+			expectedErrStr: `^dyconf: the key was not found`,
+		},
+		{ // Case-2: the error of fn is returned.
+			key:            "Key2",
+			fnErr:          fnErr,
+			expectedVal:    []byte("Value2"),
+			expectedErrStr: "^fn failed$",
+		},
+	}
+	for i, tc := range cases {
+		var val []byte
+		err := conf.GetView(tc.key, func(value []byte) error {
+			val = append([]byte(nil), value...)
+			return tc.fnErr
+		})
+		if tc.expectedErrStr != "" {
+			ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+		} else {
+			ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		}
+		ensure.DeepEqual(t, val, tc.expectedVal, fmt.Sprintf("Case: [%d]", i))
+	}
+
+	// The manager can read in place too.
+	ensure.Nil(t, wc.GetView("Key2", func(value []byte) error {
+		ensure.DeepEqual(t, value, []byte("Value2"))
+		return nil
+	}))
+
+	ensure.Nil(t, wc.Close())
+	ensure.Nil(t, conf.Close())
+}
+
+// TestDyconfEmptyValue tests that empty values are stored and told apart from missing keys.
+func TestDyconfEmptyValue(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfEmptyValue-")
+	defer os.Remove(tmpFileName)
+
+	wc, err := NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.Nil(t, wc.Set("Empty", []byte{}))
+	ensure.Nil(t, wc.Set("Nil", nil))
+	ensure.Nil(t, wc.Set("Key1", []byte("Value1")))
+	// Overwrite a value with an empty one.
+	ensure.Nil(t, wc.Set("Key1", []byte{}))
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	for i, key := range []string{"Empty", "Nil", "Key1"} {
+		val, err := conf.Get(key)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, val, []byte{}, fmt.Sprintf("Case: [%d]", i))
+	}
+	_, err = conf.Get("Key2")
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: the key was not found`))
+
+	kv, err := wc.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, kv, map[string][]byte{"Empty": {}, "Nil": {}, "Key1": {}})
+
+	// The empty values survive a rebuild.
+	ensure.Nil(t, wc.Defrag())
+	val, err := wc.Get("Empty")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte{})
+
+	ensure.Nil(t, wc.Close())
+	ensure.Nil(t, conf.Close())
+}
+
+func TestDyconfHas(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfHas-")
+	defer os.Remove(tmpFileName)
+
+	// Everything falls into the same slot, so the keys share a list.
+	savedHashfunc := defaultHashFunc
+	defaultHashFunc = func(key string) (uint32, error) {
+		return 3, nil
+	}
+	defer func() {
+		defaultHashFunc = savedHashfunc // restore
+	}()
+
+	wc, err := NewManager(tmpFileName, WithIndexSlots(16), WithMaxChainLength(0))
+	ensure.Nil(t, err)
+	ensure.Nil(t, wc.Set("Key1", []byte("Value1")))
+	ensure.Nil(t, wc.Set("Key2", []byte{}))
+	ensure.Nil(t, wc.Set("Key3", []byte("Value3")))
+	ensure.Nil(t, wc.Delete("Key3"))
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	cases := []struct {
+		key      string
+		expected bool
+	}{
+		{key: "Key1", expected: true},  // Case-0: key in the list.
+		{key: "Key2", expected: true},  // Case-1: key with an empty value.
+		{key: "Key3", expected: false}, // Case-2: deleted key.
+		{key: "Key4", expected: false}, // Case-3: key not in the list.
+	}
+	for i, tc := range cases {
+		has, err := conf.Has(tc.key)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, has, tc.expected, fmt.Sprintf("Case: [%d]", i))
+	}
+
+	ensure.Nil(t, wc.Close())
+	ensure.Nil(t, conf.Close())
+}
+
+// TestDyconfGetAllocs tests that a lookup allocates nothing but the copy of the value, and that the
+// cached header follows the changes of the file.
+func TestDyconfGetAllocs(t *testing.T) {
+	cases := [][]Option{
+		{WithHash(HashFNV1a)},     // Case-0
+		{WithHash(HashCRC32C)},    // Case-1
+		{WithHash(HashSipHash24)}, // Case-2
+		{WithLockFreeReads()},     // Case-3
+	}
+	for i, opts := range cases {
+		tmpFileName := setupTempFile(t, fmt.Sprintf("TestDyconfGetAllocs-Case%d-", i))
+		defer os.Remove(tmpFileName)
+
+		wc, err := NewManager(tmpFileName, append(opts, WithDataBlockSize(minDataBlockSize))...)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, wc.Set("Key1", []byte("Value1")), fmt.Sprintf("Case: [%d]", i))
+		conf, err := New(tmpFileName, opts...)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+
+		// Has allocates nothing.
+		allocs := testing.AllocsPerRun(100, func() {
+			conf.Has("Key1")
+			conf.Has("Key2")
+		})
+		ensure.DeepEqual(t, allocs, float64(0), fmt.Sprintf("Case: [%d]", i))
+
+		// A miss allocates nothing.
+		allocs = testing.AllocsPerRun(100, func() {
+			conf.Get("Key2")
+		})
+		ensure.DeepEqual(t, allocs, float64(0), fmt.Sprintf("Case: [%d]", i))
+
+		// A hit allocates only the copy of the value.
+		allocs = testing.AllocsPerRun(100, func() {
+			conf.Get("Key1")
+		})
+		ensure.DeepEqual(t, allocs, float64(1), fmt.Sprintf("Case: [%d]", i))
+
+		// The changes are seen through the cached header, including growing the file.
+		ensure.Nil(t, wc.Set("Key1", []byte("Value1-2")), fmt.Sprintf("Case: [%d]", i))
+		val, err := conf.Get("Key1")
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, val, []byte("Value1-2"), fmt.Sprintf("Case: [%d]", i))
+		bigVal := make([]byte, minDataBlockSize*2)
+		ensure.Nil(t, wc.Set("Key2", bigVal), fmt.Sprintf("Case: [%d]", i))
+		val, err = conf.Get("Key2")
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, val, bigVal, fmt.Sprintf("Case: [%d]", i))
+
+		ensure.Nil(t, wc.Close(), fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, conf.Close(), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
 func TestDyconfOverwrite(t *testing.T) {
 	setSequence := []struct {
 		key string
@@ -199,7 +395,7 @@ func TestDyconfDelete(t *testing.T) {
 	ensure.Nil(t, err)
 	for _, delKey := range deleteKeys {
 		val, err := conf.Get(delKey)
-		ensure.Err(t, err, regexp.MustCompile(`^dyconf: key .* was not found.*`))
+		ensure.Err(t, err, regexp.MustCompile(`^dyconf: the key was not found`))
 		ensure.True(t, (val == nil))
 	}
 
@@ -271,7 +467,7 @@ func TestDyconfDeleteWithCollisions(t *testing.T) {
 	ensure.Nil(t, err)
 	for _, delKey := range deleteKeys {
 		val, err := conf.Get(delKey)
-		ensure.Err(t, err, regexp.MustCompile(`^dyconf: key .* was not found.*`))
+		ensure.Err(t, err, regexp.MustCompile(`^dyconf: the key was not found`))
 		ensure.True(t, (val == nil))
 	}
 
@@ -296,6 +492,23 @@ func TestDyconfInitErrors(t *testing.T) {
 	ensure.Nil(t, conf)
 }
 
+// TestDyconfInitNotConfigFile tests that files which are not config files are refused.
+func TestDyconfInitNotConfigFile(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfInitNotConfigFile-")
+	defer os.Remove(tmpFileName)
+	ensure.Nil(t, ioutil.WriteFile(tmpFileName, make([]byte, 4096), 0644))
+
+	conf, err := New(tmpFileName)
+	ensure.Err(t, err, regexp.MustCompile(`^headerBlock: invalid magic \[00 00 00 00\]. Not a config file`))
+	ensure.Nil(t, conf)
+	_, ok := err.(*FormatError)
+	ensure.True(t, ok)
+
+	m, err := NewManager(tmpFileName)
+	ensure.Err(t, err, regexp.MustCompile(`^headerBlock: invalid magic \[00 00 00 00\]. Not a config file`))
+	ensure.Nil(t, m)
+}
+
 func TestDyconfWriteInitNewFile(t *testing.T) {
 	// Create the file first.
 	tmpFileName := setupTempFile(t, "TestDyconfWriteInitNewFile-")
@@ -430,23 +643,856 @@ func TestDyconfDefrag(t *testing.T) {
 		ensure.Nil(t, m.Set(kv.key, kv.val))
 	}
 	// save previous free byte count
-	prevFreeBytes, err := m.freeDataByteCount()
+	prevFreeBytes, prevReclaimable, err := m.freeDataByteCount()
 	ensure.Nil(t, err)
+	ensure.True(t, prevReclaimable > 0)
 
 	// defrag
 	ensure.Nil(t, m.Defrag())
 
 	// new free byte count
-	newFreeBytes, err := m.freeDataByteCount()
+	newFreeBytes, newReclaimable, err := m.freeDataByteCount()
 	ensure.Nil(t, err)
 
 	// new free byte count must be greater than previous one.
 	ensure.True(t, newFreeBytes > prevFreeBytes)
+	ensure.DeepEqual(t, newReclaimable, uint64(0))
 
 	// Also verify the size of the data block.
 	usedByteCount, err := m.dataBlockSize()
 	ensure.Nil(t, err)
-	ensure.DeepEqual(t, usedByteCount, expectedUsedByteCount)
+	ensure.DeepEqual(t, usedByteCount, uint64(expectedUsedByteCount))
+
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfDefragReplacesFile tests that Defrag replaces the config file with a new one and that
+// existing readers and writers switch to it.
+func TestDyconfDefragReplacesFile(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfDefragReplacesFile-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithFileMode(0600))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key1", []byte("value1")))
+	ensure.Nil(t, m.Set("key2", []byte("value2")))
+	ensure.Nil(t, m.Delete("key2"))
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	m2, err := NewManager(tmpFileName)
+	ensure.Nil(t, err)
+
+	before, err := os.Stat(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Defrag())
+	after, err := os.Stat(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.False(t, os.SameFile(before, after))
+	ensure.DeepEqual(t, after.Mode().Perm(), os.FileMode(0600))
+
+	// The new file is renamed into place, so nothing is left behind.
+	_, err = os.Stat(tmpFileName + defragFileSuffix)
+	ensure.True(t, os.IsNotExist(err))
+
+	// The reader switches to the new file.
+	val, err := conf.Get("key1")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("value1"))
+	_, err = conf.Get("key2")
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: the key was not found`))
+
+	// Changes made by either writer are seen by the reader.
+	ensure.Nil(t, m.Set("key3", []byte("value3")))
+	ensure.Nil(t, m2.Set("key4", []byte("value4")))
+	for _, key := range []string{"key3", "key4"} {
+		_, err = conf.Get(key)
+		ensure.Nil(t, err, key)
+	}
+	kv, err := m.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(kv), 3)
+
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m2.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfStaleReplacedFlag tests that a replaced flag left behind by a Defrag that died before the
+// rename is ignored by readers and cleared by writers.
+func TestDyconfStaleReplacedFlag(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfStaleReplacedFlag-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	cm := m.(*configManager)
+	ensure.Nil(t, cm.wlock())
+	h, err := cm.header()
+	ensure.Nil(t, err)
+	h.flags |= headerFlagReplaced
+	ensure.Nil(t, h.save())
+	ensure.Nil(t, cm.unlock())
+	ensure.Nil(t, m.Close())
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	val, err := conf.Get("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("value"))
+
+	m, err = NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	cm = m.(*configManager)
+	ensure.Nil(t, cm.rlock())
+	h, err = cm.header()
+	ensure.Nil(t, err)
+	ensure.Nil(t, cm.unlock())
+	ensure.DeepEqual(t, h.flags&headerFlagReplaced, uint32(0))
 
+	ensure.Nil(t, conf.Close())
 	ensure.Nil(t, m.Close())
 }
+
+// TestDyconfGrow tests that the data block grows when it runs out of space and that an existing reader
+// picks up the new size.
+func TestDyconfGrow(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfGrow-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		val := []byte(fmt.Sprintf("value-%d", i))
+		ensure.Nil(t, m.Set(key, val), fmt.Sprintf("key: [%s]", key))
+		expected[key] = val
+	}
+	// A value much bigger than the data block.
+	bigVal := make([]byte, minDataBlockSize*8)
+	ensure.Nil(t, m.Set("big", bigVal))
+	expected["big"] = bigVal
+
+	stat, err := os.Stat(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.True(t, stat.Size() > int64(headerBlockSize+journalBlockSize+16*sizeOfUint32+minDataBlockSize))
+
+	for key, expectedVal := range expected {
+		val, err := conf.Get(key)
+		ensure.Nil(t, err, fmt.Sprintf("key: [%s]", key))
+		ensure.DeepEqual(t, val, expectedVal, fmt.Sprintf("key: [%s]", key))
+	}
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfWriteInitInterruptedGrowth tests that the bytes left behind by an interrupted growth are discarded.
+func TestDyconfWriteInitInterruptedGrowth(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfWriteInitInterruptedGrowth-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	ensure.Nil(t, m.Close())
+
+	// Extend the file without updating the header.
+	expectedSize := int64(headerBlockSize + journalBlockSize + defaultChangeFeedSize + 16*sizeOfUint32 + minDataBlockSize)
+	ensure.Nil(t, os.Truncate(tmpFileName, expectedSize*2))
+
+	m, err = NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	val, err := m.Get("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("value"))
+	ensure.Nil(t, m.Close())
+
+	stat, err := os.Stat(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, stat.Size(), expectedSize)
+}
+
+// TestDyconfCorruptRecord tests that a corrupted record is detected while reading.
+func TestDyconfCorruptRecord(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfCorruptRecord-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("some value")))
+	ensure.Nil(t, m.Close())
+
+	// Flip a bit of the value on disk.
+	content, err := ioutil.ReadFile(tmpFileName)
+	ensure.Nil(t, err)
+	pos := bytes.Index(content, []byte("some value"))
+	ensure.True(t, pos > 0)
+	content[pos] ^= 0x01
+	ensure.Nil(t, ioutil.WriteFile(tmpFileName, content, 0644))
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	_, err = conf.Get("key")
+	// The first record follows the free list directory.
+	ensure.Err(t, err, regexp.MustCompile(`^dataBlock: corrupt record at offset \[0x50\].*Checksum mismatch`))
+	_, ok := err.(*CorruptionError)
+	ensure.True(t, ok)
+	ensure.Nil(t, conf.Close())
+}
+
+// TestDyconfLogger tests that the corruption found in the file is logged along with the bytes around it.
+func TestDyconfLogger(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfLogger-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("some value")))
+	ensure.Nil(t, m.Close())
+
+	// Flip a bit of the value on disk.
+	content, err := ioutil.ReadFile(tmpFileName)
+	ensure.Nil(t, err)
+	content[bytes.Index(content, []byte("some value"))] ^= 0x01
+	ensure.Nil(t, ioutil.WriteFile(tmpFileName, content, 0644))
+
+	var logs bytes.Buffer
+	conf, err := New(tmpFileName, WithLogger(log.New(&logs, "", 0)))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, logs.String(), "")
+	_, err = conf.Get("key")
+	ensure.NotNil(t, err)
+	ensure.StringContains(t, logs.String(), "Checksum mismatch")
+	ensure.StringContains(t, logs.String(), "bytes around offset [0x50] of [0x400]")
+	ensure.True(t, logs.Len() < 1024, logs.String())
+	ensure.Nil(t, conf.Close())
+}
+
+// TestDyconfGeneration tests that the generation changes with every change of the config data.
+func TestDyconfGeneration(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfGeneration-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	gen, err := conf.Generation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, gen, uint64(0))
+
+	changes := []func() error{
+		func() error { return m.Set("key", []byte("value")) },
+		func() error { return m.Set("key", []byte("value2")) },
+		func() error { return m.Delete("key") },
+		func() error { return m.Defrag() },
+	}
+	for i, change := range changes {
+		ensure.Nil(t, change(), fmt.Sprintf("Change: [%d]", i))
+		newGen, err := conf.Generation()
+		ensure.Nil(t, err, fmt.Sprintf("Change: [%d]", i))
+		ensure.True(t, newGen > gen, fmt.Sprintf("Change: [%d]. Generation [%d] should be greater than [%d]", i, newGen, gen))
+		gen = newGen
+	}
+
+	// Reads don't change the generation.
+	_, err = conf.Get("key")
+	ensure.NotNil(t, err)
+	_, err = m.Map()
+	ensure.Nil(t, err)
+	newGen, err := m.Generation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, newGen, gen)
+
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfMutateRollback tests that a failed change is undone.
+func TestDyconfMutateRollback(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfMutateRollback-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	cm := m.(*configManager)
+	before := append([]byte(nil), cm.block...)
+
+	ensure.Nil(t, cm.wlock())
+	err = cm.mutate(func(h *headerBlock) error {
+		ensure.Nil(t, cm.index(h).set("key", 0))
+		h.touch()
+		ensure.Nil(t, h.save())
+		return errors.New("failed")
+	})
+	ensure.Nil(t, cm.unlock())
+	ensure.Err(t, err, regexp.MustCompile(`^failed$`))
+	// Everything but the journal itself is restored.
+	journalEnd := headerBlockSize + journalBlockSize
+	ensure.DeepEqual(t, cm.block[:headerBlockSize], before[:headerBlockSize])
+	ensure.DeepEqual(t, cm.block[journalEnd:], before[journalEnd:])
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfRecoverInterruptedChange tests that a change interrupted by a crash is undone when the file is
+// opened for writing again.
+func TestDyconfRecoverInterruptedChange(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfRecoverInterruptedChange-")
+	defer os.Remove(tmpFileName)
+
+	// Use a single slot so that the keys are chained.
+	m, err := NewManager(tmpFileName, WithIndexSlots(1), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key1", []byte("value1")))
+	ensure.Nil(t, m.Set("key2", []byte("value2")))
+	gen, err := m.Generation()
+	ensure.Nil(t, err)
+
+	// Die in the middle of a change. The panic stands in for the crash.
+	cm := m.(*configManager)
+	ensure.Nil(t, cm.wlock())
+	func() {
+		defer func() { ensure.DeepEqual(t, recover(), "crash") }()
+		cm.mutate(func(h *headerBlock) error {
+			db := cm.data(h)
+			offset, err := cm.index(h).get("key1")
+			ensure.Nil(t, err)
+			_, err = db.update(offset, "key2", []byte("a longer value2"), TypeBytes)
+			ensure.Nil(t, err)
+			_, err = db.delete(offset, "key1")
+			ensure.Nil(t, err)
+			panic("crash")
+		})
+	}()
+	ensure.Nil(t, cm.unlock())
+	ensure.Nil(t, m.Close())
+
+	m, err = NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	kv, err := m.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, kv, map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")})
+	newGen, err := m.Generation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, newGen, gen)
+
+	// The file is usable after the rollback.
+	ensure.Nil(t, m.Set("key2", []byte("a longer value2")))
+	val, err := m.Get("key2")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("a longer value2"))
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfReuseFreedSpace tests that the space of deleted and moved records is reused.
+func TestDyconfReuseFreedSpace(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfReuseFreedSpace-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+
+	// Fill the free lists with a few moved and deleted records.
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		ensure.Nil(t, m.Set(key, []byte("a long value that is freed")))
+	}
+	ensure.Nil(t, m.Set("key-0", []byte("a longer value that is kept")))
+	for i := 1; i < 4; i++ {
+		ensure.Nil(t, m.Delete(fmt.Sprintf("key-%d", i)))
+	}
+	contiguous, reclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.True(t, reclaimable > 0)
+
+	// Records that fit in the freed space don't take any more of the contiguous free space.
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("new-key-%d", i)
+		ensure.Nil(t, m.Set(key, []byte("new value")))
+	}
+	newContiguous, newReclaimable, err := m.freeDataByteCount()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, newContiguous, contiguous)
+	ensure.True(t, newReclaimable < reclaimable)
+
+	kv, err := m.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(kv), 5)
+	ensure.DeepEqual(t, kv["key-0"], []byte("a longer value that is kept"))
+	for i := 0; i < 4; i++ {
+		ensure.DeepEqual(t, kv[fmt.Sprintf("new-key-%d", i)], []byte("new value"))
+	}
+	ensure.Nil(t, m.Close())
+}
+
+// indexSlots returns the number of index slots and the number of keys recorded in the header.
+func indexSlots(t *testing.T, m ConfigManager) (uint32, uint64) {
+	cm := m.(*configManager)
+	ensure.Nil(t, cm.rlock())
+	defer cm.unlock()
+	h, err := cm.header()
+	ensure.Nil(t, err)
+	return h.indexSlotCount(), h.keyCount
+}
+
+// TestDyconfKeyCount tests that the header keeps count of the keys as they are added, overwritten and
+// deleted.
+func TestDyconfKeyCount(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfKeyCount-")
+	defer os.Remove(tmpFileName)
+
+	// Everything falls into the same slot, so the keys share a list.
+	savedHashfunc := defaultHashFunc
+	defaultHashFunc = func(key string) (uint32, error) {
+		return 3, nil
+	}
+	defer func() {
+		defaultHashFunc = savedHashfunc // restore
+	}()
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithMaxChainLength(0))
+	ensure.Nil(t, err)
+	cases := []struct {
+		set      string
+		del      string
+		expected uint64
+	}{
+		{set: "key-1", expected: 1}, // Case-0: new key in an empty slot.
+		{set: "key-2", expected: 2}, // Case-1: new key in the same list.
+		{set: "key-1", expected: 2}, // Case-2: overwrite the first key in the list.
+		{set: "key-2", expected: 2}, // Case-3: overwrite the second key in the list.
+		{del: "key-3", expected: 2}, // Case-4: delete a key that isn't there.
+		{del: "key-1", expected: 1}, // Case-5: delete a key.
+		{del: "key-1", expected: 1}, // Case-6: delete it again.
+		{del: "key-2", expected: 0}, // Case-7: delete the last key.
+	}
+	for i, tc := range cases {
+		if tc.set != "" {
+			ensure.Nil(t, m.Set(tc.set, []byte("value")), fmt.Sprintf("Case: [%d]", i))
+		} else {
+			ensure.Nil(t, m.Delete(tc.del), fmt.Sprintf("Case: [%d]", i))
+		}
+		_, keyCount := indexSlots(t, m)
+		ensure.DeepEqual(t, keyCount, tc.expected, fmt.Sprintf("Case: [%d]", i))
+	}
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfWriteInitCountsKeys tests that the keys of a file without a key count are counted when it
+// is opened for writing.
+func TestDyconfWriteInitCountsKeys(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfWriteInitCountsKeys-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(4), WithMaxLoadFactor(0), WithMaxChainLength(0))
+	ensure.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		ensure.Nil(t, m.Set(fmt.Sprintf("key-%d", i), []byte("value")))
+	}
+	// Make it look like a file written before the key count was added.
+	cm := m.(*configManager)
+	ensure.Nil(t, cm.wlock())
+	h, err := cm.header()
+	ensure.Nil(t, err)
+	h.keyCount = 0
+	h.compatFeatures &^= featureKeyCount
+	ensure.Nil(t, h.save())
+	ensure.Nil(t, cm.unlock())
+	ensure.Nil(t, m.Close())
+
+	m, err = NewManager(tmpFileName)
+	ensure.Nil(t, err)
+	_, keyCount := indexSlots(t, m)
+	ensure.DeepEqual(t, keyCount, uint64(10))
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfRehashLoadFactor tests that the index grows once there are too many keys per slot, and that
+// an existing reader follows it.
+func TestDyconfRehashLoadFactor(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfRehashLoadFactor-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(4), WithMaxLoadFactor(2))
+	ensure.Nil(t, err)
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	set := func(n int) {
+		for i := len(expected); i < n; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			val := []byte(fmt.Sprintf("value-%d", i))
+			ensure.Nil(t, m.Set(key, val), fmt.Sprintf("key: [%s]", key))
+			expected[key] = val
+		}
+	}
+	// 8 keys in 4 slots is right at the limit.
+	set(8)
+	slots, _ := indexSlots(t, m)
+	ensure.DeepEqual(t, slots, uint32(4))
+	set(9)
+	slots, _ = indexSlots(t, m)
+	ensure.DeepEqual(t, slots, uint32(8))
+	set(40)
+	slots, keyCount := indexSlots(t, m)
+	ensure.DeepEqual(t, slots, uint32(32))
+	ensure.DeepEqual(t, keyCount, uint64(40))
+
+	for key, expectedVal := range expected {
+		val, err := conf.Get(key)
+		ensure.Nil(t, err, fmt.Sprintf("key: [%s]", key))
+		ensure.DeepEqual(t, val, expectedVal, fmt.Sprintf("key: [%s]", key))
+	}
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfRehashChainLength tests that the index grows once a list gets too long, unless the keys
+// just happen to collide in a mostly empty index.
+// TestDyconfRehashFailure tests that a rehash that fails doesn't fail the Set that triggered it, and
+// that it isn't tried again on every Set.
+func TestDyconfRehashFailure(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfRehashFailure-")
+	defer os.Remove(tmpFileName)
+	// The new file can't be created where a directory is in the way.
+	ensure.Nil(t, os.Mkdir(tmpFileName+defragFileSuffix, 0755))
+	ensure.Nil(t, ioutil.WriteFile(filepath.Join(tmpFileName+defragFileSuffix, "file"), nil, 0644))
+	defer os.RemoveAll(tmpFileName + defragFileSuffix)
+
+	var logs bytes.Buffer
+	m, err := NewManager(tmpFileName, WithIndexSlots(1), WithMaxLoadFactor(1), WithLogger(log.New(&logs, "", 0)))
+	ensure.Nil(t, err)
+	defer m.Close()
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		ensure.Nil(t, m.Set(key, []byte("value")), key)
+		val, err := m.Get(key)
+		ensure.Nil(t, err, key)
+		ensure.DeepEqual(t, val, []byte("value"))
+	}
+	slots, _ := indexSlots(t, m)
+	ensure.DeepEqual(t, slots, uint32(1))
+	ensure.DeepEqual(t, strings.Count(logs.String(), "failed to rehash"), 1)
+
+	// The rehash is tried again once the file has twice as many keys.
+	ensure.Nil(t, os.RemoveAll(tmpFileName+defragFileSuffix))
+	ensure.Nil(t, m.Set("key-3", []byte("value")))
+	slots, _ = indexSlots(t, m)
+	ensure.DeepEqual(t, slots, uint32(2))
+}
+
+func TestDyconfRehashChainLength(t *testing.T) {
+	// Everything falls into the same slot.
+	savedHashfunc := defaultHashFunc
+	defaultHashFunc = func(key string) (uint32, error) {
+		return 3, nil
+	}
+	defer func() {
+		defaultHashFunc = savedHashfunc // restore
+	}()
+
+	cases := []struct {
+		opts     []Option
+		keys     int
+		expected uint32
+	}{
+		// Case-0: the list is at the limit.
+		{opts: []Option{WithMaxChainLength(8)}, keys: 8, expected: 16},
+		// Case-1: the list is over the limit.
+		{opts: []Option{WithMaxChainLength(8)}, keys: 9, expected: 32},
+		// Case-2: the index is too empty for the list to matter.
+		{opts: []Option{WithMaxChainLength(8), WithMaxLoadFactor(4)}, keys: 9, expected: 16},
+		// Case-3: disabled.
+		{opts: []Option{WithMaxChainLength(0)}, keys: 12, expected: 16},
+	}
+	for i, tc := range cases {
+		tmpFileName := setupTempFile(t, "TestDyconfRehashChainLength-")
+		m, err := NewManager(tmpFileName, append([]Option{WithIndexSlots(16)}, tc.opts...)...)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		for k := 0; k < tc.keys; k++ {
+			ensure.Nil(t, m.Set(fmt.Sprintf("key-%d", k), []byte("value")), fmt.Sprintf("Case: [%d]", i))
+		}
+		slots, _ := indexSlots(t, m)
+		ensure.DeepEqual(t, slots, tc.expected, fmt.Sprintf("Case: [%d]", i))
+		kv, err := m.Map()
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, len(kv), tc.keys, fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Close(), fmt.Sprintf("Case: [%d]", i))
+		os.Remove(tmpFileName)
+	}
+}
+
+// TestDyconfHash tests that the hash chosen when the file is created is recorded in it and used by
+// readers and later writers, including across a Defrag.
+func TestDyconfHash(t *testing.T) {
+	cases := []HashID{HashFNV1a, HashCRC32C, HashSipHash24}
+	for i, hash := range cases {
+		tmpFileName := setupTempFile(t, "TestDyconfHash-")
+		m, err := NewManager(tmpFileName, WithIndexSlots(64), WithHash(hash))
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		expected := make(map[string][]byte)
+		for k := 0; k < 32; k++ {
+			key := fmt.Sprintf("key-%d", k)
+			expected[key] = []byte(fmt.Sprintf("value-%d", k))
+			ensure.Nil(t, m.Set(key, expected[key]), fmt.Sprintf("Case: [%d]", i))
+		}
+		ensure.Nil(t, m.Close(), fmt.Sprintf("Case: [%d]", i))
+
+		// A writer opening the file without the option uses the hash of the file.
+		m, err = NewManager(tmpFileName)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Defrag(), fmt.Sprintf("Case: [%d]", i))
+		cm := m.(*configManager)
+		ensure.Nil(t, cm.rlock())
+		h, err := cm.header()
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, cm.unlock())
+		ensure.DeepEqual(t, h.hash, hash, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, h.hashKey == [hashKeySize]byte{}, !hash.keyed(), fmt.Sprintf("Case: [%d]", i))
+
+		conf, err := New(tmpFileName)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		for key, expectedVal := range expected {
+			val, err := conf.Get(key)
+			ensure.Nil(t, err, fmt.Sprintf("Case: [%d], key: [%s]", i, key))
+			ensure.DeepEqual(t, val, expectedVal, fmt.Sprintf("Case: [%d], key: [%s]", i, key))
+		}
+		ensure.Nil(t, conf.Close(), fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Close(), fmt.Sprintf("Case: [%d]", i))
+		os.Remove(tmpFileName)
+	}
+}
+
+// TestDyconfWideOffsets tests that a file with wide offsets is used through the same API as any other.
+func TestDyconfWideOffsets(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfWideOffsets-")
+	defer os.Remove(tmpFileName)
+
+	// Few slots make long lists, and a small data block has to grow.
+	m, err := NewManager(
+		tmpFileName,
+		WithWideOffsets(),
+		WithIndexSlots(4),
+		WithDataBlockSize(minDataBlockSize),
+		WithMaxLoadFactor(0),
+		WithMaxChainLength(0),
+	)
+	ensure.Nil(t, err)
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		expected[key] = []byte(fmt.Sprintf("value-%d", i))
+		ensure.Nil(t, m.Set(key, expected[key]), fmt.Sprintf("key: [%s]", key))
+	}
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("key-%d", i)
+		expected[key] = []byte(fmt.Sprintf("a longer value-%d", i))
+		ensure.Nil(t, m.Set(key, expected[key]), fmt.Sprintf("key: [%s]", key))
+	}
+	for i := 0; i < 100; i += 4 {
+		key := fmt.Sprintf("key-%d", i)
+		delete(expected, key)
+		ensure.Nil(t, m.Delete(key), fmt.Sprintf("key: [%s]", key))
+	}
+	ensure.Nil(t, m.Compact(context.Background(), 0))
+
+	check := func() {
+		for key, expectedVal := range expected {
+			val, err := conf.Get(key)
+			ensure.Nil(t, err, fmt.Sprintf("key: [%s]", key))
+			ensure.DeepEqual(t, val, expectedVal, fmt.Sprintf("key: [%s]", key))
+		}
+		kv, err := m.Map()
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, kv, expected)
+	}
+	check()
+	ensure.Nil(t, m.Defrag())
+	check()
+
+	cm := m.(*configManager)
+	ensure.Nil(t, cm.rlock())
+	h, err := cm.header()
+	ensure.Nil(t, err)
+	ensure.Nil(t, cm.unlock())
+	ensure.True(t, h.wide())
+	ensure.DeepEqual(t, h.indexBlockSize, uint32(4*sizeOfUint64))
+	ensure.DeepEqual(t, h.keyCount, uint64(len(expected)))
+
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfBeyond4GB tests that records can be saved beyond the first 4 GB of a file with wide offsets.
+// The file is sparse, so it doesn't take that much space on disk.
+func TestDyconfBeyond4GB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the 5 GB file in short mode")
+	}
+	if ^uint(0)>>32 == 0 {
+		t.Skip("a 5 GB file can't be mapped on a 32-bit platform")
+	}
+	tmpFileName := setupTempFile(t, "TestDyconfBeyond4GB-")
+	defer os.Remove(tmpFileName)
+
+	// Everything falls into the same slot, so the records point to each other.
+	savedHashfunc := defaultHashFunc
+	defaultHashFunc = func(key string) (uint32, error) {
+		return 3, nil
+	}
+	defer func() {
+		defaultHashFunc = savedHashfunc // restore
+	}()
+
+	m, err := NewManager(tmpFileName, WithWideOffsets(), WithIndexSlots(16), WithDataBlockSize(5<<30), WithMaxChainLength(0))
+	ensure.Nil(t, err)
+
+	// Skip the first 4 GB of the data block.
+	cm := m.(*configManager)
+	ensure.Nil(t, cm.wlock())
+	h, err := cm.header()
+	ensure.Nil(t, err)
+	ensure.Nil(t, cm.data(h).updateWriteOffset(4<<30))
+	ensure.Nil(t, cm.unlock())
+
+	for i := 0; i < 3; i++ {
+		ensure.Nil(t, m.Set(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		val, err := conf.Get(fmt.Sprintf("key-%d", i))
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, val, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	ensure.Nil(t, cm.rlock())
+	h, err = cm.header()
+	ensure.Nil(t, err)
+	offset, err := cm.index(h).offset(3)
+	ensure.Nil(t, err)
+	ensure.Nil(t, cm.unlock())
+	ensure.True(t, offset >= 4<<30)
+
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
+
+// TestDyconfConcurrentUse tests a manager and a reader used by several goroutines at once, while the file
+// grows, is rehashed and is defragmented.
+func TestDyconfConcurrentUse(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfConcurrentUse-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(2), WithDataBlockSize(minDataBlockSize), WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer m.Close()
+	conf, err := New(tmpFileName, WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer conf.Close()
+
+	const goroutines, keys = 8, 50
+	errs := make(chan error, goroutines+1)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			errs <- func() error {
+				for i := 0; i < keys; i++ {
+					key, value := fmt.Sprintf("key-%d-%d", g, i), []byte(fmt.Sprintf("value-%d-%d", g, i))
+					if err := m.Set(key, value); err != nil {
+						return err
+					}
+					for _, c := range []Config{m, conf} {
+						got, err := c.Get(key)
+						if err != nil {
+							return err
+						}
+						if !bytes.Equal(got, value) {
+							return fmt.Errorf("key [%s] has the value [%s]. It should be [%s]", key, got, value)
+						}
+						if _, err := c.Generation(); err != nil {
+							return err
+						}
+					}
+					if i%2 == 1 {
+						if err := m.Delete(key); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			}()
+		}(g)
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := m.Defrag(); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < goroutines+1; i++ {
+		ensure.Nil(t, <-errs)
+	}
+
+	kv, err := m.Map()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(kv), goroutines*keys/2)
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < keys; i += 2 {
+			ensure.DeepEqual(t, kv[fmt.Sprintf("key-%d-%d", g, i)], []byte(fmt.Sprintf("value-%d-%d", g, i)))
+		}
+	}
+}
+
+// TestDyconfCloseWaits tests that Close waits for the operations in flight, and that the operations
+// after it fail with ErrClosed.
+func TestDyconfCloseWaits(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfCloseWaits-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	viewing, release, closed := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		conf.GetView("key", func(value []byte) error {
+			close(viewing)
+			<-release
+			return nil
+		})
+	}()
+	<-viewing
+	go func() {
+		closed <- conf.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while GetView was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	ensure.Nil(t, <-closed)
+
+	for _, err := range []error{conf.Close(), func() error { _, err := conf.Get("key"); return err }()} {
+		fileErr, ok := err.(*FileError)
+		ensure.True(t, ok, err)
+		ensure.DeepEqual(t, fileErr.Err, ErrClosed)
+	}
+}
@@ -0,0 +1,117 @@
+package dyconf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors returned by this package wrap one of these, when it applies, so callers can tell the
+// failures apart with errors.Is rather than by their messages.
+var (
+	// ErrNotFound means the key doesn't exist.
+	ErrNotFound = errors.New("dyconf: key not found")
+	// ErrNoSpace means the file can't hold the change, because the data block is full and can't grow or
+	// because the value is bigger than a record can hold.
+	ErrNoSpace = errors.New("dyconf: no space left")
+	// ErrKeyTooLarge means the key is longer than a record can hold.
+	ErrKeyTooLarge = errors.New("dyconf: key too large")
+	// ErrClosed means the config has been closed.
+	ErrClosed = errors.New("dyconf: config closed")
+	// ErrCorrupt means the file holds something that can't be right, like a record that fails its
+	// checksum or an offset out of its block.
+	ErrCorrupt = errors.New("dyconf: config file corrupt")
+	// ErrTypeMismatch means a typed getter was used on a value saved as another type. See TypeError.
+	ErrTypeMismatch = errors.New("dyconf: value type mismatch")
+	// ErrChangesLost means the change feed no longer holds the changes asked for, so the reader has to
+	// read all the keys it is interested in again. See Config.Changes.
+	ErrChangesLost = errors.New("dyconf: changes lost")
+	// ErrFormat means the file is not a config file, or uses a format version or features this package
+	// doesn't support. See FormatError.
+	ErrFormat = errors.New("dyconf: unsupported file format")
+	// ErrLock means the file couldn't be locked or unlocked.
+	ErrLock = errors.New("dyconf: config file lock failed")
+	// ErrMap means the file couldn't be mapped into memory or unmapped.
+	ErrMap = errors.New("dyconf: config file mapping failed")
+)
+
+// KeyError is returned when an operation on a key fails for a reason that has to do with the key or its
+// value. Err is ErrNotFound, ErrKeyTooLarge or ErrNoSpace, or the error of converting the value, like that
+// of a Codec. Key is empty in the error a config returns for every key that doesn't exist. See Config.Get.
+type KeyError struct {
+	Key      string
+	FileName string
+	Reason   string
+	Err      error
+}
+
+// maxErrorKeyLen is the length of the keys beyond which they are cut short in the error messages.
+const maxErrorKeyLen = 64
+
+func (e *KeyError) Error() string {
+	if e.Key == "" {
+		if e.FileName == "" {
+			return fmt.Sprintf("dyconf: the key %s", e.Reason)
+		}
+		return fmt.Sprintf("dyconf: the key %s. File: [%s]", e.Reason, e.FileName)
+	}
+	key := e.Key
+	if len(key) > maxErrorKeyLen {
+		key = key[:maxErrorKeyLen] + "..."
+	}
+	if e.FileName == "" {
+		return fmt.Sprintf("dyconf: key [%s] %s", key, e.Reason)
+	}
+	return fmt.Sprintf("dyconf: key [%s] %s. File: [%s]", key, e.Reason, e.FileName)
+}
+
+// Unwrap returns the sentinel error the error wraps.
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// FileError is returned when the config file can't be used. Err is ErrNoSpace, ErrClosed, ErrCorrupt,
+// ErrChangesLost, ErrLock or ErrMap. The offset is that of the failing field or record within its block, if any.
+type FileError struct {
+	FileName string
+	Offset   uint64
+	Reason   string
+	Err      error
+
+	window string // hex dump of the bytes around the offset, for the logs. See hexWindow.
+}
+
+func (e *FileError) Error() string {
+	if e.FileName == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s. File: [%s]", e.Reason, e.FileName)
+}
+
+// Unwrap returns the sentinel error the error wraps.
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// withFileName sets the file name of the given error, if it is one of the errors of this package that
+// carries one. The blocks don't know the name of the file they are in, so it is set on the way out.
+func withFileName(err error, fileName string) error {
+	switch e := err.(type) {
+	case *KeyError:
+		if e.FileName == "" {
+			e.FileName = fileName
+		}
+	case *FileError:
+		if e.FileName == "" {
+			e.FileName = fileName
+		}
+	case *CorruptionError:
+		if e.FileName == "" {
+			e.FileName = fileName
+		}
+	case *TypeError:
+		if e.FileName == "" {
+			e.FileName = fileName
+		}
+	}
+	return err
+}
@@ -0,0 +1,343 @@
+//go:build go1.13
+// +build go1.13
+
+package dyconf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// TestErrorsIs tests that the errors returned by Config and ConfigManager wrap the sentinel errors.
+func TestErrorsIs(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestErrorsIs-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("some value")))
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+
+	cases := []struct {
+		op       func() error
+		expected error
+	}{
+		{ // Case-0: missing key.
+			op: func() error {
+				_, err := conf.Get("missing")
+				return err
+			},
+			expected: ErrNotFound,
+		},
+		{ // Case-1: missing key in GetView.
+			op: func() error {
+				return m.GetView("missing", func([]byte) error { return nil })
+			},
+			expected: ErrNotFound,
+		},
+		{ // Case-2: key longer than a record can hold.
+			op: func() error {
+				return m.Set(strings.Repeat("k", int(maxKeySize)+1), []byte("value"))
+			},
+			expected: ErrKeyTooLarge,
+		},
+		{ // Case-3: value bigger than a record can hold.
+			op: func() error {
+				return m.Set("key", make([]byte, maxDataSize+1))
+			},
+			expected: ErrNoSpace,
+		},
+	}
+	for i, tc := range cases {
+		err := tc.op()
+		ensure.True(t, errors.Is(err, tc.expected), fmt.Sprintf("Case: [%d]", i), err)
+		var keyErr *KeyError
+		ensure.True(t, errors.As(err, &keyErr), fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, keyErr.FileName, tmpFileName, fmt.Sprintf("Case: [%d]", i))
+	}
+
+	// Reading a value as another type.
+	_, err = conf.GetInt64("key")
+	ensure.True(t, errors.Is(err, ErrTypeMismatch), err)
+	var typeErr *TypeError
+	ensure.True(t, errors.As(err, &typeErr))
+	ensure.DeepEqual(t, typeErr.FileName, tmpFileName)
+
+	// The errors of a closed config.
+	ensure.Nil(t, conf.Close())
+	_, err = conf.Get("key")
+	ensure.True(t, errors.Is(err, ErrClosed), err)
+	_, err = conf.Has("key")
+	ensure.True(t, errors.Is(err, ErrClosed), err)
+	ensure.True(t, errors.Is(conf.Close(), ErrClosed))
+	ensure.Nil(t, m.Close())
+	ensure.True(t, errors.Is(m.Set("key", []byte("value")), ErrClosed))
+}
+
+// TestErrorsCorrupt tests that corruption is reported as ErrCorrupt along with where it was found.
+func TestErrorsCorrupt(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestErrorsCorrupt-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("some value")))
+	ensure.Nil(t, m.Close())
+	content, err := ioutil.ReadFile(tmpFileName)
+	ensure.Nil(t, err)
+
+	// Flip a bit of the value.
+	corrupt := append([]byte(nil), content...)
+	corrupt[bytes.Index(corrupt, []byte("some value"))] ^= 0x01
+	ensure.Nil(t, ioutil.WriteFile(tmpFileName, corrupt, 0644))
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	_, err = conf.Get("key")
+	ensure.True(t, errors.Is(err, ErrCorrupt), err)
+	var corruptionErr *CorruptionError
+	ensure.True(t, errors.As(err, &corruptionErr))
+	ensure.DeepEqual(t, corruptionErr.FileName, tmpFileName)
+	ensure.DeepEqual(t, corruptionErr.Offset, uint64(0x50))
+	ensure.Nil(t, conf.Close())
+
+	// Flip a bit of the data block size in the header.
+	corrupt = append([]byte(nil), content...)
+	corrupt[0x38] ^= 0x01
+	ensure.Nil(t, ioutil.WriteFile(tmpFileName, corrupt, 0644))
+	_, err = New(tmpFileName)
+	ensure.True(t, errors.Is(err, ErrCorrupt), err)
+	var fileErr *FileError
+	ensure.True(t, errors.As(err, &fileErr))
+	ensure.DeepEqual(t, fileErr.FileName, tmpFileName)
+	ensure.DeepEqual(t, fileErr.Offset, uint64(headerChecksumOffset))
+}
+
+// TestErrorsCorruptBlocks tests that the damage found within the blocks is reported as ErrCorrupt.
+func TestErrorsCorruptBlocks(t *testing.T) {
+	cases := []struct {
+		op func() error
+	}{
+		{ // Case-0: Free list directory out of the block.
+			op: func() error {
+				db := &dataBlock{block: make([]byte, 0x100)}
+				ensure.Nil(t, db.reset())
+				db.block[dataFreeListOffset] = 0xF0
+				_, err := db.freeDirectory()
+				return err
+			},
+		},
+		{ // Case-1: Free chunk out of the block.
+			op: func() error {
+				db := &dataBlock{block: make([]byte, 0x100)}
+				ensure.Nil(t, db.reset())
+				_, _, err := db.readChunk(0xFC)
+				return err
+			},
+		},
+		{ // Case-2: Free chunk size out of the block.
+			op: func() error {
+				db := &dataBlock{block: make([]byte, 0x100)}
+				ensure.Nil(t, db.reset())
+				db.block[0x10] = 0xFF
+				_, _, err := db.readChunk(0x10)
+				return err
+			},
+		},
+		{ // Case-3: Journal used size exceeds the journal.
+			op: func() error {
+				j := &journal{block: []byte{0x01, 0x00, 0x00, 0x00, 0xFF, 0x00, 0x00, 0x00}}
+				return j.rollback(blockWriter(make([]byte, 0x20)))
+			},
+		},
+		{ // Case-4: Incomplete journal entry header.
+			op: func() error {
+				j := &journal{block: []byte{0x01, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00}}
+				return j.rollback(blockWriter(make([]byte, 0x20)))
+			},
+		},
+		{ // Case-5: Incomplete journal entry.
+			op: func() error {
+				j := &journal{block: []byte{
+					0x01, 0x00, 0x00, 0x00, 0x0A, 0x00, 0x00, 0x00,
+					0x10, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
+					0xAA, 0xBB,
+				}}
+				return j.rollback(blockWriter(make([]byte, 0x20)))
+			},
+		},
+		{ // Case-6: Record that fails the checks of recordAt only.
+			op: func() error {
+				db := &dataBlock{block: make([]byte, 0x100)}
+				ensure.Nil(t, db.reset())
+				offset, err := db.save("key", []byte("value"), TypeBytes)
+				ensure.Nil(t, err)
+				return db.recordError(offset)
+			},
+		},
+		{ // Case-7: Record to be updated out of the block.
+			op: func() error {
+				db := &dataBlock{block: make([]byte, 0x100)}
+				ensure.Nil(t, db.reset())
+				return db.setNext(0xF0, &dataRecord{key: []byte("key"), data: []byte("value")}, 0)
+			},
+		},
+		{ // Case-8: Index slot out of the block.
+			op: func() error {
+				i := &indexBlock{size: 4, data: make([]byte, 0x08)}
+				return i.setOffset(3, 0x10)
+			},
+		},
+		{ // Case-9: Write offset within the header of the data block.
+			op: func() error {
+				db := &dataBlock{block: make([]byte, 0x100)}
+				ensure.Nil(t, db.reset())
+				db.block[dataWriteOffset] = 0x04
+				_, err := db.freeByteCount()
+				return err
+			},
+		},
+	}
+	for i, tc := range cases {
+		err := tc.op()
+		ensure.True(t, errors.Is(err, ErrCorrupt), fmt.Sprintf("Case: [%d]", i), err)
+	}
+}
+
+// TestErrorsCorruptFileSize tests that a file smaller than the size in its header is reported as
+// ErrCorrupt when it is opened for writing.
+func TestErrorsCorruptFileSize(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestErrorsCorruptFileSize-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Close())
+	stat, err := os.Stat(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.Nil(t, os.Truncate(tmpFileName, stat.Size()-1))
+
+	_, err = NewManager(tmpFileName)
+	ensure.True(t, errors.Is(err, ErrCorrupt), err)
+	var fileErr *FileError
+	ensure.True(t, errors.As(err, &fileErr))
+	ensure.DeepEqual(t, fileErr.FileName, tmpFileName)
+	ensure.DeepEqual(t, fileErr.Offset, uint64(stat.Size()-1))
+}
+
+// TestErrorsCorruptHeaderSizes tests that a header with a valid checksum but block sizes the file can't
+// be used with is reported as ErrCorrupt.
+func TestErrorsCorruptHeaderSizes(t *testing.T) {
+	cases := []struct {
+		damage func(h *headerBlock)
+		offset uint64
+	}{
+		{ // Case-0: No index slots.
+			damage: func(h *headerBlock) { h.indexBlockSize = 0 },
+			offset: 0x28,
+		},
+		{ // Case-1: Empty data block.
+			damage: func(h *headerBlock) { h.dataBlockSize = 0 },
+			offset: 0x38,
+		},
+	}
+
+	for i, tc := range cases {
+		tmpFileName := setupTempFile(t, "TestErrorsCorruptHeaderSizes-")
+		defer os.Remove(tmpFileName)
+		m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		h, err := m.(*configManager).header()
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		tc.damage(h)
+		ensure.Nil(t, h.save(), fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Close(), fmt.Sprintf("Case: [%d]", i))
+
+		for _, open := range []func() error{
+			func() error { _, err := New(tmpFileName); return err },
+			func() error { _, err := NewManager(tmpFileName); return err },
+		} {
+			err := open()
+			ensure.True(t, errors.Is(err, ErrCorrupt), fmt.Sprintf("Case: [%d]", i), err)
+			var fileErr *FileError
+			ensure.True(t, errors.As(err, &fileErr), fmt.Sprintf("Case: [%d]", i))
+			ensure.DeepEqual(t, fileErr.Offset, tc.offset, fmt.Sprintf("Case: [%d]", i))
+		}
+	}
+}
+
+// TestErrorsFormat tests that a file of an unknown format is reported as ErrFormat.
+func TestErrorsFormat(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestErrorsFormat-")
+	defer os.Remove(tmpFileName)
+
+	ensure.Nil(t, ioutil.WriteFile(tmpFileName, bytes.Repeat([]byte("GIF89a"), headerBlockSize), 0644))
+	_, err := New(tmpFileName)
+	ensure.True(t, errors.Is(err, ErrFormat), err)
+	var formatErr *FormatError
+	ensure.True(t, errors.As(err, &formatErr))
+}
+
+// TestErrorsLockMap tests that the failures of locking and mapping the file are reported as ErrLock and
+// ErrMap.
+func TestErrorsLockMap(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestErrorsLockMap-")
+	defer os.Remove(tmpFileName)
+
+	// The file is closed behind the config's back, so the system calls fail.
+	newConfig := func() *config {
+		file, err := os.Create(tmpFileName)
+		ensure.Nil(t, err)
+		ensure.Nil(t, file.Close())
+		c := &config{file: file}
+		c.setFileName(tmpFileName)
+		return c
+	}
+	cases := []struct {
+		op       func(c *config) error
+		expected error
+	}{
+		{ // Case-0: Read lock.
+			op:       func(c *config) error { return c.flock(syscall.LOCK_SH) },
+			expected: ErrLock,
+		},
+		{ // Case-1: Write lock.
+			op:       func(c *config) error { return c.flock(syscall.LOCK_EX) },
+			expected: ErrLock,
+		},
+		{ // Case-2: Unlock.
+			op:       func(c *config) error { return c.funlock() },
+			expected: ErrLock,
+		},
+		{ // Case-3: Map.
+			op:       func(c *config) error { return c.mmap(0x1000, syscall.PROT_READ) },
+			expected: ErrMap,
+		},
+	}
+	for i, tc := range cases {
+		err := tc.op(newConfig())
+		ensure.True(t, errors.Is(err, tc.expected), fmt.Sprintf("Case: [%d]", i), err)
+		var fileErr *FileError
+		ensure.True(t, errors.As(err, &fileErr), fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, fileErr.FileName, tmpFileName, fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestErrorsNoSpace tests that a full data block is reported as ErrNoSpace.
+func TestErrorsNoSpace(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x30)}
+	ensure.Nil(t, db.reset())
+	_, err := db.save("key", make([]byte, 0x30), TypeBytes)
+	ensure.True(t, errors.Is(err, ErrNoSpace), err)
+	var fileErr *FileError
+	ensure.True(t, errors.As(err, &fileErr))
+	ensure.DeepEqual(t, fileErr.Offset, uint64(db.headerSize()))
+}
@@ -0,0 +1,279 @@
+package dyconf
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	defaultChangeFeedSize = 0x4000    // 16 KB
+	minChangeFeedSize     = 0x100     // 256 bytes
+	maxChangeFeedSize     = 0x1000000 // 16 MB
+
+	changeFeedHeaderSize  = 0x18 // 24 bytes
+	changeEntryHeaderSize = 0x0D // 13 bytes
+
+	changeFeedHeadOffset = 0x00 // position of the next entry is saved here.
+	changeFeedTailOffset = 0x08 // position of the oldest entry is saved here.
+	changeFeedBaseOffset = 0x10 // generation the feed starts after is saved here.
+
+	// changeSkip is the type of the entry that fills the end of the ring when the next entry doesn't fit
+	// there.
+	changeSkip = 0xFF
+)
+
+// Change is an entry of the change feed. See Config.Changes.
+type Change struct {
+	Generation uint64 // Generation of the file the change made.
+	Type       EventType
+	Key        string
+}
+
+// changeFeed is a ring of the keys set and deleted by the recent changes of the config file. Readers use
+// it to find out which keys changed since the generation they last saw, without reading all the keys.
+// The oldest entries are dropped to make room for the new ones, so the feed holds every change made after
+// its base generation, and only those.
+//
+// The feed is laid out as below. All the fields are little-endian.
+//
+//	head         8 bytes (position of the next entry)
+//	tail         8 bytes (position of the oldest entry)
+//	base         8 bytes (generation the feed starts after)
+//	ring         (the rest, rounded down to 8 bytes)
+//
+// The positions only grow. An entry is at its position modulo the size of the ring, and it takes a
+// multiple of 8 bytes. Entries don't wrap around the end of the ring. The end is skipped instead, with a
+// skip entry if the header of one fits there. Every entry is laid out as below.
+//
+//	size         4 bytes (size of the entry, before it is rounded up to 8 bytes)
+//	generation   8 bytes
+//	type         1 byte (see EventType, or changeSkip)
+//	key          (size - 13) bytes
+type changeFeed struct {
+	block []byte
+	base  dataOffset // offset of the feed in the file.
+	j     *journal   // journal of the change in progress, if any.
+}
+
+// feedOffset returns the offset of the change feed in the file. It lies right after the journal.
+func (h *headerBlock) feedOffset() dataOffset {
+	return h.journalOffset + dataOffset(h.journalSize)
+}
+
+func (f *changeFeed) ringSize() uint64 {
+	return uint64(len(f.block)-changeFeedHeaderSize) &^ 0x07
+}
+
+func (f *changeFeed) field(offset int) uint64 {
+	return binary.LittleEndian.Uint64(f.block[offset:])
+}
+
+// setFields saves the head, the tail and the base of the feed.
+func (f *changeFeed) setFields(head, tail, base uint64) error {
+	if err := f.j.preserve(f.base, changeFeedHeaderSize); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(f.block[changeFeedHeadOffset:], head)
+	binary.LittleEndian.PutUint64(f.block[changeFeedTailOffset:], tail)
+	binary.LittleEndian.PutUint64(f.block[changeFeedBaseOffset:], base)
+	return nil
+}
+
+// reset drops all the entries. The feed starts after the given generation then.
+func (f *changeFeed) reset(generation uint64) error {
+	head := f.field(changeFeedHeadOffset)
+	return f.setFields(head, head, generation)
+}
+
+// entrySize returns the space taken by an entry of the given size in the ring.
+func entrySize(size uint64) uint64 {
+	return (size + 0x07) &^ 0x07
+}
+
+// entryAt returns the entry at the given position, and the space it takes in the ring. The type of the
+// space skipped at the end of the ring is changeSkip.
+func (f *changeFeed) entryAt(position uint64) (Change, uint64, error) {
+	ring := f.ringSize()
+	offset := position % ring
+	if ring-offset < changeEntryHeaderSize {
+		return Change{Type: changeSkip}, ring - offset, nil
+	}
+	entry := f.block[changeFeedHeaderSize+offset:]
+	size := uint64(binary.LittleEndian.Uint32(entry))
+	if size < changeEntryHeaderSize || entrySize(size) > ring-offset {
+		return Change{}, 0, &FileError{
+			Offset: uint64(f.base) + changeFeedHeaderSize + offset,
+			Reason: fmt.Sprintf("changeFeed: invalid entry size [%#x] at position [%#x]. Ring size: [%#x]", size, position, ring),
+			Err:    ErrCorrupt,
+			window: hexWindow(f.block, int(changeFeedHeaderSize+offset)),
+		}
+	}
+	c := Change{
+		Generation: binary.LittleEndian.Uint64(entry[sizeOfUint32:]),
+		Type:       EventType(entry[sizeOfUint32+sizeOfUint64]),
+	}
+	if c.Type != changeSkip {
+		c.Key = string(entry[changeEntryHeaderSize:size])
+	}
+	return c, entrySize(size), nil
+}
+
+// append adds the change of the given key, made by the given generation. The oldest entries are dropped
+// to make room for it. If it can't be added, because it is too big for the ring or for the journal to
+// save the bytes it overwrites, all the entries are dropped instead, so readers know they missed it.
+func (f *changeFeed) append(generation uint64, t EventType, key string) error {
+	size := uint64(changeEntryHeaderSize + len(key))
+	ring := f.ringSize()
+	// The append overwrites at most the entry, a skip entry before it and the feed header, in as many
+	// journal entries.
+	overwritten := entrySize(size) + changeEntryHeaderSize + changeFeedHeaderSize + 2*(sizeOfUint64+sizeOfUint32)
+	if entrySize(size) > ring/2 || overwritten > uint64(maxDataSize) || !f.j.canPreserve(uint32(overwritten)) {
+		return f.reset(generation)
+	}
+
+	head, tail, base := f.field(changeFeedHeadOffset), f.field(changeFeedTailOffset), f.field(changeFeedBaseOffset)
+	var skip uint64
+	if offset := head % ring; ring-offset < entrySize(size) {
+		skip = ring - offset
+	}
+	// Drop the oldest entries until there is room.
+	for head+skip+entrySize(size)-tail > ring {
+		c, n, err := f.entryAt(tail)
+		if err != nil {
+			return err
+		}
+		if c.Type != changeSkip {
+			base = c.Generation
+		}
+		tail += n
+	}
+
+	if skip >= changeEntryHeaderSize {
+		if err := f.writeEntry(head, skip, Change{Type: changeSkip}); err != nil {
+			return err
+		}
+	}
+	head += skip
+	if err := f.writeEntry(head, size, Change{Generation: generation, Type: t, Key: key}); err != nil {
+		return err
+	}
+	return f.setFields(head+entrySize(size), tail, base)
+}
+
+func (f *changeFeed) writeEntry(position, size uint64, c Change) error {
+	offset := changeFeedHeaderSize + position%f.ringSize()
+	if err := f.j.preserve(f.base+dataOffset(offset), uint32(size)); err != nil {
+		return err
+	}
+	entry := f.block[offset:]
+	binary.LittleEndian.PutUint32(entry, uint32(size))
+	binary.LittleEndian.PutUint64(entry[sizeOfUint32:], c.Generation)
+	entry[sizeOfUint32+sizeOfUint64] = byte(c.Type)
+	copy(entry[changeEntryHeaderSize:], c.Key)
+	return nil
+}
+
+// since returns the changes made after the given generation, oldest first. It returns false if the feed
+// doesn't go back that far.
+func (f *changeFeed) since(generation uint64) ([]Change, bool, error) {
+	if generation < f.field(changeFeedBaseOffset) {
+		return nil, false, nil
+	}
+	var changes []Change
+	head := f.field(changeFeedHeadOffset)
+	for position := f.field(changeFeedTailOffset); position < head; {
+		c, n, err := f.entryAt(position)
+		if err != nil {
+			return nil, false, err
+		}
+		if c.Type != changeSkip && c.Generation > generation {
+			changes = append(changes, c)
+		}
+		position += n
+	}
+	return changes, true, nil
+}
+
+// copyFrom replaces the entries with those of the given feed, which may be nil for a file without a
+// feed. The feed starts after the given generation then.
+func (f *changeFeed) copyFrom(src *changeFeed, generation uint64) error {
+	if src == nil {
+		return f.reset(generation)
+	}
+	if err := f.reset(src.field(changeFeedBaseOffset)); err != nil {
+		return err
+	}
+	changes, _, err := src.since(0)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if err := f.append(c.Generation, c.Type, c.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// feed returns the change feed described by the given header, or nil if the file has none.
+func (c *config) feed(h *headerBlock) *changeFeed {
+	if h.feedSize == 0 {
+		return nil
+	}
+	offset := h.feedOffset()
+	return &changeFeed{
+		block: c.block[offset : offset+dataOffset(h.feedSize)],
+		base:  offset,
+		j:     c.tx,
+	}
+}
+
+// recordChange adds the change of the given key to the change feed, if the file has one. It is called
+// after the header is touched, so that the change is recorded with the generation it makes.
+func (c *configManager) recordChange(h *headerBlock, t EventType, key string) error {
+	f := c.feed(h)
+	if f == nil {
+		return nil
+	}
+	return f.append(h.generation, t, key)
+}
+
+// Changes returns the keys set and deleted after the given generation, oldest first, along with the
+// current generation. The changes come from the change feed of the file (see WithChangeFeedSize), which
+// holds only the recent ones. If it doesn't go back to the given generation, or the file has no feed, it
+// returns an ErrChangesLost error, and the caller has to read all the keys it is interested in again.
+func (c *config) Changes(since uint64) ([]Change, uint64, error) {
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return nil, 0, err
+	}
+	defer c.unlock()
+	return c.changesNoLock(since)
+}
+
+func (c *config) changesNoLock(since uint64) ([]Change, uint64, error) {
+	h, err := c.header()
+	if err != nil {
+		return nil, 0, err
+	}
+	f := c.feed(h)
+	if f == nil {
+		return nil, 0, &FileError{FileName: c.fileName, Reason: "dyconf: the file has no change feed", Err: ErrChangesLost}
+	}
+	changes, ok, err := f.since(since)
+	if err != nil {
+		return nil, 0, c.report(err)
+	}
+	if !ok {
+		return nil, 0, &FileError{
+			FileName: c.fileName,
+			Reason: fmt.Sprintf(
+				"dyconf: the changes after generation [%d] are no longer in the change feed. It starts after generation [%d]",
+				since,
+				f.field(changeFeedBaseOffset),
+			),
+			Err: ErrChangesLost,
+		}
+	}
+	return changes, h.generation, nil
+}
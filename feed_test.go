@@ -0,0 +1,223 @@
+package dyconf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// newTestFeed returns an empty change feed with a ring of the given size.
+func newTestFeed(ringSize int) *changeFeed {
+	return &changeFeed{block: make([]byte, changeFeedHeaderSize+ringSize)}
+}
+
+// TestChangeFeedAppend tests that the oldest entries are dropped to make room for the new ones.
+func TestChangeFeedAppend(t *testing.T) {
+	cases := []struct {
+		ringSize        int
+		keys            []string
+		since           uint64
+		expectedKeys    []string
+		expectedBase    uint64
+		expectedNotHeld bool
+	}{
+		{ // Case-0: Everything fits.
+			ringSize:     0x40,
+			keys:         []string{"a", "b", "c"},
+			expectedKeys: []string{"a", "b", "c"},
+		},
+		{ // Case-1: Only the changes after the given generation are returned.
+			ringSize:     0x40,
+			keys:         []string{"a", "b", "c"},
+			since:        2,
+			expectedKeys: []string{"c"},
+		},
+		{ // Case-2: The oldest entries are dropped, and the feed starts after the last one dropped.
+			ringSize:     0x30,
+			keys:         []string{"a", "b", "c", "d"},
+			since:        1,
+			expectedKeys: []string{"b", "c", "d"},
+			expectedBase: 1,
+		},
+		{ // Case-3: The changes dropped are not returned.
+			ringSize:        0x30,
+			keys:            []string{"a", "b", "c", "d"},
+			since:           0,
+			expectedBase:    1,
+			expectedNotHeld: true,
+		},
+		{ // Case-4: An entry that doesn't fit at the end of the ring is saved at its start.
+			ringSize:     0x48,
+			keys:         []string{"a", "b", "ccccccccccccccccccc", "d"},
+			since:        1,
+			expectedKeys: []string{"b", "ccccccccccccccccccc", "d"},
+			expectedBase: 1,
+		},
+		{ // Case-5: The end of the ring is skipped with an entry if there is room for one.
+			ringSize:     0x48,
+			keys:         []string{"a", "cccccccccccc", "eeeeeeeeeeee", "f", "g"},
+			since:        2,
+			expectedKeys: []string{"eeeeeeeeeeee", "f", "g"},
+			expectedBase: 2,
+		},
+		{ // Case-6: An entry too big for the ring drops all the entries.
+			ringSize:     0x40,
+			keys:         []string{"a", strings.Repeat("b", 0x20), "c"},
+			since:        2,
+			expectedKeys: []string{"c"},
+			expectedBase: 2,
+		},
+	}
+
+	for i, tc := range cases {
+		f := newTestFeed(tc.ringSize)
+		for j, key := range tc.keys {
+			ensure.Nil(t, f.append(uint64(j+1), EventSet, key), fmt.Sprintf("Case: [%d]", i))
+		}
+		ensure.DeepEqual(t, f.field(changeFeedBaseOffset), tc.expectedBase, fmt.Sprintf("Case: [%d]", i))
+		changes, held, err := f.since(tc.since)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, held, !tc.expectedNotHeld, fmt.Sprintf("Case: [%d]", i))
+		var keys []string
+		for _, c := range changes {
+			keys = append(keys, c.Key)
+		}
+		ensure.DeepEqual(t, keys, tc.expectedKeys, fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestChangeFeedCopyFrom tests that a feed copied into a smaller one keeps its newest entries.
+func TestChangeFeedCopyFrom(t *testing.T) {
+	src := newTestFeed(0x100)
+	for j, key := range []string{"a", "b", "c", "d"} {
+		ensure.Nil(t, src.append(uint64(j+11), EventDelete, key))
+	}
+
+	dst := newTestFeed(0x30)
+	ensure.Nil(t, dst.append(1, EventSet, "x"))
+	ensure.Nil(t, dst.copyFrom(src, 15))
+	changes, held, err := dst.since(11)
+	ensure.Nil(t, err)
+	ensure.True(t, held)
+	ensure.DeepEqual(t, changes, []Change{
+		{Generation: 12, Type: EventDelete, Key: "b"},
+		{Generation: 13, Type: EventDelete, Key: "c"},
+		{Generation: 14, Type: EventDelete, Key: "d"},
+	})
+
+	// The copy of a file without a feed starts after the given generation.
+	ensure.Nil(t, dst.copyFrom(nil, 15))
+	changes, held, err = dst.since(15)
+	ensure.Nil(t, err)
+	ensure.True(t, held)
+	ensure.DeepEqual(t, len(changes), 0)
+	_, held, err = dst.since(14)
+	ensure.Nil(t, err)
+	ensure.False(t, held)
+}
+
+func TestChangeFeedCorruption(t *testing.T) {
+	f := newTestFeed(0x40)
+	ensure.Nil(t, f.append(1, EventSet, "a"))
+	f.block[changeFeedHeaderSize] = 0x02 // entry size (2)
+	_, _, err := f.since(0)
+	ensure.Err(t, err, regexp.MustCompile(`^changeFeed: invalid entry size \[0x2\] at position \[0x0\]`))
+	ensure.DeepEqual(t, err.(*FileError).Err, ErrCorrupt)
+}
+
+// TestDyconfChanges tests that Set and Delete record their changes in the feed, through Defrag too.
+func TestDyconfChanges(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfChanges-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithChangeFeedSize(minChangeFeedSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	defer conf.Close()
+
+	since, err := conf.Generation()
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("a", []byte("1")))
+	ensure.Nil(t, m.SetInt64("b", 2))
+	ensure.Nil(t, m.Delete("a"))
+	ensure.Nil(t, m.Delete("missing"))
+	ensure.Nil(t, m.Defrag())
+	changes, generation, err := conf.Changes(since)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, changes, []Change{
+		{Generation: since + 1, Type: EventSet, Key: "a"},
+		{Generation: since + 2, Type: EventSet, Key: "b"},
+		{Generation: since + 3, Type: EventDelete, Key: "a"},
+	})
+	current, err := m.Generation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, generation, current)
+
+	// A failed change is not recorded.
+	ensure.NotNil(t, m.Set(strings.Repeat("k", int(maxKeySize)+1), []byte("v")))
+	changes, _, err = conf.Changes(current)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(changes), 0)
+
+	// The feed only holds the recent changes.
+	for i := 0; i < 32; i++ {
+		ensure.Nil(t, m.Set(fmt.Sprintf("key%d", i), []byte("v")))
+	}
+	_, _, err = conf.Changes(since)
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: the changes after generation \[\d+\] are no longer in the change feed`))
+	ensure.DeepEqual(t, err.(*FileError).Err, ErrChangesLost)
+}
+
+// TestDyconfChangesRollback tests that a change rolled back leaves no entry in the feed.
+func TestDyconfChangesRollback(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfChangesRollback-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithChangeFeedSize(minChangeFeedSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	cm := m.(*configManager)
+	for i := 0; i < 16; i++ {
+		ensure.Nil(t, m.Set(fmt.Sprintf("key%d", i), []byte("v")))
+	}
+	since, err := m.Generation()
+	ensure.Nil(t, err)
+	before, _, err := m.Changes(since - 4)
+	ensure.Nil(t, err)
+
+	ensure.Nil(t, cm.wlock())
+	err = cm.mutate(func(h *headerBlock) error {
+		h.touch()
+		ensure.Nil(t, cm.recordChange(h, EventSet, "rolled back"))
+		return errors.New("failed")
+	})
+	ensure.Nil(t, cm.unlock())
+	ensure.Err(t, err, regexp.MustCompile(`^failed$`))
+	after, _, err := m.Changes(since - 4)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, after, before)
+}
+
+// TestDyconfNoChangeFeed tests that a file without a feed reports the changes as lost.
+func TestDyconfNoChangeFeed(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfNoChangeFeed-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithChangeFeedSize(0))
+	ensure.Nil(t, err)
+	defer m.Close()
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	h, err := m.(*configManager).header()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.compatFeatures&featureChangeFeed, uint32(0))
+	_, _, err = m.Changes(0)
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: the file has no change feed`))
+	ensure.DeepEqual(t, err.(*FileError).Err, ErrChangesLost)
+}
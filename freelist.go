@@ -0,0 +1,367 @@
+package dyconf
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The space left behind by deleted and moved records is kept in free lists, so that it can be reused by
+// new records. Free chunks are grouped into size classes. Class n holds the chunks of size
+// [minFreeChunkSize << n, minFreeChunkSize << (n+1)), except for the last class, which holds all the
+// bigger chunks. The heads of the lists are saved in a directory, which is allocated at the start of the
+// data block when the file is created. Files created before free lists were added get one the first
+// time a record is freed. Its offset is saved in the data block header.
+//
+// Every free chunk starts with its size and the offset of the next chunk in its list.
+//
+//	size 4 bytes
+//	next 4 bytes (8 bytes in files with featureWideOffsets)
+//
+// The sizes below are those in a file with 4 byte offsets. See dataBlock.freeDirectorySize and
+// dataBlock.freeChunkHeaderLen.
+const (
+	freeClassCount     = 16
+	freeDirectorySize  = freeClassCount * sizeOfUint32
+	freeChunkHeaderLen = 2 * sizeOfUint32
+
+	// minFreeChunkSize is the size of the smallest chunk worth keeping. No record is smaller, since a
+	// record takes this many bytes for its fixed size fields alone. The bytes left over when a record is
+	// saved in a slightly bigger chunk are lost until the next Defrag.
+	minFreeChunkSize = 4 * sizeOfUint32
+)
+
+// freeClass returns the size class of a free chunk of the given size.
+func freeClass(size uint32) uint32 {
+	class := uint32(0)
+	for class < freeClassCount-1 && size >= minFreeChunkSize<<(class+1) {
+		class++
+	}
+	return class
+}
+
+// freeDirectorySize returns the size of the free list directory of this block.
+func (db *dataBlock) freeDirectorySize() uint32 {
+	return freeClassCount * offsetSize(db.wide)
+}
+
+// freeChunkHeaderLen returns the size of the header of the free chunks of this block.
+func (db *dataBlock) freeChunkHeaderLen() uint32 {
+	return sizeOfUint32 + offsetSize(db.wide)
+}
+
+// freeDirectory returns the offset of the free list directory. It is 0 if nothing has been freed yet.
+func (db *dataBlock) freeDirectory() (dataOffset, error) {
+	dir := dataOffset(db.headerField(dataFreeListOffset))
+	if dir == 0 {
+		return 0, nil
+	}
+	if dir < db.headerSize() || uint64(dir)+uint64(db.freeDirectorySize()) > uint64(len(db.block)) {
+		return 0, &FileError{
+			Offset: dataFreeListOffset,
+			Reason: fmt.Sprintf("dataBlock: invalid free list directory offset [%#v]. Block size: [%#v]", dir, dataOffset(len(db.block))),
+			Err:    ErrCorrupt,
+		}
+	}
+	return dir, nil
+}
+
+// reclaimable returns the number of bytes in the free lists.
+func (db *dataBlock) reclaimable() uint64 {
+	return db.headerField(dataReclaimableOffset)
+}
+
+func (db *dataBlock) updateReclaimable(size uint64) error {
+	return db.setHeaderField(dataReclaimableOffset, size)
+}
+
+func (db *dataBlock) freeHead(dir dataOffset, class uint32) dataOffset {
+	return getOffset(db.block[dir+dataOffset(class*offsetSize(db.wide)):], db.wide)
+}
+
+func (db *dataBlock) setFreeHead(dir dataOffset, class uint32, head dataOffset) error {
+	offset := dir + dataOffset(class*offsetSize(db.wide))
+	if err := db.preserve(offset, offsetSize(db.wide)); err != nil {
+		return err
+	}
+	putOffset(db.block[offset:], head, db.wide)
+	return nil
+}
+
+// readChunk returns the size of the free chunk at the given offset and the offset of the next chunk in
+// its list.
+func (db *dataBlock) readChunk(offset dataOffset) (uint32, dataOffset, error) {
+	if offset < db.headerSize() || uint64(offset)+uint64(db.freeChunkHeaderLen()) > uint64(len(db.block)) {
+		return 0, 0, &FileError{
+			Offset: uint64(offset),
+			Reason: fmt.Sprintf("dataBlock: invalid free chunk offset [%#v]. Block size: [%#v]", offset, dataOffset(len(db.block))),
+			Err:    ErrCorrupt,
+		}
+	}
+	size := binary.LittleEndian.Uint32(db.block[offset:])
+	next := getOffset(db.block[offset+sizeOfUint32:], db.wide)
+	if size < minFreeChunkSize || uint64(offset)+uint64(size) > uint64(len(db.block)) {
+		return 0, 0, &FileError{
+			Offset: uint64(offset),
+			Reason: fmt.Sprintf("dataBlock: invalid free chunk [%#v +%#v]. Block size: [%#v]", offset, size, dataOffset(len(db.block))),
+			Err:    ErrCorrupt,
+			window: hexWindow(db.block, int(offset)),
+		}
+	}
+	return size, next, nil
+}
+
+func (db *dataBlock) writeChunk(offset dataOffset, size uint32, next dataOffset) error {
+	if err := db.preserve(offset, db.freeChunkHeaderLen()); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(db.block[offset:], size)
+	putOffset(db.block[offset+sizeOfUint32:], next, db.wide)
+	return nil
+}
+
+// free adds the given bytes to the free lists. If there is no free list directory yet, it is allocated
+// first. If there isn't enough free space even for that, the bytes are lost until the next Defrag.
+func (db *dataBlock) free(offset dataOffset, size uint32) error {
+	if size < minFreeChunkSize {
+		return nil
+	}
+	dir, err := db.freeDirectory()
+	if err != nil {
+		return err
+	}
+	if dir == 0 {
+		if dir, err = db.allocateFreeDirectory(); err != nil || dir == 0 {
+			return err
+		}
+	}
+
+	class := freeClass(size)
+	if err := db.writeChunk(offset, size, db.freeHead(dir, class)); err != nil {
+		return err
+	}
+	if err := db.setFreeHead(dir, class, offset); err != nil {
+		return err
+	}
+	return db.updateReclaimable(db.reclaimable() + uint64(size))
+}
+
+// allocateFreeDirectory allocates an empty free list directory at the write offset. It returns 0 if
+// there isn't enough free space for it. A new data block gets its directory before any records, so
+// that the directory doesn't stand in the way of trim later.
+func (db *dataBlock) allocateFreeDirectory() (dataOffset, error) {
+	free, err := db.freeByteCount()
+	if err != nil {
+		return 0, err
+	}
+	size := db.freeDirectorySize()
+	if free < uint64(size) {
+		return 0, nil
+	}
+	dir, err := db.getWriteOffset()
+	if err != nil {
+		return 0, err
+	}
+	copy(db.block[dir:dir+dataOffset(size)], make([]byte, size))
+	if err := db.updateWriteOffset(dir + dataOffset(size)); err != nil {
+		return 0, err
+	}
+	if err := db.setHeaderField(dataFreeListOffset, uint64(dir)); err != nil {
+		return 0, err
+	}
+	return dir, nil
+}
+
+// findChunk finds a free chunk for which the given function returns true. It returns the offset of the
+// chunk, the offset of the chunk before it in its list (0 if it is the head), its size and class. Only
+// the classes starting with the given one are searched. The offset is 0 if there is no such chunk.
+func (db *dataBlock) findChunk(
+	class uint32,
+	match func(offset dataOffset, size uint32) bool,
+) (offset, prevOffset dataOffset, chunkSize, chunkClass uint32, err error) {
+	dir, err := db.freeDirectory()
+	if err != nil || dir == 0 {
+		return 0, 0, 0, 0, err
+	}
+	for ; class < freeClassCount; class++ {
+		prevOffset = 0
+		for offset = db.freeHead(dir, class); offset != 0; {
+			chunkSize, next, err := db.readChunk(offset)
+			if err != nil {
+				return 0, 0, 0, 0, err
+			}
+			if match(offset, chunkSize) {
+				return offset, prevOffset, chunkSize, class, nil
+			}
+			prevOffset, offset = offset, next
+		}
+	}
+	return 0, 0, 0, 0, nil
+}
+
+// findFit finds a free chunk of at least the given size that starts before the given offset.
+func (db *dataBlock) findFit(size uint32, below dataOffset) (offset, prevOffset dataOffset, chunkSize, class uint32, err error) {
+	// Chunks in the class of the size may be smaller than the size. Chunks in the bigger classes are
+	// always big enough.
+	return db.findChunk(freeClass(size), func(offset dataOffset, chunkSize uint32) bool {
+		return chunkSize >= size && offset < below
+	})
+}
+
+// findLowestFit is like findFit, but it finds the chunk with the lowest offset instead of the first one.
+func (db *dataBlock) findLowestFit(size uint32, below dataOffset) (offset, prevOffset dataOffset, chunkSize, class uint32, err error) {
+	var lowest dataOffset
+	_, _, _, _, err = db.findChunk(freeClass(size), func(offset dataOffset, chunkSize uint32) bool {
+		if chunkSize >= size && offset < below && (lowest == 0 || offset < lowest) {
+			lowest = offset
+		}
+		return false
+	})
+	if err != nil || lowest == 0 {
+		return 0, 0, 0, 0, err
+	}
+	return db.findChunk(freeClass(size), func(offset dataOffset, chunkSize uint32) bool {
+		return offset == lowest
+	})
+}
+
+// canAllocate returns true if a free chunk of at least the given size is available.
+func (db *dataBlock) canAllocate(size uint32) (bool, error) {
+	offset, _, _, _, err := db.findFit(size, dataOffset(len(db.block)))
+	return offset != 0, err
+}
+
+// allocate takes a free chunk of at least the given size out of the free lists and returns its
+// offset. The unused end of the chunk is put back, if it is big enough to be reused. It returns 0 if
+// there is no such chunk.
+func (db *dataBlock) allocate(size uint32) (dataOffset, error) {
+	offset, prevOffset, chunkSize, class, err := db.findFit(size, dataOffset(len(db.block)))
+	if err != nil || offset == 0 {
+		return 0, err
+	}
+	return db.take(offset, prevOffset, chunkSize, class, size)
+}
+
+// allocateBelow is like allocate, but it takes the lowest chunk that starts before the given offset. It
+// is used to move records towards the start of the data block.
+func (db *dataBlock) allocateBelow(size uint32, below dataOffset) (dataOffset, error) {
+	offset, prevOffset, chunkSize, class, err := db.findLowestFit(size, below)
+	if err != nil || offset == 0 {
+		return 0, err
+	}
+	return db.take(offset, prevOffset, chunkSize, class, size)
+}
+
+// take takes the given chunk out of its free list for a record of the given size.
+func (db *dataBlock) take(offset, prevOffset dataOffset, chunkSize, class, size uint32) (dataOffset, error) {
+	if err := db.unlink(offset, prevOffset, chunkSize, class); err != nil {
+		return 0, err
+	}
+	if rest := chunkSize - size; rest >= minFreeChunkSize {
+		if err := db.free(offset+dataOffset(size), rest); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// unlink takes the given chunk out of its free list. The header of the chunk is saved in the journal,
+// since the caller is about to overwrite it. Undoing the change has to restore it, along with the list.
+func (db *dataBlock) unlink(offset, prevOffset dataOffset, size, class uint32) error {
+	_, next, err := db.readChunk(offset)
+	if err != nil {
+		return err
+	}
+	if err := db.preserve(offset, db.freeChunkHeaderLen()); err != nil {
+		return err
+	}
+	if prevOffset == 0 {
+		dir, err := db.freeDirectory()
+		if err != nil {
+			return err
+		}
+		if err := db.setFreeHead(dir, class, next); err != nil {
+			return err
+		}
+	} else {
+		prevSize, _, err := db.readChunk(prevOffset)
+		if err != nil {
+			return err
+		}
+		if err := db.writeChunk(prevOffset, prevSize, next); err != nil {
+			return err
+		}
+	}
+	return db.updateReclaimable(db.reclaimable() - uint64(size))
+}
+
+// trim gives the free chunks at the end of the used part of the data block back to the contiguous free
+// space, by moving the write offset back over them. The free list directory is moved into a free chunk
+// before it first, so that it doesn't stand in the way.
+func (db *dataBlock) trim() error {
+	if err := db.moveFreeDirectory(); err != nil {
+		return err
+	}
+	for {
+		writeOffset, err := db.getWriteOffset()
+		if err != nil {
+			return err
+		}
+		offset, prevOffset, size, class, err := db.findChunk(0, func(offset dataOffset, size uint32) bool {
+			return offset+dataOffset(size) == writeOffset
+		})
+		if err != nil || offset == 0 {
+			return err
+		}
+		if err := db.unlink(offset, prevOffset, size, class); err != nil {
+			return err
+		}
+		if err := db.updateWriteOffset(offset); err != nil {
+			return err
+		}
+	}
+}
+
+// moveFreeDirectory moves the free list directory into a free chunk before it, if there is one.
+func (db *dataBlock) moveFreeDirectory() error {
+	dir, err := db.freeDirectory()
+	if err != nil || dir == 0 {
+		return err
+	}
+	size := db.freeDirectorySize()
+	newDir, err := db.allocateBelow(size, dir)
+	if err != nil || newDir == 0 {
+		return err
+	}
+	// Allocating changes the directory, so it is copied only afterwards.
+	copy(db.block[newDir:newDir+dataOffset(size)], db.block[dir:dir+dataOffset(size)])
+	if err := db.setHeaderField(dataFreeListOffset, uint64(newDir)); err != nil {
+		return err
+	}
+	return db.free(dir, size)
+}
+
+// fragmentation returns the share of the used part of the data block that is not taken by live
+// records. The used part starts after the data block header and ends at the write offset. The free list
+// directory is not counted.
+func (db *dataBlock) fragmentation() (float64, error) {
+	writeOffset, err := db.getWriteOffset()
+	if err != nil {
+		return 0, err
+	}
+	used, err := db.size()
+	if err != nil {
+		return 0, err
+	}
+	dir, err := db.freeDirectory()
+	if err != nil {
+		return 0, err
+	}
+	span := uint64(writeOffset - db.headerSize())
+	if dir != 0 {
+		span -= uint64(db.freeDirectorySize())
+	}
+	if span == 0 || used >= span {
+		return 0, nil
+	}
+	return float64(span-used) / float64(span), nil
+}
@@ -0,0 +1,187 @@
+package dyconf
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestFreeClass(t *testing.T) {
+	cases := []struct {
+		size     uint32
+		expected uint32
+	}{
+		{size: 0x10, expected: 0},         // Case-0
+		{size: 0x1F, expected: 0},         // Case-1
+		{size: 0x20, expected: 1},         // Case-2
+		{size: 0x3F, expected: 1},         // Case-3
+		{size: 0x40, expected: 2},         // Case-4
+		{size: 0x10 << 15, expected: 15},  // Case-5
+		{size: maxDataSize, expected: 15}, // Case-6: Bigger chunks are all in the last class.
+	}
+
+	for i, tc := range cases {
+		ensure.DeepEqual(t, freeClass(tc.size), tc.expected, fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestDataBlockFreeAllocate tests that freed chunks are handed out again.
+func TestDataBlockFreeAllocate(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x200)}
+	ensure.Nil(t, db.reset())
+	ensure.Nil(t, db.updateWriteOffset(0x100)) // Pretend the records take up to 0x100.
+
+	// Nothing to allocate yet.
+	offset, err := db.allocate(0x10)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, offset, dataOffset(0))
+
+	ensure.Nil(t, db.free(0x10, 0x20))
+	ensure.Nil(t, db.free(0x30, 0x40))
+	ensure.DeepEqual(t, db.reclaimable(), uint64(0x60))
+	// The directory is allocated at the write offset.
+	dir, err := db.freeDirectory()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, dir, dataOffset(0x100))
+	writeOffset, err := db.getWriteOffset()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, writeOffset, dataOffset(0x100+freeDirectorySize))
+
+	cases := []struct {
+		size                uint32
+		expectedOffset      dataOffset
+		expectedReclaimable uint64
+	}{
+		{ // Case-0: Fits in the chunk of its own class. The 8 bytes left over are too few to keep.
+			size:                0x18,
+			expectedOffset:      0x10,
+			expectedReclaimable: 0x40,
+		},
+		{ // Case-1: Taken from a bigger chunk. The rest of it is put back.
+			size:                0x20,
+			expectedOffset:      0x30,
+			expectedReclaimable: 0x20,
+		},
+		{ // Case-2: The rest of the bigger chunk.
+			size:                0x11,
+			expectedOffset:      0x50,
+			expectedReclaimable: 0x00,
+		},
+		{ // Case-3: Nothing left.
+			size:                0x10,
+			expectedOffset:      0x00,
+			expectedReclaimable: 0x00,
+		},
+	}
+
+	for i, tc := range cases {
+		ok, err := db.canAllocate(tc.size)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, ok, tc.expectedOffset != 0, fmt.Sprintf("Case: [%d]", i))
+		offset, err := db.allocate(tc.size)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, offset, tc.expectedOffset, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, db.reclaimable(), tc.expectedReclaimable, fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestDataBlockFreeNoRoom tests that the freed bytes are lost if there is no room for the directory.
+func TestDataBlockFreeNoRoom(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x100)}
+	ensure.Nil(t, db.reset())
+	ensure.Nil(t, db.updateWriteOffset(0xF0))
+
+	ensure.Nil(t, db.free(0x10, 0x20))
+	ensure.DeepEqual(t, db.reclaimable(), uint64(0))
+	dir, err := db.freeDirectory()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, dir, dataOffset(0))
+}
+
+// TestDataBlockFreeListErrors tests that damaged free lists are detected.
+func TestDataBlockFreeListErrors(t *testing.T) {
+	cases := []struct {
+		damage         func(db *dataBlock)
+		expectedErrStr string
+	}{
+		{ // Case-0: Directory out of the block.
+			damage:         func(db *dataBlock) { db.block[dataFreeListOffset] = 0xF0 },
+			expectedErrStr: `^dataBlock: invalid free list directory offset \[0xf0\]. Block size: \[0x100\]`,
+		},
+		{ // Case-1: Chunk size out of the block.
+			damage:         func(db *dataBlock) { db.block[0x10] = 0xFF },
+			expectedErrStr: `^dataBlock: invalid free chunk \[0x10 \+0xff\]. Block size: \[0x100\]`,
+		},
+		{ // Case-2: Next chunk out of the block.
+			damage:         func(db *dataBlock) { db.block[0x14] = 0xFC },
+			expectedErrStr: `^dataBlock: invalid free chunk offset \[0xfc\]. Block size: \[0x100\]`,
+		},
+	}
+
+	for i, tc := range cases {
+		db := &dataBlock{block: make([]byte, 0x100)}
+		ensure.Nil(t, db.reset())
+		ensure.Nil(t, db.updateWriteOffset(0x80))
+		ensure.Nil(t, db.free(0x10, 0x20))
+		tc.damage(db)
+		_, err := db.allocate(0x30)
+		ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestDataBlockTrim tests that the free chunks at the end of the used part are given back.
+func TestDataBlockTrim(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x200)}
+	ensure.Nil(t, db.reset())
+	ensure.Nil(t, db.updateWriteOffset(0x50)) // Directory goes to 0x50 - 0x90.
+	ensure.Nil(t, db.free(0x10, 0x20))
+	ensure.Nil(t, db.updateWriteOffset(0xF0)) // Pretend records take 0x90 - 0xF0.
+	ensure.Nil(t, db.free(0xC0, 0x30))
+	ensure.Nil(t, db.free(0xA0, 0x20))
+	ensure.DeepEqual(t, db.reclaimable(), uint64(0x70))
+
+	ensure.Nil(t, db.trim())
+	writeOffset, err := db.getWriteOffset()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, writeOffset, dataOffset(0xA0))
+	ensure.DeepEqual(t, db.reclaimable(), uint64(0x20))
+}
+
+func TestDataBlockFragmentation(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x200)}
+	ensure.Nil(t, db.reset())
+
+	// Case-0: Empty block.
+	fragmentation, err := db.fragmentation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, fragmentation, float64(0))
+
+	// Case-1: A quarter of the used part is live. The directory doesn't count.
+	ensure.Nil(t, db.updateWriteOffset(0x90))
+	ensure.Nil(t, db.updateSize(0x20))
+	ensure.Nil(t, db.free(0x10, 0x20))
+	fragmentation, err = db.fragmentation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, fragmentation, 0.75)
+}
+
+// TestDataBlockTrimMovesDirectory tests that a directory at the end of the used part is moved out of the
+// way of trim.
+func TestDataBlockTrimMovesDirectory(t *testing.T) {
+	db := &dataBlock{block: make([]byte, 0x200)}
+	ensure.Nil(t, db.reset())
+	ensure.Nil(t, db.updateWriteOffset(0x100)) // Pretend records take up to 0x100.
+	ensure.Nil(t, db.free(0x10, 0x40))         // Directory goes to 0x100 - 0x140.
+	ensure.Nil(t, db.free(0xC0, 0x40))
+
+	ensure.Nil(t, db.trim())
+	dir, err := db.freeDirectory()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, dir, dataOffset(0x10))
+	writeOffset, err := db.getWriteOffset()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, writeOffset, dataOffset(0xC0))
+	ensure.DeepEqual(t, db.reclaimable(), uint64(0))
+}
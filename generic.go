@@ -0,0 +1,139 @@
+//go:build go1.18
+// +build go1.18
+
+package dyconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// Codec converts the values of a type to and from the bytes saved in a config. Get and Set use the codec
+// registered for the type with RegisterCodec, if any.
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// codecs holds the registered codecs by the type they convert.
+var codecs = struct {
+	sync.RWMutex
+	m map[reflect.Type]interface{}
+}{m: make(map[reflect.Type]interface{})}
+
+// RegisterCodec makes Get and Set use the given codec for the values of type T. It replaces the codec
+// registered for T before, if any.
+func RegisterCodec[T any](c Codec[T]) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[typeOf[T]()] = c
+}
+
+func codecFor[T any]() (Codec[T], bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[typeOf[T]()]
+	if !ok {
+		return nil, false
+	}
+	return c.(Codec[T]), true
+}
+
+// typeOf returns the type T, even if it is an interface type.
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// JSONCodec returns a codec that saves the values of type T as JSON.
+func JSONCodec[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// Get returns the value of the given key as a T. The value is decoded by the codec registered for T. If
+// there is none, T must be one of the types Unmarshal can bind a field of, and the value is read like
+// Unmarshal reads such a field: a slice from the keys key.0, key.1 and so on.
+func Get[T any](cfg Config, key string) (T, error) {
+	var value T
+	if c, ok := codecFor[T](); ok {
+		data, err := cfg.Get(key)
+		if err != nil {
+			return value, err
+		}
+		value, err = c.Decode(data)
+		if err != nil {
+			return value, &KeyError{
+				Key:    key,
+				Reason: fmt.Sprintf("cannot be decoded as [%s]. error: [%s]", typeOf[T](), err.Error()),
+				Err:    err,
+			}
+		}
+		return value, nil
+	}
+
+	v := reflect.ValueOf(&value).Elem()
+	var err error
+	if isSlice(v.Type()) {
+		err = unmarshalSlice(cfg, boundField{value: v, path: key, key: key, tag: bindTag{required: true}})
+	} else {
+		err = getValue(cfg, key, v)
+	}
+	if _, ok := err.(*unsupportedTypeError); ok {
+		return value, stackerr.Newf("dyconf: no codec is registered for the type [%s]", v.Type())
+	}
+	return value, err
+}
+
+// MustGet is like Get but panics if the value can't be read. It is meant for keys that must exist, like
+// those read once at startup.
+func MustGet[T any](cfg Config, key string) T {
+	value, err := Get[T](cfg, key)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Set sets the given key to the given value. The value is encoded by the codec registered for T. If there
+// is none, T must be one of the types Marshal can bind a field of, and the value is set like Marshal sets
+// such a field.
+func Set[T any](mgr ConfigManager, key string, value T) error {
+	if c, ok := codecFor[T](); ok {
+		data, err := c.Encode(value)
+		if err != nil {
+			return &KeyError{
+				Key:    key,
+				Reason: fmt.Sprintf("cannot be encoded as [%s]. error: [%s]", typeOf[T](), err.Error()),
+				Err:    err,
+			}
+		}
+		return mgr.Set(key, data)
+	}
+
+	v := reflect.ValueOf(&value).Elem()
+	var err error
+	if isSlice(v.Type()) {
+		err = marshalSlice(mgr, boundField{value: v, path: key, key: key})
+	} else {
+		err = setValue(mgr, key, v)
+	}
+	if _, ok := err.(*unsupportedTypeError); ok {
+		return stackerr.Newf("dyconf: no codec is registered for the type [%s]", v.Type())
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+//go:build go1.18
+// +build go1.18
+
+package dyconf
+
+import (
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+type genericPoint struct {
+	X, Y int
+}
+
+// TestGenericGetSet tests that Get reads the values of the types it supports as Set wrote them.
+func TestGenericGetSet(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestGenericGetSet-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	RegisterCodec(JSONCodec[genericPoint]())
+
+	ensure.Nil(t, Set(m, "int", 42))
+	ensure.Nil(t, Set(m, "duration", 3*time.Second))
+	ensure.Nil(t, Set(m, "strings", []string{"a", "b"}))
+	ensure.Nil(t, Set(m, "point", genericPoint{X: 1, Y: 2}))
+	ensure.Nil(t, m.Set("text", []byte("17")))
+
+	i, err := Get[int](m, "int")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, i, 42)
+	i, err = Get[int](m, "text")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, i, 17)
+	ensure.DeepEqual(t, MustGet[time.Duration](m, "duration"), 3*time.Second)
+	ensure.DeepEqual(t, MustGet[[]string](m, "strings"), []string{"a", "b"})
+	ensure.DeepEqual(t, MustGet[genericPoint](m, "point"), genericPoint{X: 1, Y: 2})
+	data, err := m.Get("point")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(data), `{"X":1,"Y":2}`)
+
+	// Set with a shorter slice drops the elements of the longer one.
+	ensure.Nil(t, Set(m, "strings", []string{"c"}))
+	ensure.DeepEqual(t, MustGet[[]string](m, "strings"), []string{"c"})
+}
+
+// TestGenericErrors tests the errors of Get and MustGet.
+func TestGenericErrors(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestGenericErrors-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	RegisterCodec(JSONCodec[genericPoint]())
+	ensure.Nil(t, m.Set("point", []byte("not json")))
+	ensure.Nil(t, Set(m, "int", 42))
+
+	_, err = Get[int](m, "missing")
+	ensure.True(t, isNotFound(err), err)
+	_, err = Get[[]string](m, "missing")
+	ensure.True(t, isNotFound(err), err)
+	_, err = Get[genericPoint](m, "point")
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: key \[point\] cannot be decoded as \[dyconf.genericPoint\]. error: \[invalid character`))
+	_, err = Get[string](m, "int")
+	_, ok := err.(*TypeError)
+	ensure.True(t, ok, err)
+	_, err = Get[map[string]int](m, "int")
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: no codec is registered for the type \[map\[string\]int\]`))
+	err = Set(m, "map", map[string]int{})
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: no codec is registered for the type \[map\[string\]int\]`))
+
+	defer func() {
+		ensure.True(t, isNotFound(recover().(error)))
+	}()
+	MustGet[int](m, "missing")
+}
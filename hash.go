@@ -0,0 +1,182 @@
+package dyconf
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// HashID identifies the hash function that maps the keys to the index slots. It is recorded in the
+// header of the file, so the file is always read with the hash it was written with.
+type HashID uint32
+
+const (
+	// HashFNV1a is the 32-bit FNV-1a hash. It is fast, but anyone who knows the keys can make them all
+	// fall into the same slot. It is the default, and the only hash of the files created before the hash
+	// was recorded in the header.
+	HashFNV1a HashID = 0
+	// HashCRC32C is the CRC-32C checksum of the key.
+	HashCRC32C HashID = 1
+	// HashSipHash24 is SipHash-2-4 keyed with a random key generated when the file is created. Use it
+	// when the keys come from an untrusted source, since they can't be chosen to collide without knowing
+	// the key.
+	HashSipHash24 HashID = 2
+
+	// HashUserMin is the first of the ids of the hashes registered with RegisterHash. The ids below it are
+	// reserved for the hashes of this package.
+	HashUserMin HashID = 1 << 16
+)
+
+// userHashes holds the hashes registered with RegisterHash.
+var userHashes = struct {
+	sync.RWMutex
+	m map[HashID]func(key string) uint32
+}{m: make(map[HashID]func(key string) uint32)}
+
+// RegisterHash makes the given hash function usable with WithHash under the given id, which must be at
+// least HashUserMin. The id is recorded in the files created with it, so every process that opens them
+// must register the same function under the same id first. New and NewManager fail on a file whose hash
+// is not registered. A registered id can't be registered again.
+func RegisterHash(id HashID, fn func(key string) uint32) error {
+	if id < HashUserMin {
+		return stackerr.Newf("dyconf: cannot register the hash [%d]. The ids below [%d] are reserved", id, HashUserMin)
+	}
+	if fn == nil {
+		return stackerr.Newf("dyconf: cannot register a nil function as the hash [%d]", id)
+	}
+	userHashes.Lock()
+	defer userHashes.Unlock()
+	if _, found := userHashes.m[id]; found {
+		return stackerr.Newf("dyconf: the hash [%d] is registered already", id)
+	}
+	userHashes.m[id] = fn
+	return nil
+}
+
+// userHash returns the registered hash function of the given id, or nil if there is none.
+func userHash(id HashID) func(key string) uint32 {
+	userHashes.RLock()
+	defer userHashes.RUnlock()
+	return userHashes.m[id]
+}
+
+// hashKeySize is the size of the key of a keyed hash.
+const hashKeySize = 16
+
+func (id HashID) known() bool {
+	return id == HashFNV1a || id == HashCRC32C || id == HashSipHash24 || userHash(id) != nil
+}
+
+// keyed returns true if the hash needs a key.
+func (id HashID) keyed() bool {
+	return id == HashSipHash24
+}
+
+type hashFunc func(key string) (uint32, error)
+
+// defaultHashFunc is the hash function of the files using HashFNV1a.
+var defaultHashFunc = hashFuncFNV1a
+
+// The hash functions are computed over the key string in place. Converting the key to a []byte for the
+// hash and crc32 packages would allocate on every lookup.
+
+var hashFuncFNV1a = func(key string) (uint32, error) {
+	// 32-bit FNV-1a, as computed by hash/fnv.
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h, nil
+}
+
+var hashFuncCRC32C = func(key string) (uint32, error) {
+	crc := ^uint32(0)
+	for i := 0; i < len(key); i++ {
+		crc = crcTable[byte(crc)^key[i]] ^ crc>>8
+	}
+	return ^crc, nil
+}
+
+// newHashFunc returns the hash function identified by the given id. The key is used only by keyed
+// hashes. It returns nil if the id is unknown.
+func newHashFunc(id HashID, key [hashKeySize]byte) hashFunc {
+	switch id {
+	case HashFNV1a:
+		return defaultHashFunc
+	case HashCRC32C:
+		return hashFuncCRC32C
+	case HashSipHash24:
+		k0 := binary.LittleEndian.Uint64(key[0:])
+		k1 := binary.LittleEndian.Uint64(key[8:])
+		return func(key string) (uint32, error) {
+			h := sipHash24(k0, k1, key)
+			return uint32(h) ^ uint32(h>>32), nil
+		}
+	}
+	if fn := userHash(id); fn != nil {
+		return func(key string) (uint32, error) {
+			return fn(key), nil
+		}
+	}
+	return nil
+}
+
+// sipHash24 returns the SipHash-2-4 of the given message with the key (k0, k1).
+func sipHash24(k0, k1 uint64, msg string) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = rotl(v1, 13)
+		v1 ^= v0
+		v0 = rotl(v0, 32)
+		v2 += v3
+		v3 = rotl(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = rotl(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = rotl(v1, 17)
+		v1 ^= v2
+		v2 = rotl(v2, 32)
+	}
+
+	// Compress all the complete 8 byte words.
+	n := len(msg)
+	for len(msg) >= 8 {
+		m := uint64(msg[0]) | uint64(msg[1])<<8 | uint64(msg[2])<<16 | uint64(msg[3])<<24 |
+			uint64(msg[4])<<32 | uint64(msg[5])<<40 | uint64(msg[6])<<48 | uint64(msg[7])<<56
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		msg = msg[8:]
+	}
+
+	// The last word holds the remaining bytes and the length of the message in its top byte.
+	last := uint64(n) << 56
+	for i := len(msg) - 1; i >= 0; i-- {
+		last |= uint64(msg[i]) << (8 * uint(i))
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func rotl(x uint64, b uint) uint64 {
+	return x<<b | x>>(64-b)
+}
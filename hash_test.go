@@ -0,0 +1,134 @@
+package dyconf
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// TestSipHash24 tests SipHash-2-4 against the test vectors of the reference implementation. The key is
+// 00 01 02 ... 0f and the message is the first n bytes of 00 01 02 ...
+func TestSipHash24(t *testing.T) {
+	cases := []struct {
+		msgLen   int
+		expected uint64
+	}{
+		{msgLen: 0, expected: 0x726fdb47dd0e0e31},  // Case-0: empty message.
+		{msgLen: 1, expected: 0x74f839c593dc67fd},  // Case-1: only the last word.
+		{msgLen: 8, expected: 0x93f5f5799a932462},  // Case-2: a complete word.
+		{msgLen: 15, expected: 0xa129ca6149be45e5}, // Case-3: a complete word and 7 bytes.
+	}
+	msg := make([]byte, 64)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for i, tc := range cases {
+		h := sipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, string(msg[:tc.msgLen]))
+		ensure.DeepEqual(t, h, tc.expected, fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestNewHashFunc tests that every hash id maps to its hash function.
+func TestNewHashFunc(t *testing.T) {
+	var key [hashKeySize]byte
+	h, err := newHashFunc(HashFNV1a, key)("key")
+	ensure.Nil(t, err)
+	expected, err := hashFuncFNV1a("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h, expected)
+
+	h, err = newHashFunc(HashCRC32C, key)("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h, crc32.Checksum([]byte("key"), crc32.MakeTable(crc32.Castagnoli)))
+
+	// The keyed hash depends on the key.
+	h, err = newHashFunc(HashSipHash24, key)("key")
+	ensure.Nil(t, err)
+	key[0] = 0x01
+	h2, err := newHashFunc(HashSipHash24, key)("key")
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, h, h2)
+
+	ensure.True(t, newHashFunc(HashID(9), key) == nil)
+}
+
+// TestHashFuncs tests the hash functions against the hash and crc32 packages, and that they allocate
+// nothing.
+func TestHashFuncs(t *testing.T) {
+	keys := []string{
+		"",                       // Case-0: empty key.
+		"key",                    // Case-1: short key.
+		strings.Repeat("k", 100), // Case-2: long key.
+	}
+	for i, key := range keys {
+		fnvHash := fnv.New32a()
+		fnvHash.Write([]byte(key))
+		h, err := hashFuncFNV1a(key)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, h, fnvHash.Sum32(), fmt.Sprintf("Case: [%d]", i))
+
+		h, err = hashFuncCRC32C(key)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, h, crc32.Checksum([]byte(key), crc32.MakeTable(crc32.Castagnoli)), fmt.Sprintf("Case: [%d]", i))
+
+		sipHash := newHashFunc(HashSipHash24, [hashKeySize]byte{})
+		allocs := testing.AllocsPerRun(10, func() {
+			hashFuncFNV1a(key)
+			hashFuncCRC32C(key)
+			sipHash(key)
+		})
+		ensure.DeepEqual(t, allocs, float64(0), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestRegisterHash tests that a registered hash is used by the files created with it, and that the files
+// can't be opened once it is not registered.
+func TestRegisterHash(t *testing.T) {
+	id := HashUserMin + 1
+	calls := 0
+	fn := func(key string) uint32 {
+		calls++
+		return uint32(len(key))
+	}
+	ensure.Err(t, RegisterHash(HashCRC32C, fn), regexp.MustCompile(`^dyconf: cannot register the hash \[1\]. The ids below \[65536\] are reserved`))
+	ensure.Err(t, RegisterHash(id, nil), regexp.MustCompile(`^dyconf: cannot register a nil function as the hash \[65537\]`))
+	_, err := newOptions([]Option{WithHash(id)})
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: the hash \[65537\] is not registered. See RegisterHash`))
+
+	ensure.Nil(t, RegisterHash(id, fn))
+	defer func() {
+		userHashes.Lock()
+		delete(userHashes.m, id)
+		userHashes.Unlock()
+	}()
+	ensure.Err(t, RegisterHash(id, fn), regexp.MustCompile(`^dyconf: the hash \[65537\] is registered already`))
+
+	tmpFileName := setupTempFile(t, "TestRegisterHash-")
+	defer os.Remove(tmpFileName)
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithHash(id))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	ensure.Nil(t, m.Close())
+	ensure.True(t, calls > 0)
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	val, err := conf.Get("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("value"))
+	ensure.Nil(t, conf.Close())
+
+	// A process that didn't register the hash can't open the file.
+	userHashes.Lock()
+	delete(userHashes.m, id)
+	userHashes.Unlock()
+	_, err = New(tmpFileName)
+	ensure.Err(t, err, regexp.MustCompile(`the hash \[65537\] of the file is not registered`))
+	_, ok := err.(*FormatError)
+	ensure.True(t, ok, err)
+}
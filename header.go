@@ -1,109 +1,379 @@
 package dyconf
 
 import (
-	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/facebookgo/stackerr"
 )
 
 const (
-	headerBlockSize       = 0x20              // 32 bytes
+	headerBlockSize       = 0x80              // 128 bytes
 	defaultIndexBlockSize = 1024 * 1024 * 4   // 4 MB
 	defaultDataBlockSize  = 1024 * 1024 * 128 // 128 MB
-	defaultTotalSize      = headerBlockSize + defaultIndexBlockSize + defaultDataBlockSize
+	defaultTotalSize      = headerBlockSize + journalBlockSize + defaultChangeFeedSize + defaultIndexBlockSize + defaultDataBlockSize
 	defaultIndexCount     = defaultIndexBlockSize / sizeOfUint32
 
 	// Max limits
-	maxIndexBlockSize = 1024 * 1024 * 128  // 128 MB
-	maxDataBlockSize  = 1024 * 1024 * 1024 // 1 GB
+	maxIndexBlockSize   = 1024 * 1024 * 128  // 128 MB
+	maxDataBlockSize    = 1024 * 1024 * 1024 // 1 GB
+	maxJournalBlockSize = 1024 * 1024 * 16   // 16 MB
+
+	// maxWideDataBlockSize is the limit of the data block of files with featureWideOffsets.
+	maxWideDataBlockSize = 1024 * 1024 * 1024 * 1024 // 1 TB
+)
+
+// Every config file starts with the magic bytes followed by the format version. The major version
+// changes only when the layout changes in a way that older readers cannot understand. Additions that
+// older readers can safely ignore bump the minor version.
+const (
+	headerMagic        = "DYCF"
+	formatMajorVersion = 1
+	formatMinorVersion = 10
 )
 
+// Feature bits recorded in the header. A newer writer sets a compat feature for a capability that older
+// readers can safely ignore, and an incompat feature for one that older readers must not ignore. Readers
+// refuse files with unknown incompat features. Writers refuse files with any unknown feature, since they
+// can't keep its data consistent.
+const (
+	// featureHeaderChecksum means the header carries a checksum of itself.
+	featureHeaderChecksum = uint32(1 << 0)
+	// featureJournal means changes of the file are journaled. See journal.
+	featureJournal = uint32(1 << 1)
+	// featureKeyCount means the header holds the number of keys in the file.
+	featureKeyCount = uint32(1 << 2)
+	// featureChangeFeed means the file has a change feed. See changeFeed.
+	featureChangeFeed = uint32(1 << 3)
+	// featureSequence means the header is followed by a sequence number that the writers bump around
+	// every change. See WithLockFreeReads.
+	featureSequence = uint32(1 << 4)
+
+	// featureHash means the keys are hashed with the hash recorded in the header rather than FNV-1a.
+	featureHash = uint32(1 << 0) // incompat
+	// featureWideOffsets means the offsets saved in the index slots, the data block and the journal
+	// take 8 bytes rather than 4, so the file can be bigger than 4 GB. See offsetSize.
+	featureWideOffsets = uint32(1 << 1) // incompat
+	// featureValueTypes means the records may hold the type of their value. See ValueType.
+	featureValueTypes = uint32(1 << 2) // incompat
+
+	knownCompatFeatures   = featureHeaderChecksum | featureJournal | featureKeyCount | featureChangeFeed | featureSequence
+	knownIncompatFeatures = featureHash | featureWideOffsets | featureValueTypes
+)
+
+// Header flags describe the state of the file rather than its format.
+const (
+	// headerFlagReplaced means Defrag has replaced the file with a new one at the same path. Processes
+	// that still have the old file open should reopen the path.
+	headerFlagReplaced = uint32(1 << 0)
+)
+
+// headerChecksumOffset is where the header checksum is saved. It covers all the bytes before it.
+const headerChecksumOffset = headerBlockSize - sizeOfUint32
+
+// FormatError is returned when a file is not a config file or when it uses a format version or features
+// that this package does not support.
+type FormatError struct {
+	Reason   string
+	Major    uint16 // Major format version found in the file.
+	Minor    uint16 // Minor format version found in the file.
+	Features uint32 // Unsupported feature bits, if any.
+}
+
+func (e *FormatError) Error() string {
+	if e.Features != 0 {
+		return fmt.Sprintf("headerBlock: %s. Format version: [%d.%d], unsupported features: [%#x]", e.Reason, e.Major, e.Minor, e.Features)
+	}
+	return fmt.Sprintf("headerBlock: %s. Format version: [%d.%d]", e.Reason, e.Major, e.Minor)
+}
+
+// Is returns true for ErrFormat.
+func (e *FormatError) Is(target error) bool {
+	return target == ErrFormat
+}
+
+// The header is laid out as below. All the fields are little-endian.
+//
+//	0x00 magic              4 bytes
+//	0x04 major version      2 bytes
+//	0x06 minor version      2 bytes
+//	0x08 compat features    4 bytes
+//	0x0C incompat features  4 bytes
+//	0x10 total size         8 bytes
+//	0x18 modified time      8 bytes (nanoseconds since the unix epoch)
+//	0x20 index block offset 8 bytes
+//	0x28 index block size   8 bytes
+//	0x30 data block offset  8 bytes
+//	0x38 data block size    8 bytes
+//	0x40 generation         8 bytes
+//	0x48 flags              4 bytes
+//	0x4C change feed size   4 bytes (0 if the file has no change feed. It lies right after the journal)
+//	0x50 journal offset     8 bytes
+//	0x58 journal size       8 bytes (0 if the file has no journal)
+//	0x60 key count          8 bytes (valid only with featureKeyCount)
+//	0x68 hash               4 bytes (see HashID)
+//	0x6C hash key           16 bytes (used only by keyed hashes)
+//	0x7C checksum           4 bytes (CRC-32C of the bytes 0x00 - 0x7B)
 type headerBlock struct {
-	version          uint32
-	totalSize        uint32
+	majorVersion     uint16
+	minorVersion     uint16
+	compatFeatures   uint32
+	incompatFeatures uint32
+	totalSize        uint64
 	modifiedTime     time.Time
 	indexBlockOffset dataOffset
 	indexBlockSize   uint32
 	dataBlockOffset  dataOffset
-	dataBlockSize    uint32
+	dataBlockSize    uint64
+	generation       uint64 // bumped on every change of the config data.
+	flags            uint32
+	journalOffset    dataOffset
+	journalSize      uint32
+	feedSize         uint32
+	keyCount         uint64
+	hash             HashID
+	hashKey          [hashKeySize]byte
 
 	block []byte
 }
 
+// newHeaderBlock returns a header of the current format version that is saved to the given block.
+func newHeaderBlock(block []byte) *headerBlock {
+	return &headerBlock{
+		majorVersion: formatMajorVersion,
+		minorVersion: formatMinorVersion,
+		block:        block,
+	}
+}
+
 func (h *headerBlock) read(block []byte) (*headerBlock, error) {
 	if len(block) < headerBlockSize {
 		return nil, stackerr.Newf(
-			"headerBlock: failed to read the header. It should be [%#v] bytes. Given block: \n%s\n",
+			"headerBlock: failed to read the header. It should be [%#v] bytes. Given block: %s",
 			headerBlockSize,
-			spew.Sdump(block),
+			hexWindow(block, len(block)),
 		)
 	}
 
+	// The fields are decoded directly from the block. The header is read on every lookup that misses the
+	// header cache, so this avoids the reflection of binary.Read.
+	le := binary.LittleEndian
 	h.block = block
-	buf := bytes.NewReader(block)
-	if err := binary.Read(buf, binary.LittleEndian, &h.version); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the version. error: [%s]", err.Error())
+	magic := block[0:len(headerMagic)]
+	h.majorVersion = le.Uint16(block[0x04:])
+	h.minorVersion = le.Uint16(block[0x06:])
+	if string(magic) != headerMagic {
+		return nil, &FormatError{
+			Reason: fmt.Sprintf("invalid magic [% x]. Not a config file", magic),
+			Major:  h.majorVersion,
+			Minor:  h.minorVersion,
+		}
+	}
+	if h.majorVersion != formatMajorVersion {
+		return nil, &FormatError{
+			Reason: fmt.Sprintf("unsupported major version. Only [%d] is supported", formatMajorVersion),
+			Major:  h.majorVersion,
+			Minor:  h.minorVersion,
+		}
 	}
 
-	if err := binary.Read(buf, binary.LittleEndian, &h.totalSize); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the total size. error: [%s]", err.Error())
+	h.compatFeatures = le.Uint32(block[0x08:])
+	if h.compatFeatures&featureHeaderChecksum != 0 {
+		stored := le.Uint32(block[headerChecksumOffset:])
+		computed := crc32.Checksum(block[:headerChecksumOffset], crcTable)
+		if stored != computed {
+			return nil, corruptHeader(block, headerChecksumOffset, "headerBlock: checksum mismatch. stored: [%#x], computed: [%#x]", stored, computed)
+		}
+	}
+	h.incompatFeatures = le.Uint32(block[0x0C:])
+	if unknown := h.incompatFeatures &^ knownIncompatFeatures; unknown != 0 {
+		return nil, &FormatError{
+			Reason:   "unsupported incompat features",
+			Major:    h.majorVersion,
+			Minor:    h.minorVersion,
+			Features: unknown,
+		}
 	}
 
-	var timestamp int64
-	if err := binary.Read(buf, binary.LittleEndian, &timestamp); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the modified time. error: [%s]", err.Error())
+	h.totalSize = le.Uint64(block[0x10:])
+	if h.totalSize > h.maxOffset() {
+		return nil, corruptHeader(block, 0x10, "headerBlock: invalid total size [%#X]. It should not exceed [%#X]", h.totalSize, h.maxOffset())
 	}
-	h.modifiedTime = time.Unix(timestamp, 0)
+	h.modifiedTime = time.Unix(0, int64(le.Uint64(block[0x18:])))
 
-	if err := binary.Read(buf, binary.LittleEndian, &h.indexBlockOffset); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the index block offset. error: [%s]", err.Error())
+	offset, size := le.Uint64(block[0x20:]), le.Uint64(block[0x28:])
+	if size > maxIndexBlockSize {
+		return nil, corruptHeader(block, 0x28, "headerBlock: invalid index block size [%#X]. It should not exceed [%#X]", size, maxIndexBlockSize)
 	}
-	if err := binary.Read(buf, binary.LittleEndian, &h.indexBlockSize); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the index block size. error: [%s]", err.Error())
+	if offset > h.maxOffset() {
+		return nil, corruptHeader(block, 0x20, "headerBlock: invalid index block offset [%#X]. It should not exceed [%#X]", offset, h.maxOffset())
+	}
+	h.indexBlockOffset, h.indexBlockSize = dataOffset(offset), uint32(size)
+
+	offset, size = le.Uint64(block[0x30:]), le.Uint64(block[0x38:])
+	if size > h.maxDataBlockSize() {
+		return nil, corruptHeader(block, 0x38, "headerBlock: invalid data block size [%#X]. It should not exceed [%#X]", size, h.maxDataBlockSize())
 	}
-	if h.indexBlockSize > maxIndexBlockSize {
-		return nil, stackerr.Newf("headerBlock: invalid index block size [%#X]. It should not exceed [%#X]", h.indexBlockSize, maxIndexBlockSize)
+	if offset > h.maxOffset() {
+		return nil, corruptHeader(block, 0x30, "headerBlock: invalid data block offset [%#X]. It should not exceed [%#X]", offset, h.maxOffset())
 	}
+	h.dataBlockOffset, h.dataBlockSize = dataOffset(offset), size
 
-	if err := binary.Read(buf, binary.LittleEndian, &h.dataBlockOffset); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the data block offset. error: [%s]", err.Error())
+	h.generation = le.Uint64(block[0x40:])
+	h.flags = le.Uint32(block[0x48:])
+
+	h.feedSize = le.Uint32(block[0x4C:])
+	if h.feedSize != 0 && (h.feedSize < minChangeFeedSize || h.feedSize > maxChangeFeedSize) {
+		return nil, corruptHeader(block, 0x4C, "headerBlock: invalid change feed size [%#X]. It should be between [%#X - %#X]", h.feedSize, minChangeFeedSize, maxChangeFeedSize)
 	}
-	if err := binary.Read(buf, binary.LittleEndian, &h.dataBlockSize); err != nil {
-		return nil, stackerr.Newf("headerBlock: failed to read the data block size. error: [%s]", err.Error())
+
+	offset, size = le.Uint64(block[0x50:]), le.Uint64(block[0x58:])
+	if size != 0 && (size < journalHeaderSize || size > maxJournalBlockSize) {
+		return nil, corruptHeader(block, 0x58, "headerBlock: invalid journal size [%#X]. It should be between [%#X - %#X]", size, journalHeaderSize, maxJournalBlockSize)
 	}
-	if h.dataBlockSize > maxDataBlockSize {
-		return nil, stackerr.Newf("headerBlock: invalid data block size [%#X]. It should not exceed [%#X]", h.dataBlockSize, maxDataBlockSize)
+	if offset > h.maxOffset() {
+		return nil, corruptHeader(block, 0x50, "headerBlock: invalid journal offset [%#X]. It should not exceed [%#X]", offset, h.maxOffset())
+	}
+	h.journalOffset, h.journalSize = dataOffset(offset), uint32(size)
+
+	h.keyCount = le.Uint64(block[0x60:])
+	h.hash = HashID(le.Uint32(block[0x68:]))
+	if h.hash >= HashUserMin && !h.hash.known() {
+		return nil, &FormatError{
+			Reason: fmt.Sprintf("the hash [%d] of the file is not registered. See RegisterHash", h.hash),
+			Major:  h.majorVersion,
+			Minor:  h.minorVersion,
+		}
+	}
+	if !h.hash.known() {
+		return nil, corruptHeader(block, 0x68, "headerBlock: unknown hash [%d]", h.hash)
+	}
+	copy(h.hashKey[:], block[0x6C:0x6C+hashKeySize])
+
+	// The keys are hashed modulo the number of index slots, so there must be at least one. The data block
+	// grows by doubling its size, so it can't be empty either.
+	if slotSize := offsetSize(h.wide()); h.indexBlockSize < slotSize || h.indexBlockSize%slotSize != 0 {
+		return nil, corruptHeader(block, 0x28, "headerBlock: invalid index block size [%#X]. It should be a non-zero multiple of [%#X]", h.indexBlockSize, slotSize)
+	}
+	if h.dataBlockSize == 0 {
+		return nil, corruptHeader(block, 0x38, "headerBlock: invalid data block size [0]. It should be positive")
 	}
 	return h, nil
 }
 
+// corruptHeader returns an ErrCorrupt error about the header field at the given offset.
+func corruptHeader(block []byte, offset uint64, format string, args ...interface{}) error {
+	return &FileError{
+		Offset: offset,
+		Reason: fmt.Sprintf(format, args...),
+		Err:    ErrCorrupt,
+		window: hexWindow(block, int(offset)),
+	}
+}
+
+// wide returns true if the file saves 8 byte offsets. See featureWideOffsets.
+func (h *headerBlock) wide() bool {
+	return h.incompatFeatures&featureWideOffsets != 0
+}
+
+// maxOffset returns the limit of the offsets and sizes in the file. File offsets are int64 in the os
+// package, so that is the limit of the files with wide offsets.
+func (h *headerBlock) maxOffset() uint64 {
+	if h.wide() {
+		return math.MaxInt64
+	}
+	return math.MaxUint32
+}
+
+// indexSlotCount returns the number of slots in the index block.
+func (h *headerBlock) indexSlotCount() uint32 {
+	return h.indexBlockSize / offsetSize(h.wide())
+}
+
+// maxDataBlockSize returns the limit of the data block size of the file.
+func (h *headerBlock) maxDataBlockSize() uint64 {
+	if h.wide() {
+		return maxWideDataBlockSize
+	}
+	return maxDataBlockSize
+}
+
+// hashFunc returns the hash function of the file.
+func (h *headerBlock) hashFunc() hashFunc {
+	return newHashFunc(h.hash, h.hashKey)
+}
+
+// checkWritable returns an error if the file uses features that this package can read but cannot keep
+// consistent while writing.
+func (h *headerBlock) checkWritable() error {
+	if unknown := h.compatFeatures &^ knownCompatFeatures; unknown != 0 {
+		return &FormatError{
+			Reason:   "cannot write to a file with unsupported compat features",
+			Major:    h.majorVersion,
+			Minor:    h.minorVersion,
+			Features: unknown,
+		}
+	}
+	return nil
+}
+
+// touch records a change of the config data. It bumps the generation and the modified time.
+func (h *headerBlock) touch() {
+	h.generation++
+	h.modifiedTime = time.Now()
+}
+
 func (h *headerBlock) save() error {
 	if len(h.block) < headerBlockSize {
 		return stackerr.Newf(
-			"headerBlock: failed to save the header. It should be [%#v] bytes. Given block (%d bytes): \n%s\n",
+			"headerBlock: failed to save the header. It should be [%#v] bytes. Given block (%d bytes): %s",
 			headerBlockSize,
 			len(h.block),
-			spew.Sdump(h.block),
+			hexWindow(h.block, len(h.block)),
 		)
 	}
 
-	timestamp := h.modifiedTime.Unix()
+	timestamp := h.modifiedTime.UnixNano()
+	h.compatFeatures |= featureHeaderChecksum
+	if h.journalSize != 0 {
+		h.compatFeatures |= featureJournal
+	}
+	if h.feedSize != 0 {
+		h.compatFeatures |= featureChangeFeed
+	}
+	if h.hash != HashFNV1a {
+		h.incompatFeatures |= featureHash
+	}
 
 	buf := &writeBuffer{buf: h.block}
-	binary.Write(buf, binary.LittleEndian, h.version)
+	binary.Write(buf, binary.LittleEndian, []byte(headerMagic))
+	binary.Write(buf, binary.LittleEndian, h.majorVersion)
+	binary.Write(buf, binary.LittleEndian, h.minorVersion)
+	binary.Write(buf, binary.LittleEndian, h.compatFeatures)
+	binary.Write(buf, binary.LittleEndian, h.incompatFeatures)
 	binary.Write(buf, binary.LittleEndian, h.totalSize)
 	binary.Write(buf, binary.LittleEndian, timestamp)
-	binary.Write(buf, binary.LittleEndian, h.indexBlockOffset)
-	binary.Write(buf, binary.LittleEndian, h.indexBlockSize)
-	binary.Write(buf, binary.LittleEndian, h.dataBlockOffset)
+	binary.Write(buf, binary.LittleEndian, uint64(h.indexBlockOffset))
+	binary.Write(buf, binary.LittleEndian, uint64(h.indexBlockSize))
+	binary.Write(buf, binary.LittleEndian, uint64(h.dataBlockOffset))
 	binary.Write(buf, binary.LittleEndian, h.dataBlockSize)
+	binary.Write(buf, binary.LittleEndian, h.generation)
+	binary.Write(buf, binary.LittleEndian, h.flags)
+	binary.Write(buf, binary.LittleEndian, h.feedSize)
+	binary.Write(buf, binary.LittleEndian, uint64(h.journalOffset))
+	binary.Write(buf, binary.LittleEndian, uint64(h.journalSize))
+	binary.Write(buf, binary.LittleEndian, h.keyCount)
+	binary.Write(buf, binary.LittleEndian, h.hash)
+	binary.Write(buf, binary.LittleEndian, h.hashKey)
 
 	if buf.err != nil {
 		return stackerr.Newf("headerBlock: unable to write the header. Details: [%s]", buf.err.Error())
 	}
 
+	checksum := crc32.Checksum(h.block[:headerChecksumOffset], crcTable)
+	binary.LittleEndian.PutUint32(h.block[headerChecksumOffset:], checksum)
 	return nil
 }
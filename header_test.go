@@ -9,27 +9,110 @@ import (
 	"github.com/facebookgo/ensure"
 )
 
+func headerPrefix(major, minor uint16, compat, incompat uint32) []byte {
+	return []byte{
+		0x44, 0x59, 0x43, 0x46, // magic (DYCF)
+		byte(major), byte(major >> 8), byte(minor), byte(minor >> 8), // major, minor version
+		byte(compat), byte(compat >> 8), byte(compat >> 16), byte(compat >> 24), // compat features
+		byte(incompat), byte(incompat >> 8), byte(incompat >> 16), byte(incompat >> 24), // incompat features
+	}
+}
+
 // TestHeaderRead tests the reading of header.
 func TestHeaderRead(t *testing.T) {
 	cases := []struct {
 		inputBlock  []byte
 		expectedHdr *headerBlock
 	}{
-		{
-			inputBlock: []byte{
-				0xAA, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x00, // Version(0xAA), totalSze(0xFFFF)
-				0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
-				0x00, 0xBB, 0x00, 0xAA, 0xFF, 0xFF, 0x00, 0x00, // indexBlockOffset(0xAA00BB00), indexBlockSize(0xFFFF)
-				0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0xFF, 0x00, 0x00, // dataBlockOffset(0xAABBCCDD), dataBlockSize(0xFF00)
-			},
+		{ // Case-0
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, featureHash),
+				[]byte{
+					0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // totalSize(0xFFFF)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
+					0x00, 0xBB, 0x00, 0xAA, 0x00, 0x00, 0x00, 0x00, // indexBlockOffset(0xAA00BB00)
+					0xFC, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // indexBlockSize(0xFFFC)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // dataBlockOffset(0xAABBCCDD)
+					0x00, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // dataBlockSize(0xFF00)
+				},
+				[]byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, // generation(0x0102030405060708)
+				[]byte{0x01, 0x00, 0x00, 0x00},                         // flags(replaced)
+				make([]byte, 0x04),                                     // padding
+				[]byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // journalOffset(0x80)
+				[]byte{0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // journalSize(0x1000)
+				[]byte{0x2A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // keyCount(42)
+				[]byte{0x02, 0x00, 0x00, 0x00},                         // hash(SipHash-2-4)
+				[]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}, // hashKey
+				make([]byte, 0x04), // checksum
+			),
 			expectedHdr: &headerBlock{
-				version:          0xAA,
+				majorVersion:     1,
+				incompatFeatures: featureHash,
 				totalSize:        0xFFFF,
-				modifiedTime:     time.Unix(0xAABBCCDD, 0),
+				modifiedTime:     time.Unix(0, 0xAABBCCDD),
 				indexBlockOffset: 0xAA00BB00,
-				indexBlockSize:   0xFFFF,
+				indexBlockSize:   0xFFFC,
 				dataBlockOffset:  0xAABBCCDD,
 				dataBlockSize:    0xFF00,
+				generation:       0x0102030405060708,
+				flags:            headerFlagReplaced,
+				journalOffset:    0x80,
+				journalSize:      0x1000,
+				keyCount:         42,
+				hash:             HashSipHash24,
+				hashKey:          [hashKeySize]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10},
+			},
+		},
+		{ // Case-1: Newer minor version with unknown compat features can be read.
+			inputBlock: concatBytes(
+				headerPrefix(1, 7, 0x80000000, 0),
+				[]byte{
+					0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // totalSize(0xFFFF)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
+					0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // indexBlockOffset(0x80)
+					0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // indexBlockSize(0x100)
+					0x80, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // dataBlockOffset(0x180)
+					0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // dataBlockSize(0x400)
+				},
+				[]byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, // generation(0x0102030405060708)
+				make([]byte, 0x38), // reserved, checksum
+			),
+			expectedHdr: &headerBlock{
+				majorVersion:     1,
+				minorVersion:     7,
+				compatFeatures:   0x80000000,
+				totalSize:        0xFFFF,
+				modifiedTime:     time.Unix(0, 0xAABBCCDD),
+				indexBlockOffset: 0x80,
+				indexBlockSize:   0x100,
+				dataBlockOffset:  0x180,
+				dataBlockSize:    0x400,
+				generation:       0x0102030405060708,
+			},
+		},
+		{ // Case-2: Files with wide offsets can be bigger than 4 GB.
+			inputBlock: concatBytes(
+				headerPrefix(1, 7, 0, featureWideOffsets),
+				[]byte{
+					0x80, 0x01, 0x00, 0x80, 0x01, 0x00, 0x00, 0x00, // totalSize(0x180000180)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
+					0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // indexBlockOffset(0x80)
+					0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // indexBlockSize(0x100)
+					0x80, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // dataBlockOffset(0x180)
+					0x00, 0x00, 0x00, 0x80, 0x01, 0x00, 0x00, 0x00, // dataBlockSize(0x180000000)
+				},
+				make([]byte, 0x40), // reserved, checksum
+			),
+			expectedHdr: &headerBlock{
+				majorVersion:     1,
+				minorVersion:     7,
+				incompatFeatures: featureWideOffsets,
+				totalSize:        0x180000180,
+				modifiedTime:     time.Unix(0, 0xAABBCCDD),
+				indexBlockOffset: 0x80,
+				indexBlockSize:   0x100,
+				dataBlockOffset:  0x180,
+				dataBlockSize:    0x180000000,
 			},
 		},
 	}
@@ -50,29 +133,100 @@ func TestHeaderReadErrors(t *testing.T) {
 		expectedErrStr string
 	}{
 		{ //Case-0: Incomplete header.
-			inputBlock: []byte{
-				0xAA, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x00, // Version(0xAA), totalSze(0xFFFF)
-			},
-			expectedErrStr: `^headerBlock: failed to read the header. It should be \[32\] bytes.`,
+			inputBlock:     headerPrefix(1, 0, 0, 0),
+			expectedErrStr: `^headerBlock: failed to read the header. It should be \[128\] bytes.`,
 		},
 		{ //Case-1: Index block size exceeds max allowed size.
-			inputBlock: []byte{
-				0xAA, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x00, // Version(0xAA), totalSze(0xFFFF)
-				0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
-				0x00, 0xBB, 0x00, 0xAA, 0xFF, 0xFF, 0xFF, 0xFF, // indexBlockOffset(0xAA00BB00), indexBlockSize(0xFFFFFFFF)
-				0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0xFF, 0x00, 0x00, // dataBlockOffset(0xAABBCCDD), dataBlockSize(0xFF00)
-			},
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, 0),
+				[]byte{
+					0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // totalSize(0xFFFF)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
+					0x00, 0xBB, 0x00, 0xAA, 0x00, 0x00, 0x00, 0x00, // indexBlockOffset(0xAA00BB00)
+					0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, // indexBlockSize(0xFFFFFFFF)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // dataBlockOffset(0xAABBCCDD)
+					0x00, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // dataBlockSize(0xFF00)
+				},
+				make([]byte, 0x40), // reserved
+			),
 			expectedErrStr: `^headerBlock: invalid index block size \[0XFFFFFFFF\]. It should not exceed \[0X8000000\]`,
 		},
 		{ //Case-2: Data block size exceeds max allowed size.
-			inputBlock: []byte{
-				0xAA, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x00, // Version(0xAA), totalSze(0xFFFF)
-				0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
-				0x00, 0xBB, 0x00, 0xAA, 0xFF, 0xFF, 0x00, 0x00, // indexBlockOffset(0xAA00BB00), indexBlockSize(0xFFFF)
-				0xDD, 0xCC, 0xBB, 0xAA, 0xFF, 0xFF, 0xFF, 0xFF, // dataBlockOffset(0xAABBCCDD), dataBlockSize(0xFFFFFFFF)
-			},
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, 0),
+				[]byte{
+					0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // totalSize(0xFFFF)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // modifiedTime(0xAABBCCDD)
+					0x00, 0xBB, 0x00, 0xAA, 0x00, 0x00, 0x00, 0x00, // indexBlockOffset(0xAA00BB00)
+					0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // indexBlockSize(0xFFFF)
+					0xDD, 0xCC, 0xBB, 0xAA, 0x00, 0x00, 0x00, 0x00, // dataBlockOffset(0xAABBCCDD)
+					0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, // dataBlockSize(0xFFFFFFFF)
+				},
+				make([]byte, 0x40), // reserved
+			),
 			expectedErrStr: `^headerBlock: invalid data block size \[0XFFFFFFFF\]. It should not exceed \[0X40000000\]`,
 		},
+		{ //Case-3: Total size doesn't fit in 32 bits.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, 0),
+				[]byte{0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}, // totalSize(0x100000000)
+				make([]byte, 0x70),
+			),
+			expectedErrStr: `^headerBlock: invalid total size \[0X100000000\]. It should not exceed \[0XFFFFFFFF\]`,
+		},
+		{ //Case-4: Journal size exceeds max allowed size.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, 0),
+				make([]byte, 0x40), // sizes, offsets, generation, flags, padding
+				[]byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // journalOffset(0x80)
+				[]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00}, // journalSize(0x2000000)
+				make([]byte, 0x20),
+			),
+			expectedErrStr: `^headerBlock: invalid journal size \[0X2000000\]. It should be between \[0X8 - 0X1000000\]`,
+		},
+		{ //Case-5: Unknown hash.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, featureHash),
+				make([]byte, 0x58),             // sizes, offsets, generation, flags, padding, journal, key count
+				[]byte{0x09, 0x00, 0x00, 0x00}, // hash(9)
+				make([]byte, 0x14),
+			),
+			expectedErrStr: `^headerBlock: unknown hash \[9\]`,
+		},
+		{ //Case-6: Data block size exceeds max allowed size of files with wide offsets.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, featureWideOffsets),
+				make([]byte, 0x28),                                     // totalSize, modifiedTime, index block, data block offset
+				[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00}, // dataBlockSize(0x20000000000)
+				make([]byte, 0x48),
+			),
+			expectedErrStr: `^headerBlock: invalid data block size \[0X20000000000\]. It should not exceed \[0X10000000000\]`,
+		},
+		{ //Case-7: Empty index block.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, 0),
+				make([]byte, 0x70),
+			),
+			expectedErrStr: `^headerBlock: invalid index block size \[0X0\]. It should be a non-zero multiple of \[0X4\]`,
+		},
+		{ //Case-8: Index block size that isn't a whole number of slots.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, featureWideOffsets),
+				make([]byte, 0x18),                                     // totalSize, modifiedTime, index block offset
+				[]byte{0x0C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // indexBlockSize(0xC)
+				make([]byte, 0x50),
+			),
+			expectedErrStr: `^headerBlock: invalid index block size \[0XC\]. It should be a non-zero multiple of \[0X8\]`,
+		},
+		{ //Case-9: Empty data block.
+			inputBlock: concatBytes(
+				headerPrefix(1, 0, 0, 0),
+				make([]byte, 0x18), // totalSize, modifiedTime, index block offset
+				[]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, // indexBlockSize(0x100)
+				make([]byte, 0x50),
+			),
+			expectedErrStr: `^headerBlock: invalid data block size \[0\]. It should be positive`,
+		},
 	}
 
 	for i, tc := range cases {
@@ -81,6 +235,87 @@ func TestHeaderReadErrors(t *testing.T) {
 	}
 }
 
+// TestHeaderReadFormatErrors tests that files of unknown formats are refused with a FormatError.
+func TestHeaderReadFormatErrors(t *testing.T) {
+	cases := []struct {
+		inputBlock     []byte
+		expectedErr    *FormatError
+		expectedErrStr string
+	}{
+		{ // Case-0: Not a config file.
+			inputBlock:     concatBytes([]byte("GIF89a"), make([]byte, headerBlockSize)),
+			expectedErr:    &FormatError{Reason: "invalid magic [47 49 46 38]. Not a config file", Major: 0x6139, Minor: 0},
+			expectedErrStr: `^headerBlock: invalid magic \[47 49 46 38\]. Not a config file`,
+		},
+		{ // Case-1: Unsupported major version.
+			inputBlock:     concatBytes(headerPrefix(2, 0, 0, 0), make([]byte, headerBlockSize)),
+			expectedErr:    &FormatError{Reason: "unsupported major version. Only [1] is supported", Major: 2},
+			expectedErrStr: `^headerBlock: unsupported major version. Only \[1\] is supported. Format version: \[2.0\]`,
+		},
+		{ // Case-2: Unknown incompat feature.
+			inputBlock:     concatBytes(headerPrefix(1, 3, 0, 0x80000000), make([]byte, headerBlockSize)),
+			expectedErr:    &FormatError{Reason: "unsupported incompat features", Major: 1, Minor: 3, Features: 0x80000000},
+			expectedErrStr: `^headerBlock: unsupported incompat features. Format version: \[1.3\], unsupported features: \[0x80000000\]`,
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := (&headerBlock{}).read(tc.inputBlock)
+		ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+		formatErr, ok := err.(*FormatError)
+		ensure.True(t, ok, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, formatErr, tc.expectedErr, fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestHeaderSaveRead tests that a saved header reads back the same.
+func TestHeaderSaveRead(t *testing.T) {
+	hdr := newHeaderBlock(make([]byte, headerBlockSize))
+	hdr.totalSize = 0x1234
+	hdr.modifiedTime = time.Unix(0xAABBCCDD, 0)
+	hdr.indexBlockOffset = headerBlockSize
+	hdr.indexBlockSize = 0x100
+	hdr.dataBlockOffset = headerBlockSize + 0x100
+	hdr.dataBlockSize = 0x1000
+	hdr.generation = 0x42
+	hdr.flags = headerFlagReplaced
+	hdr.journalOffset = headerBlockSize
+	hdr.journalSize = journalBlockSize
+	hdr.feedSize = minChangeFeedSize
+	hdr.keyCount = 42
+	hdr.hash = HashSipHash24
+	hdr.hashKey = [hashKeySize]byte{0x0F, 0x0E, 0x0D, 0x0C}
+	ensure.Nil(t, hdr.save())
+	ensure.DeepEqual(t, hdr.compatFeatures, featureHeaderChecksum|featureJournal|featureChangeFeed)
+	ensure.DeepEqual(t, hdr.incompatFeatures, featureHash)
+
+	readHdr, err := (&headerBlock{}).read(hdr.block)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, readHdr, hdr)
+}
+
+// TestHeaderChecksum tests that a corrupted header is detected.
+func TestHeaderChecksum(t *testing.T) {
+	hdr := newHeaderBlock(make([]byte, headerBlockSize))
+	hdr.totalSize = 0x1234
+	ensure.Nil(t, hdr.save())
+	ensure.True(t, hdr.compatFeatures&featureHeaderChecksum != 0)
+
+	hdr.block[0x10] ^= 0x01 // flip a bit of the total size.
+	_, err := (&headerBlock{}).read(hdr.block)
+	ensure.Err(t, err, regexp.MustCompile(`^headerBlock: checksum mismatch. stored: \[0x[0-9a-f]+\], computed: \[0x[0-9a-f]+\]`))
+}
+
+// TestHeaderCheckWritable tests that writers refuse files with unknown compat features.
+func TestHeaderCheckWritable(t *testing.T) {
+	ensure.Nil(t, newHeaderBlock(nil).checkWritable())
+
+	hdr := newHeaderBlock(nil)
+	hdr.compatFeatures = 0x80000000
+	err := hdr.checkWritable()
+	ensure.Err(t, err, regexp.MustCompile(`^headerBlock: cannot write to a file with unsupported compat features`))
+}
+
 // TestHeaderSaveErrors tests errors while saving the header.
 func TestHeaderSaveErrors(t *testing.T) {
 	buf := make([]byte, headerBlockSize-1)
@@ -1,20 +1,46 @@
 package dyconf
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
-	"hash/fnv"
 
 	"github.com/facebookgo/stackerr"
 )
 
 const (
+	sizeOfUint64 = 8
 	sizeOfUint32 = 4
 	sizeOfUint16 = 2
 )
 
-type dataOffset uint32
+// dataOffset is an offset in the file or in one of its blocks. Files with featureWideOffsets save it in
+// 8 bytes, the others in 4 bytes. See offsetSize.
+type dataOffset uint64
+
+// offsetSize returns the number of bytes an offset takes in the file.
+func offsetSize(wide bool) uint32 {
+	if wide {
+		return sizeOfUint64
+	}
+	return sizeOfUint32
+}
+
+// getOffset reads the offset saved at the start of the given bytes.
+func getOffset(b []byte, wide bool) dataOffset {
+	if wide {
+		return dataOffset(binary.LittleEndian.Uint64(b))
+	}
+	return dataOffset(binary.LittleEndian.Uint32(b))
+}
+
+// putOffset saves the offset at the start of the given bytes.
+func putOffset(b []byte, offset dataOffset, wide bool) {
+	if wide {
+		binary.LittleEndian.PutUint64(b, uint64(offset))
+		return
+	}
+	binary.LittleEndian.PutUint32(b, uint32(offset))
+}
 
 type index interface {
 	get(key string) (dataOffset, error)
@@ -22,8 +48,12 @@ type index interface {
 }
 
 type indexBlock struct {
-	size uint32 // current size of the index.
-	data []byte // Index data block
+	size uint32     // current size of the index.
+	data []byte     // Index data block
+	base dataOffset // offset of the index block in the file.
+	j    *journal   // journal of the change in progress, if any.
+	hash hashFunc   // hash function of the file. defaultHashFunc is used if it is nil.
+	wide bool       // the slots are 8 bytes instead of 4. See offsetSize.
 }
 
 // offsets returns all the valid datablock offsets set in the index.
@@ -42,22 +72,29 @@ func (i *indexBlock) getAll() ([]dataOffset, error) {
 }
 
 func (i *indexBlock) offset(idx uint32) (dataOffset, error) {
-	idx = idx * sizeOfUint32
-	// These 4 bytes represent the pointer in data block.
-	ptrBytes := i.data[idx : idx+sizeOfUint32]
-
-	// Convert from bytes to data block pointer offset.
-	var offset dataOffset
-	buf := bytes.NewReader(ptrBytes)
-	err := binary.Read(buf, binary.LittleEndian, &offset)
-	if err != nil {
-		return 0, fmt.Errorf("error in reading index: %s", err)
+	slotSize := offsetSize(i.wide)
+	index := uint64(idx) * uint64(slotSize)
+	if index+uint64(slotSize) > uint64(len(i.data)) {
+		return 0, &FileError{
+			Offset: index,
+			Reason: fmt.Sprintf("indexBlock: slot [%d] is out of bounds. Index block size: [%#x]", idx, len(i.data)),
+			Err:    ErrCorrupt,
+		}
+	}
+	// These bytes represent the pointer in data block.
+	return getOffset(i.data[index:], i.wide), nil
+}
+
+// hashKey returns the hash of the given key.
+func (i *indexBlock) hashKey(key string) (uint32, error) {
+	if i.hash == nil {
+		return defaultHashFunc(key)
 	}
-	return offset, nil
+	return i.hash(key)
 }
 
 func (i *indexBlock) get(key string) (dataOffset, error) {
-	h, err := defaultHashFunc(key)
+	h, err := i.hashKey(key)
 	if err != nil {
 		return 0, err
 	}
@@ -67,46 +104,40 @@ func (i *indexBlock) get(key string) (dataOffset, error) {
 
 func (i *indexBlock) set(key string, offset dataOffset) error {
 	// compute index offset.
-	h, err := defaultHashFunc(key)
+	h, err := i.hashKey(key)
 	if err != nil {
 		return err
 	}
-	index := (h % i.size) * sizeOfUint32
-	offsetBytes := i.data[index : index+sizeOfUint32]
+	return i.setOffset(h%i.size, offset)
+}
 
-	// Conver the offset into little-endian byte ordering.
-	buf := &bytes.Buffer{}
-	err = binary.Write(buf, binary.LittleEndian, offset)
-	if err != nil {
+// setOffset saves the given data block offset in the given slot.
+func (i *indexBlock) setOffset(idx uint32, offset dataOffset) error {
+	slotSize := offsetSize(i.wide)
+	index := uint64(idx) * uint64(slotSize)
+	if index+uint64(slotSize) > uint64(len(i.data)) {
+		return &FileError{
+			Offset: index,
+			Reason: fmt.Sprintf("indexBlock: slot [%d] is out of bounds. Index block size: [%#x]", idx, len(i.data)),
+			Err:    ErrCorrupt,
+		}
+	}
+	if err := i.j.preserve(i.base+dataOffset(index), slotSize); err != nil {
 		return err
 	}
-
-	// save at offsetBytes
-	copy(offsetBytes, buf.Bytes())
+	putOffset(i.data[index:], offset, i.wide)
 	return nil
 }
 
 func (i *indexBlock) reset() error {
-	zeroBytes := make([]byte, sizeOfUint32)
+	slotSize := offsetSize(i.wide)
+	zeroBytes := make([]byte, slotSize)
 	for idx := uint32(0); idx < i.size; idx++ {
-		offset := idx * sizeOfUint32
-		offsetBytes := i.data[offset : offset+sizeOfUint32]
-		if copy(offsetBytes, zeroBytes) != sizeOfUint32 {
+		offset := idx * slotSize
+		offsetBytes := i.data[offset : offset+slotSize]
+		if copy(offsetBytes, zeroBytes) != int(slotSize) {
 			return stackerr.Newf("Error while resetting index block")
 		}
 	}
 	return nil
 }
-
-type hashFunc func(key string) (uint32, error)
-
-var defaultHashFunc = hashFuncFNV1a
-
-var hashFuncFNV1a = func(key string) (uint32, error) {
-	h := fnv.New32a() // Use FNV-1a hashing.
-	_, err := h.Write([]byte(key))
-	if err != nil {
-		return 0, err
-	}
-	return h.Sum32(), nil
-}
@@ -36,6 +36,15 @@ func TestIndexSuccessfulGet(t *testing.T) {
 			mockedHashIndex: 100,
 			expectedDataPtr: 0x44332211,
 		},
+		{ // Case-3: wide index block contains 0x0102030405060708 at 1st index
+			indexBlk: indexBlock{
+				size: 2,
+				data: []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+				wide: true,
+			},
+			mockedHashIndex: 3,
+			expectedDataPtr: 0x0102030405060708,
+		},
 	}
 
 	for i, tc := range cases {
@@ -55,6 +64,7 @@ func TestIndexSuccessfulSet(t *testing.T) {
 		indexBlkCount     uint32
 		mockedHashIndex   uint32
 		offset            dataOffset
+		wide              bool
 		expectedDataBytes []byte
 	}{
 		{ // Case-0: index block contains 0x11223344 at 0th index
@@ -76,6 +86,13 @@ func TestIndexSuccessfulSet(t *testing.T) {
 			offset:            0x44332211,
 			expectedDataBytes: append(make([]byte, sizeOfUint32*100), []byte{0x11, 0x22, 0x33, 0x44, 0x0, 0x0, 0x0, 0x0}...),
 		},
+		{ // Case-3: wide index block contains 0x0102030405060708 at 1st index
+			indexBlkCount:     2,
+			mockedHashIndex:   1,
+			offset:            0x0102030405060708,
+			wide:              true,
+			expectedDataBytes: []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+		},
 	}
 
 	for i, tc := range cases {
@@ -88,6 +105,7 @@ func TestIndexSuccessfulSet(t *testing.T) {
 		indexBlk := indexBlock{
 			size: tc.indexBlkCount,
 			data: make([]byte, len(tc.expectedDataBytes)),
+			wide: tc.wide,
 		}
 
 		err := indexBlk.set("qwerty", tc.offset)
@@ -0,0 +1,186 @@
+package dyconf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/facebookgo/stackerr"
+)
+
+const (
+	journalBlockSize       = 0x1000 // 4 KB
+	journalHeaderSize      = 0x08   // 8 bytes
+	journalEntryHeaderSize = 0x08   // 8 bytes, or 12 bytes in files with featureWideOffsets.
+
+	journalStateOffset = 0x00 // state of the journal is saved here.
+	journalUsedOffset  = 0x04 // number of bytes used by the entries is saved here.
+
+	journalIdle   = uint32(0)
+	journalActive = uint32(1)
+)
+
+// journal is an undo log of the in-place writes of a single change of the config file. Before a byte
+// that may be in use is overwritten, its old value is saved in the journal. The journal is marked active
+// when the change begins and idle when it is complete. If the change fails, or the writer dies while the
+// journal is active, the saved bytes are written back in reverse order to undo the change. The latter
+// happens the next time the file is opened for writing.
+//
+// Bytes that were unused when the change began, like the free space of the data block, are not saved.
+// Undoing the change restores the write offset of the data block, and with it they become unused again.
+//
+// The journal is laid out as below. All the fields are little-endian.
+//
+//	state        4 bytes (idle or active)
+//	used         4 bytes (number of bytes used by the entries)
+//	entries      (used) bytes
+//
+// Every entry is laid out as below.
+//
+//	offset       4 bytes (offset in the file. 8 bytes in files with featureWideOffsets)
+//	size         4 bytes
+//	old bytes    (size) bytes
+type journal struct {
+	block  []byte     // the journal region of the file.
+	offset dataOffset // offset of the journal region in the file.
+	file   []byte     // the mapped file. It is nil if the journal is only read to roll back.
+	fresh  dataOffset // offsets in the file from here on were unused when the change began.
+	wide   bool       // the entries have 8 byte offsets. See offsetSize.
+}
+
+// newJournal returns the journal described by the given header in the mapped file.
+func newJournal(h *headerBlock, file []byte) *journal {
+	j := &journal{offset: h.journalOffset, wide: h.wide()}
+	j.block = file[j.offset : j.offset+dataOffset(h.journalSize)]
+	j.file = file
+	return j
+}
+
+// entryHeaderSize returns the size of the header of every entry.
+func (j *journal) entryHeaderSize() uint32 {
+	return offsetSize(j.wide) + sizeOfUint32
+}
+
+// begin marks the start of a change. Offsets in the file starting at fresh are not saved, since they
+// are not in use.
+func (j *journal) begin(fresh dataOffset) {
+	j.fresh = fresh
+	binary.LittleEndian.PutUint32(j.block[journalUsedOffset:], 0)
+	binary.LittleEndian.PutUint32(j.block[journalStateOffset:], journalActive)
+}
+
+// commit marks the end of the change. After this it can't be undone.
+func (j *journal) commit() {
+	binary.LittleEndian.PutUint32(j.block[journalStateOffset:], journalIdle)
+}
+
+func (j *journal) active() bool {
+	return binary.LittleEndian.Uint32(j.block[journalStateOffset:]) == journalActive
+}
+
+func (j *journal) used() uint32 {
+	return binary.LittleEndian.Uint32(j.block[journalUsedOffset:])
+}
+
+// canPreserve returns true if the journal has enough room to save the given number of bytes. It is
+// always true for a nil journal, which doesn't save anything.
+func (j *journal) canPreserve(size uint32) bool {
+	if j == nil {
+		return true
+	}
+	return uint64(journalHeaderSize)+uint64(j.used())+uint64(j.entryHeaderSize())+uint64(size) <= uint64(len(j.block))
+}
+
+// preserve saves the current value of the given bytes of the file, before they are overwritten. It does
+// nothing for a nil journal, which is used by files without a journal and for changes that don't need
+// one.
+func (j *journal) preserve(offset dataOffset, size uint32) error {
+	if j == nil || offset >= j.fresh {
+		return nil
+	}
+	if uint64(offset)+uint64(size) > uint64(len(j.file)) {
+		return stackerr.Newf("journal: cannot save the bytes [%#x +%#x]. They exceed the file size [%#x]", offset, size, len(j.file))
+	}
+	if !j.canPreserve(size) {
+		return stackerr.Newf(
+			"journal: cannot save the bytes [%#x +%#x]. The journal has only [%#x] of [%#x] bytes free",
+			offset,
+			size,
+			uint32(len(j.block))-journalHeaderSize-j.used(),
+			len(j.block)-journalHeaderSize,
+		)
+	}
+
+	// Write the entry first and only then count it, so that a partially written entry is never undone.
+	used := j.used()
+	entry := j.block[journalHeaderSize+used:]
+	putOffset(entry, offset, j.wide)
+	binary.LittleEndian.PutUint32(entry[offsetSize(j.wide):], size)
+	copy(entry[j.entryHeaderSize():], j.file[offset:offset+dataOffset(size)])
+	binary.LittleEndian.PutUint32(j.block[journalUsedOffset:], used+j.entryHeaderSize()+size)
+	return nil
+}
+
+// rollback undoes the change recorded in the journal by writing the saved bytes back to the given file,
+// in the reverse order they were saved. Then it marks the journal idle in the file.
+func (j *journal) rollback(dst io.WriterAt) error {
+	type entry struct {
+		offset dataOffset
+		old    []byte
+	}
+	used := j.used()
+	if uint64(journalHeaderSize)+uint64(used) > uint64(len(j.block)) {
+		return &FileError{
+			Offset: journalUsedOffset,
+			Reason: fmt.Sprintf("journal: invalid used size [%#x]. The journal is only [%#x] bytes", used, len(j.block)),
+			Err:    ErrCorrupt,
+		}
+	}
+	entries := j.block[journalHeaderSize : journalHeaderSize+used]
+	var undo []entry
+	for len(entries) > 0 {
+		if uint32(len(entries)) < j.entryHeaderSize() {
+			return &FileError{
+				Offset: uint64(journalHeaderSize+used) - uint64(len(entries)),
+				Reason: fmt.Sprintf("journal: incomplete entry header [% x]", entries),
+				Err:    ErrCorrupt,
+			}
+		}
+		offset := getOffset(entries, j.wide)
+		size := binary.LittleEndian.Uint32(entries[offsetSize(j.wide):])
+		entries = entries[j.entryHeaderSize():]
+		if uint32(len(entries)) < size {
+			return &FileError{
+				Offset: uint64(journalHeaderSize+used) - uint64(len(entries)),
+				Reason: fmt.Sprintf("journal: incomplete entry for the bytes [%#x +%#x]. Only [%#x] bytes left", offset, size, len(entries)),
+				Err:    ErrCorrupt,
+			}
+		}
+		undo = append(undo, entry{offset: offset, old: entries[:size]})
+		entries = entries[size:]
+	}
+
+	for i := len(undo) - 1; i >= 0; i-- {
+		if _, err := dst.WriteAt(undo[i].old, int64(undo[i].offset)); err != nil {
+			return stackerr.Newf("journal: failed to restore the bytes [%#x +%#x]. error: [%s]", undo[i].offset, len(undo[i].old), err.Error())
+		}
+	}
+
+	idle := make([]byte, sizeOfUint32)
+	binary.LittleEndian.PutUint32(idle, journalIdle)
+	if _, err := dst.WriteAt(idle, int64(j.offset+journalStateOffset)); err != nil {
+		return stackerr.Newf("journal: failed to mark the journal idle. error: [%s]", err.Error())
+	}
+	return nil
+}
+
+// blockWriter writes to a byte slice at the given offsets. It is used to roll back a change in the
+// mapped file.
+type blockWriter []byte
+
+func (b blockWriter) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(p)) > int64(len(b)) {
+		return 0, stackerr.Newf("blockWriter: cannot write [%#x] bytes at offset [%#x]. Block size: [%#x]", len(p), offset, len(b))
+	}
+	return copy(b[offset:], p), nil
+}
@@ -0,0 +1,134 @@
+package dyconf
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// TestJournalRollback tests that the rollback restores the bytes saved in the journal.
+func TestJournalRollback(t *testing.T) {
+	h := &headerBlock{journalOffset: 0x10, journalSize: 0x40}
+	file := make([]byte, 0x80)
+	for i := range file[0x50:] {
+		file[0x50+i] = byte(i)
+	}
+	original := append([]byte(nil), file...)
+
+	j := newJournal(h, file)
+	j.begin(0x70)
+	ensure.True(t, j.active())
+
+	// Overwrite the same bytes twice. The rollback restores the oldest value.
+	ensure.Nil(t, j.preserve(0x50, 4))
+	copy(file[0x50:], []byte{0xAA, 0xAA, 0xAA, 0xAA})
+	ensure.Nil(t, j.preserve(0x52, 4))
+	copy(file[0x52:], []byte{0xBB, 0xBB, 0xBB, 0xBB})
+	ensure.DeepEqual(t, j.used(), uint32(2*(journalEntryHeaderSize+4)))
+
+	// Fresh bytes are not saved.
+	ensure.Nil(t, j.preserve(0x70, 8))
+	copy(file[0x70:], []byte{0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC})
+	ensure.DeepEqual(t, j.used(), uint32(2*(journalEntryHeaderSize+4)))
+
+	ensure.Nil(t, j.rollback(blockWriter(file)))
+	ensure.False(t, j.active())
+	ensure.DeepEqual(t, file[0x50:0x70], original[0x50:0x70])
+	ensure.DeepEqual(t, file[0x70:0x78], []byte{0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC})
+}
+
+// TestJournalRollbackWide tests that the entries of a file with wide offsets have 8 byte offsets.
+func TestJournalRollbackWide(t *testing.T) {
+	h := &headerBlock{journalOffset: 0x10, journalSize: 0x40, incompatFeatures: featureWideOffsets}
+	file := make([]byte, 0x80)
+	original := append([]byte(nil), file...)
+
+	j := newJournal(h, file)
+	j.begin(0x80)
+	ensure.Nil(t, j.preserve(0x60, 4))
+	copy(file[0x60:], []byte{0xAA, 0xAA, 0xAA, 0xAA})
+	ensure.DeepEqual(t, j.used(), uint32(journalEntryHeaderSize+sizeOfUint32+4))
+	ensure.DeepEqual(t, file[0x18:0x24], []byte{0x60, 0, 0, 0, 0, 0, 0, 0, 0x04, 0, 0, 0})
+
+	ensure.Nil(t, j.rollback(blockWriter(file)))
+	ensure.False(t, j.active())
+	ensure.DeepEqual(t, file[0x60:0x64], original[0x60:0x64])
+}
+
+// TestJournalCommit tests that a committed change is not active anymore.
+func TestJournalCommit(t *testing.T) {
+	h := &headerBlock{journalOffset: 0x00, journalSize: 0x40}
+	file := make([]byte, 0x80)
+	j := newJournal(h, file)
+	j.begin(0x80)
+	ensure.Nil(t, j.preserve(0x60, 4))
+	j.commit()
+	ensure.False(t, j.active())
+
+	// A new change starts with an empty journal.
+	j.begin(0x80)
+	ensure.DeepEqual(t, j.used(), uint32(0))
+}
+
+// TestJournalPreserveErrors tests for errors while saving bytes in the journal.
+func TestJournalPreserveErrors(t *testing.T) {
+	cases := []struct {
+		offset         dataOffset
+		size           uint32
+		expectedErrStr string
+	}{
+		{ // Case-0: Beyond the end of the file.
+			offset:         0x7C,
+			size:           0x08,
+			expectedErrStr: `^journal: cannot save the bytes \[0x7c \+0x8\]. They exceed the file size \[0x80\]`,
+		},
+		{ // Case-1: Doesn't fit in the journal.
+			offset:         0x40,
+			size:           0x30,
+			expectedErrStr: `^journal: cannot save the bytes \[0x40 \+0x30\]. The journal has only \[0x18\] of \[0x18\] bytes free`,
+		},
+	}
+
+	for i, tc := range cases {
+		j := newJournal(&headerBlock{journalOffset: 0x00, journalSize: 0x20}, make([]byte, 0x80))
+		j.begin(0x80)
+		ensure.Err(t, j.preserve(tc.offset, tc.size), regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+	}
+
+	// A nil journal saves nothing and always has room.
+	var j *journal
+	ensure.True(t, j.canPreserve(maxDataSize))
+	ensure.Nil(t, j.preserve(0, maxDataSize))
+}
+
+// TestJournalRollbackErrors tests for errors while reading a damaged journal.
+func TestJournalRollbackErrors(t *testing.T) {
+	cases := []struct {
+		block          []byte
+		expectedErrStr string
+	}{
+		{ // Case-0: Used size exceeds the journal.
+			block:          []byte{0x01, 0x00, 0x00, 0x00, 0xFF, 0x00, 0x00, 0x00},
+			expectedErrStr: `^journal: invalid used size \[0xff\]. The journal is only \[0x8\] bytes`,
+		},
+		{ // Case-1: Incomplete entry header.
+			block:          []byte{0x01, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00},
+			expectedErrStr: `^journal: incomplete entry header \[10 00 00 00\]`,
+		},
+		{ // Case-2: Incomplete entry.
+			block: []byte{
+				0x01, 0x00, 0x00, 0x00, 0x0A, 0x00, 0x00, 0x00, // active, used(0x0A)
+				0x10, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, // offset(0x10), size(4)
+				0xAA, 0xBB, // old bytes
+			},
+			expectedErrStr: `^journal: incomplete entry for the bytes \[0x10 \+0x4\]. Only \[0x2\] bytes left`,
+		},
+	}
+
+	for i, tc := range cases {
+		j := &journal{block: tc.block}
+		ensure.Err(t, j.rollback(blockWriter(make([]byte, 0x20))), regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+	}
+}
@@ -0,0 +1,240 @@
+package dyconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// The writers notify the readers of a file of its changes over Unix datagram sockets. Every reader
+// created with WithNotifications binds a socket in the notify directory next to the file. After every
+// change, the writer sends an empty datagram to each socket in the directory. The datagrams only wake the
+// readers up. They find out what changed from the file itself, so a datagram that is lost, or not sent
+// because the socket is full of them already, does no harm.
+
+// notifyDirSuffix is appended to the config file name to name the directory of the reader sockets. The
+// directory is removed by the last reader to close.
+const notifyDirSuffix = ".notify"
+
+// maxSubscribeAttempts is the number of times subscribe tries to bind the socket. A reader that closes
+// may remove the directory between creating it and binding the socket in it.
+const maxSubscribeAttempts = 4
+
+// maxSocketPathLen is the length of the longest path a Unix socket can be bound to.
+const maxSocketPathLen = 107
+
+// drainTimeout is how long a reader waits for more notifications after receiving one. See read.
+const drainTimeout = time.Millisecond
+
+// socketCount numbers the sockets bound by this process.
+var socketCount uint64
+
+// socketName matches the names of the sockets bound by subscribe. The writers leave everything else in
+// the notify directory alone.
+var socketName = regexp.MustCompile(`^[0-9]+-[0-9]+\.sock$`)
+
+// subscription is the socket a reader receives the notifications of a file on. The goroutines waiting on
+// it at once take turns to read the socket, and count the notifications they receive, so that the others
+// find out about them too.
+type subscription struct {
+	conn     *net.UnixConn
+	path     string
+	mu       sync.Mutex // held by the goroutine reading the socket.
+	received uint64     // number of the waits that received a notification.
+}
+
+// subscribe binds a socket in the notify directory of the given file.
+func subscribe(fileName string) (*subscription, error) {
+	dir := fileName + notifyDirSuffix
+	path := filepath.Join(dir, fmt.Sprintf("%d-%d.sock", os.Getpid(), atomic.AddUint64(&socketCount, 1)))
+	if len(path) > maxSocketPathLen {
+		return nil, stackerr.Newf("dyconf: the socket path [%s] is longer than [%d] bytes. Use a shorter config file path", path, maxSocketPathLen)
+	}
+	for attempt := 1; ; attempt++ {
+		if err := os.Mkdir(dir, 0777); err != nil && !os.IsExist(err) {
+			return nil, stackerr.Newf("dyconf: failed to create the notify directory [%s]. error: [%s]", dir, err.Error())
+		}
+		// A socket left behind by a process that had the same pid is stale.
+		os.Remove(path)
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err == nil {
+			return &subscription{conn: conn, path: path}, nil
+		}
+		if opErr, ok := err.(*net.OpError); ok && os.IsNotExist(opErr.Err) && attempt < maxSubscribeAttempts {
+			continue
+		}
+		return nil, stackerr.Newf("dyconf: failed to bind the socket [%s]. error: [%s]", path, err.Error())
+	}
+}
+
+// count returns the number of the waits that received a notification so far. Wait passes it to wait.
+func (s *subscription) count() uint64 {
+	return atomic.LoadUint64(&s.received)
+}
+
+// wait waits for a notification until the given time. It returns false if none came. All the
+// notifications that came are consumed. It returns at once if another goroutine received one since
+// count returned the given number.
+func (s *subscription) wait(seen uint64, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count() != seen {
+		return true, nil
+	}
+	notified, err := s.read(until)
+	if notified {
+		atomic.AddUint64(&s.received, 1)
+	}
+	return notified, err
+}
+
+// read reads the notifications from the socket. See wait.
+func (s *subscription) read(until time.Time) (bool, error) {
+	buf := make([]byte, 1)
+	if err := s.conn.SetReadDeadline(until); err != nil {
+		return false, stackerr.Newf("dyconf: failed to wait on the socket [%s]. error: [%s]", s.path, err.Error())
+	}
+	for notified := false; ; notified = true {
+		if _, _, err := s.conn.ReadFrom(buf); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return notified, nil
+			}
+			return notified, stackerr.Newf("dyconf: failed to wait on the socket [%s]. error: [%s]", s.path, err.Error())
+		}
+		// Consume the notifications that came meanwhile, without waiting for more. A deadline that has
+		// passed already fails the read before the socket is even tried, so it is set a little ahead.
+		if err := s.conn.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+			return true, nil
+		}
+	}
+}
+
+func (s *subscription) close() error {
+	err := s.conn.Close()
+	os.Remove(s.path)
+	// The directory is left alone while other readers have sockets in it.
+	os.Remove(filepath.Dir(s.path))
+	if err != nil {
+		return stackerr.Newf("dyconf: failed to close the socket [%s]. error: [%s]", s.path, err.Error())
+	}
+	return nil
+}
+
+// notify wakes up the readers of the file that subscribed to its changes. Sockets left behind by readers
+// that are gone are removed. It never fails the change it is called for, so the errors are only logged.
+func (c *config) notify() {
+	dir := c.fileName + notifyDirSuffix
+	d, err := os.Open(dir)
+	if err != nil {
+		return // Nobody subscribed.
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil || len(names) == 0 {
+		return
+	}
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		c.logf("dyconf: failed to create a socket to notify the readers of the file [%s]. error: [%s]", c.fileName, err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+	for _, name := range names {
+		if !socketName.MatchString(name) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		switch err := sendNotification(fd, path); err {
+		case nil, syscall.EAGAIN, syscall.ENOENT:
+			// A socket that is full has a notification to wake its reader up already. One that is gone has
+			// nobody to wake up.
+		case syscall.ECONNREFUSED:
+			// Nobody reads the socket, but the path may be a file that is not a socket at all.
+			if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+		default:
+			c.logf("dyconf: failed to notify the reader socket [%s]. error: [%s]", path, err.Error())
+		}
+	}
+}
+
+// sendNotification sends an empty datagram to the socket bound to the given path, without waiting for
+// room in it.
+func sendNotification(fd int, path string) error {
+	return syscall.Sendto(fd, nil, syscall.MSG_DONTWAIT, &syscall.SockaddrUnix{Name: path})
+}
+
+// wake makes the wait in progress, or the next one, return at once.
+func (s *subscription) wake() {
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return
+	}
+	sendNotification(fd, s.path)
+	syscall.Close(fd)
+}
+
+// Wait returns the generation of the file once it differs from the given one, or the context's error if
+// the context is done first. A config created with WithNotifications is woken up by the writers as soon
+// as they change the file, and checks it every watch interval only in case a notification is lost.
+// Otherwise it checks the file every watch interval. See WithWatchInterval.
+func (c *config) Wait(ctx context.Context, generation uint64) (uint64, error) {
+	var ticker *time.Ticker
+	if c.sub == nil {
+		ticker = time.NewTicker(c.watchInterval)
+		defer ticker.Stop()
+	} else if ctx.Done() != nil {
+		// Wake the wait up when the context is done.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.sub.wake()
+			case <-stop:
+			}
+		}()
+	}
+	for {
+		// The count is taken before the generation, so that a notification received by another goroutine
+		// in between is not missed.
+		var seen uint64
+		if c.sub != nil {
+			seen = c.sub.count()
+		}
+		current, err := c.Generation()
+		if err != nil || current != generation {
+			return current, err
+		}
+
+		if c.sub == nil {
+			select {
+			case <-ctx.Done():
+				return current, ctx.Err()
+			case <-ticker.C:
+			}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return current, err
+		}
+		if _, err := c.sub.wait(seen, time.Now().Add(c.watchInterval)); err != nil {
+			// The socket is closed by Close.
+			if closedErr := c.checkOpen(); closedErr != nil {
+				return current, closedErr
+			}
+			return current, err
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package dyconf
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+// TestNotifyWait tests that a subscribed reader is woken up by the change of a writer, well before the
+// watch interval.
+func TestNotifyWait(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestNotifyWait-")
+	defer os.Remove(tmpFileName)
+	defer os.RemoveAll(tmpFileName + notifyDirSuffix)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	conf, err := New(tmpFileName, WithNotifications(), WithWatchInterval(time.Hour))
+	ensure.Nil(t, err)
+	generation, err := conf.Generation()
+	ensure.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		done <- m.Set("key", []byte("value"))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	current, err := conf.Wait(ctx, generation)
+	ensure.Nil(t, err)
+	ensure.Nil(t, <-done)
+	ensure.DeepEqual(t, current, generation+1)
+
+	// Events are sent as soon as the changes are made too.
+	events := conf.Watch(ctx, "key")
+	go func() {
+		done <- m.Set("key", []byte("new value"))
+	}()
+	e := nextEvent(t, events)
+	ensure.Nil(t, <-done)
+	ensure.DeepEqual(t, e.New, []byte("new value"))
+
+	// The socket is removed when the config is closed.
+	path := conf.(*config).sub.path
+	_, err = os.Stat(path)
+	ensure.Nil(t, err)
+	ensure.Nil(t, conf.Close())
+	_, err = os.Stat(path)
+	ensure.True(t, os.IsNotExist(err), err)
+}
+
+// TestNotifyDefault tests that New subscribes unless WithoutNotifications is given, and that the last
+// reader to close removes the notify directory.
+func TestNotifyDefault(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestNotifyDefault-")
+	defer os.Remove(tmpFileName)
+	defer os.RemoveAll(tmpFileName + notifyDirSuffix)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	ensure.True(t, m.(*configManager).sub == nil)
+	_, err = os.Stat(tmpFileName + notifyDirSuffix)
+	ensure.True(t, os.IsNotExist(err), err)
+
+	confs := make([]Config, 2)
+	for i := range confs {
+		confs[i], err = New(tmpFileName)
+		ensure.Nil(t, err)
+		ensure.True(t, confs[i].(*config).sub != nil)
+	}
+	conf, err := New(tmpFileName, WithoutNotifications())
+	ensure.Nil(t, err)
+	ensure.True(t, conf.(*config).sub == nil)
+	ensure.Nil(t, conf.Close())
+
+	ensure.Nil(t, confs[0].Close())
+	_, err = os.Stat(tmpFileName + notifyDirSuffix)
+	ensure.Nil(t, err)
+	ensure.Nil(t, confs[1].Close())
+	_, err = os.Stat(tmpFileName + notifyDirSuffix)
+	ensure.True(t, os.IsNotExist(err), err)
+}
+
+// TestNotifyDefaultFallback tests that New checks the file every watch interval if it can't subscribe,
+// unless WithNotifications is given.
+func TestNotifyDefaultFallback(t *testing.T) {
+	// The path of the socket would be too long.
+	dir, err := ioutil.TempDir("", "TestNotifyDefaultFallback-"+strings.Repeat("d", maxSocketPathLen))
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "config")
+
+	m, err := NewManager(fileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+
+	var logs bytes.Buffer
+	conf, err := New(fileName, WithLogger(log.New(&logs, "", 0)))
+	ensure.Nil(t, err)
+	ensure.True(t, conf.(*config).sub == nil)
+	ensure.StringContains(t, logs.String(), "failed to subscribe to the changes of the file")
+	ensure.Nil(t, conf.Close())
+
+	_, err = New(fileName, WithNotifications())
+	ensure.Err(t, err, regexp.MustCompile(`^dyconf: the socket path \[.*\] is longer than \[107\] bytes`))
+}
+
+// TestNotifyStaleSocket tests that the writers remove the sockets of the readers that are gone.
+func TestNotifyStaleSocket(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestNotifyStaleSocket-")
+	defer os.Remove(tmpFileName)
+	defer os.RemoveAll(tmpFileName + notifyDirSuffix)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	sub, err := subscribe(tmpFileName)
+	ensure.Nil(t, err)
+	// Close the socket but leave its file behind, like a reader that crashed.
+	ensure.Nil(t, sub.conn.Close())
+	_, err = os.Stat(sub.path)
+	ensure.Nil(t, err)
+
+	// The files that are not reader sockets are left alone, even if they are named like one.
+	others := []string{
+		filepath.Join(tmpFileName+notifyDirSuffix, "README"),
+		filepath.Join(tmpFileName+notifyDirSuffix, "1-1.sock"),
+	}
+	for _, other := range others {
+		ensure.Nil(t, ioutil.WriteFile(other, nil, 0644))
+	}
+
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	_, err = os.Stat(sub.path)
+	ensure.True(t, os.IsNotExist(err), err)
+	for _, other := range others {
+		_, err = os.Stat(other)
+		ensure.Nil(t, err, other)
+	}
+}
+
+// TestNotifyCompact tests that the readers are notified of the changes of the config data only, and not
+// of those of its layout.
+func TestNotifyCompact(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestNotifyCompact-")
+	defer os.Remove(tmpFileName)
+	defer os.RemoveAll(tmpFileName + notifyDirSuffix)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	sub, err := subscribe(tmpFileName)
+	ensure.Nil(t, err)
+	defer sub.close()
+	ensure.Nil(t, m.Set("key1", []byte("value")))
+	ensure.Nil(t, m.Set("key2", []byte("value")))
+	ensure.Nil(t, m.Delete("key1"))
+	notified, err := sub.wait(sub.count(), time.Now().Add(time.Second))
+	ensure.Nil(t, err)
+	ensure.True(t, notified)
+
+	generation, err := m.Generation()
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Compact(context.Background(), 0))
+	current, err := m.Generation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, current, generation)
+	notified, err = sub.wait(sub.count(), time.Now().Add(50*time.Millisecond))
+	ensure.Nil(t, err)
+	ensure.False(t, notified)
+}
+
+// TestWaitWithoutNotifications tests that Wait checks the file every watch interval without
+// notifications, and stops when the context is done.
+func TestWaitWithoutNotifications(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestWaitWithoutNotifications-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithWatchInterval(time.Millisecond))
+	ensure.Nil(t, err)
+	defer m.Close()
+	generation, err := m.Generation()
+	ensure.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	current, err := m.Wait(ctx, generation)
+	ensure.DeepEqual(t, err, context.DeadlineExceeded)
+	ensure.DeepEqual(t, current, generation)
+
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	current, err = m.Wait(context.Background(), generation)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, current, generation+1)
+}
+
+// TestNotifyWaitCancel tests that a subscribed reader stops waiting as soon as the context is done.
+func TestNotifyWaitCancel(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestNotifyWaitCancel-")
+	defer os.Remove(tmpFileName)
+	defer os.RemoveAll(tmpFileName + notifyDirSuffix)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithNotifications(), WithWatchInterval(time.Hour))
+	ensure.Nil(t, err)
+	defer m.Close()
+	generation, err := m.Generation()
+	ensure.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = m.Wait(ctx, generation)
+	ensure.DeepEqual(t, err, context.DeadlineExceeded)
+	ensure.True(t, time.Since(start) < time.Minute)
+
+	// The watchers stop as soon as the context is done too.
+	ctx, cancel = context.WithCancel(context.Background())
+	events := m.Watch(ctx, "")
+	cancel()
+	for range events {
+	}
+}
+
+// TestNotifyWaitConcurrent tests that all the goroutines waiting on a config are woken up by a change, and
+// by Close.
+func TestNotifyWaitConcurrent(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestNotifyWaitConcurrent-")
+	defer os.Remove(tmpFileName)
+	defer os.RemoveAll(tmpFileName + notifyDirSuffix)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	conf, err := New(tmpFileName, WithNotifications(), WithWatchInterval(time.Hour))
+	ensure.Nil(t, err)
+	generation, err := conf.Generation()
+	ensure.Nil(t, err)
+
+	const waiters = 4
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := make(chan error, waiters)
+	wait := func(generation uint64) {
+		for i := 0; i < waiters; i++ {
+			go func() {
+				_, err := conf.Wait(ctx, generation)
+				results <- err
+			}()
+		}
+	}
+	wait(generation)
+	time.Sleep(10 * time.Millisecond)
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	for i := 0; i < waiters; i++ {
+		ensure.Nil(t, <-results)
+	}
+
+	wait(generation + 1)
+	time.Sleep(10 * time.Millisecond)
+	ensure.Nil(t, conf.Close())
+	for i := 0; i < waiters; i++ {
+		err := <-results
+		fileErr, ok := err.(*FileError)
+		ensure.True(t, ok, err)
+		ensure.DeepEqual(t, fileErr.Err, ErrClosed)
+	}
+}
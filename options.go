@@ -0,0 +1,232 @@
+package dyconf
+
+import (
+	"os"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+const (
+	defaultFileMode       = os.FileMode(0644)
+	minDataBlockSize      = 0x400 // 1 KB
+	defaultMaxLoadFactor  = 1.0
+	defaultMaxChainLength = 8
+	defaultWatchInterval  = 100 * time.Millisecond
+)
+
+// Option configures a config file. Options that describe the layout of the file (index slots, data
+// block size, change feed size, file mode, hash, wide offsets) only take effect when NewManager creates
+// a new file. An existing file keeps the layout recorded in its header. The other options apply to the
+// ConfigManager they are given to. New only uses WithLogger, WithWatchInterval, WithNotifications and
+// WithLockFreeReads.
+type Option func(*options)
+
+type options struct {
+	indexCount     uint32
+	dataBlockSize  uint64
+	fileMode       os.FileMode
+	maxLoadFactor  float64
+	maxChainLength uint32
+	hash           HashID
+	wide           bool
+	logger         Logger
+	watchInterval  time.Duration
+	changeFeedSize uint32
+	notify         bool // subscribe, and fail if it can't. See WithNotifications.
+	noNotify       bool // don't subscribe. See WithoutNotifications.
+	lockFreeReads  bool
+}
+
+// WithIndexSlots sets the number of slots in the index block. Each slot takes 4 bytes (8 bytes with
+// WithWideOffsets), so the index block can hold at most maxIndexBlockSize/4 slots (maxIndexBlockSize/8).
+func WithIndexSlots(n uint32) Option {
+	return func(o *options) {
+		o.indexCount = n
+	}
+}
+
+// WithDataBlockSize sets the size of the data block in bytes. It can be bigger than 1 GB only with
+// WithWideOffsets.
+func WithDataBlockSize(size uint64) Option {
+	return func(o *options) {
+		o.dataBlockSize = size
+	}
+}
+
+// WithFileMode sets the permission bits used when creating the config file.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode
+	}
+}
+
+// WithWideOffsets makes the file save the offsets in 8 bytes rather than 4, so that it can grow beyond
+// 4 GB. The index slots, the next pointers of the records and the free lists take more space in return.
+// Files created with it can be read only by versions of this package that support it.
+func WithWideOffsets() Option {
+	return func(o *options) {
+		o.wide = true
+	}
+}
+
+// WithHash sets the hash function that maps the keys to the index slots. It is one of the hashes of this
+// package, or one registered with RegisterHash. It is recorded in the file, so New and NewManager always
+// use the hash the file was created with.
+func WithHash(id HashID) Option {
+	return func(o *options) {
+		o.hash = id
+	}
+}
+
+// WithMaxLoadFactor sets the number of keys per index slot above which Set rebuilds the file with an
+// index of twice as many slots. Zero disables it.
+func WithMaxLoadFactor(f float64) Option {
+	return func(o *options) {
+		o.maxLoadFactor = f
+	}
+}
+
+// WithMaxChainLength sets the number of keys in a single index slot above which Set rebuilds the file
+// with an index of twice as many slots. It only does so if the index is at least a quarter of the way to
+// the max load factor. Otherwise the keys just happen to collide, and a bigger index won't help much.
+// Zero disables it.
+func WithMaxChainLength(n uint32) Option {
+	return func(o *options) {
+		o.maxChainLength = n
+	}
+}
+
+// WithLogger sets the logger that receives the diagnostics of the config, like the details of the
+// corruption it finds and the interrupted changes it rolls back. Nothing is logged without it.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithWatchInterval sets how often Watch checks the file for changes. See Config.Watch.
+func WithWatchInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.watchInterval = d
+	}
+}
+
+// WithChangeFeedSize sets the size of the change feed in bytes. The feed records the keys changed by the
+// recent changes, so readers can find them out without reading all the keys (see Config.Changes). A
+// bigger feed holds more changes. Zero leaves the feed out.
+func WithChangeFeedSize(size uint32) Option {
+	return func(o *options) {
+		o.changeFeedSize = size
+	}
+}
+
+// WithNotifications makes the config subscribe to the changes of the file, so that the writers wake it
+// up as soon as they change the file. Wait and Watch don't have to check the file every watch interval
+// then. The writers send the notifications over Unix sockets in a directory next to the file, so the
+// reader must be able to create one there.
+//
+// New subscribes by default, and falls back to checking the file every watch interval if it can't. With
+// this option, New fails instead. NewManager subscribes only with this option.
+func WithNotifications() Option {
+	return func(o *options) {
+		o.notify, o.noNotify = true, false
+	}
+}
+
+// WithoutNotifications makes New not subscribe to the changes of the file. Wait and Watch check the file
+// every watch interval then. See WithNotifications.
+func WithoutNotifications() Option {
+	return func(o *options) {
+		o.notify, o.noNotify = false, true
+	}
+}
+
+// WithLockFreeReads makes Get, Has and the typed getters read the file without locking it, which saves
+// two system calls per read. The writers bump a sequence number in the file before and after every
+// change, and a read that overlaps a change is retried. A read falls back to locking the file if it
+// keeps overlapping changes, and for the first read after every change. The file must have the sequence
+// number, so the option also makes NewManager create the file with one. It has no effect on a file
+// created without it.
+func WithLockFreeReads() Option {
+	return func(o *options) {
+		o.lockFreeReads = true
+	}
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		indexCount:     defaultIndexCount,
+		dataBlockSize:  defaultDataBlockSize,
+		fileMode:       defaultFileMode,
+		maxLoadFactor:  defaultMaxLoadFactor,
+		maxChainLength: defaultMaxChainLength,
+		hash:           HashFNV1a,
+		watchInterval:  defaultWatchInterval,
+		changeFeedSize: defaultChangeFeedSize,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *options) validate() error {
+	if o.indexCount == 0 || o.indexCount > maxIndexBlockSize/offsetSize(o.wide) {
+		return stackerr.Newf(
+			"dyconf: invalid index slot count [%d]. It should be between [1 - %d]",
+			o.indexCount,
+			maxIndexBlockSize/offsetSize(o.wide),
+		)
+	}
+	maxSize := uint64(maxDataBlockSize)
+	if o.wide {
+		maxSize = maxWideDataBlockSize
+	}
+	if o.dataBlockSize < minDataBlockSize || o.dataBlockSize > maxSize {
+		return stackerr.Newf(
+			"dyconf: invalid data block size [%#X]. It should be between [%#X - %#X]",
+			o.dataBlockSize,
+			minDataBlockSize,
+			maxSize,
+		)
+	}
+	if o.hash >= HashUserMin && !o.hash.known() {
+		return stackerr.Newf("dyconf: the hash [%d] is not registered. See RegisterHash", o.hash)
+	}
+	if !o.hash.known() {
+		return stackerr.Newf("dyconf: unknown hash [%d]", o.hash)
+	}
+	if !(o.maxLoadFactor >= 0) {
+		return stackerr.Newf("dyconf: invalid max load factor [%v]. It should not be negative", o.maxLoadFactor)
+	}
+	if o.changeFeedSize != 0 && (o.changeFeedSize < minChangeFeedSize || o.changeFeedSize > maxChangeFeedSize) {
+		return stackerr.Newf(
+			"dyconf: invalid change feed size [%#X]. It should be 0 or between [%#X - %#X]",
+			o.changeFeedSize,
+			minChangeFeedSize,
+			maxChangeFeedSize,
+		)
+	}
+	if o.watchInterval <= 0 {
+		return stackerr.Newf("dyconf: invalid watch interval [%s]. It should be positive", o.watchInterval)
+	}
+	return nil
+}
+
+// indexBlockSize returns the size of the index block in bytes.
+func (o *options) indexBlockSize() uint32 {
+	return o.indexCount * offsetSize(o.wide)
+}
+
+// totalSize returns the size of a config file created with these options.
+func (o *options) totalSize() uint64 {
+	size := headerBlockSize + journalBlockSize + uint64(o.changeFeedSize) + uint64(o.indexBlockSize()) + o.dataBlockSize
+	if o.lockFreeReads {
+		size += sequenceSize
+	}
+	return size
+}
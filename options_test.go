@@ -0,0 +1,110 @@
+package dyconf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestOptionsDefaults(t *testing.T) {
+	o, err := newOptions(nil)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, o.indexCount, uint32(defaultIndexCount))
+	ensure.DeepEqual(t, o.dataBlockSize, uint64(defaultDataBlockSize))
+	ensure.DeepEqual(t, o.fileMode, defaultFileMode)
+	ensure.DeepEqual(t, o.totalSize(), uint64(defaultTotalSize))
+	ensure.DeepEqual(t, o.maxLoadFactor, defaultMaxLoadFactor)
+	ensure.DeepEqual(t, o.maxChainLength, uint32(defaultMaxChainLength))
+	ensure.DeepEqual(t, o.hash, HashFNV1a)
+	ensure.DeepEqual(t, o.watchInterval, defaultWatchInterval)
+}
+
+func TestOptionsErrors(t *testing.T) {
+	cases := []struct {
+		opts           []Option
+		expectedErrStr string
+	}{
+		{ // Case-0: zero index slots.
+			opts:           []Option{WithIndexSlots(0)},
+			expectedErrStr: `^dyconf: invalid index slot count \[0\]`,
+		},
+		{ // Case-1: index block would exceed the max size.
+			opts:           []Option{WithIndexSlots(maxIndexBlockSize/sizeOfUint32 + 1)},
+			expectedErrStr: `^dyconf: invalid index slot count \[33554433\]`,
+		},
+		{ // Case-2: data block is too small.
+			opts:           []Option{WithDataBlockSize(0x10)},
+			expectedErrStr: `^dyconf: invalid data block size \[0X10\]`,
+		},
+		{ // Case-3: data block exceeds the max size.
+			opts:           []Option{WithDataBlockSize(maxDataBlockSize + 1)},
+			expectedErrStr: `^dyconf: invalid data block size \[0X40000001\]`,
+		},
+		{ // Case-4: negative load factor.
+			opts:           []Option{WithMaxLoadFactor(-1)},
+			expectedErrStr: `^dyconf: invalid max load factor \[-1\]. It should not be negative`,
+		},
+		{ // Case-5: unknown hash.
+			opts:           []Option{WithHash(9)},
+			expectedErrStr: `^dyconf: unknown hash \[9\]`,
+		},
+		{ // Case-6: too many slots for wide offsets.
+			opts:           []Option{WithWideOffsets(), WithIndexSlots(maxIndexBlockSize/sizeOfUint64 + 1)},
+			expectedErrStr: `^dyconf: invalid index slot count \[16777217\]. It should be between \[1 - 16777216\]`,
+		},
+		{ // Case-7: data block exceeds the max size of files with wide offsets.
+			opts:           []Option{WithWideOffsets(), WithDataBlockSize(maxWideDataBlockSize + 1)},
+			expectedErrStr: `^dyconf: invalid data block size \[0X10000000001\]. It should be between \[0X400 - 0X10000000000\]`,
+		},
+		{ // Case-8: zero watch interval.
+			opts:           []Option{WithWatchInterval(0)},
+			expectedErrStr: `^dyconf: invalid watch interval \[0s\]. It should be positive`,
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := newOptions(tc.opts)
+		ensure.Err(t, err, regexp.MustCompile(tc.expectedErrStr), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestDyconfCustomSizes tests that the file is laid out according to the options and that both the
+// reader and the writer pick the layout up from the header.
+func TestDyconfCustomSizes(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestDyconfCustomSizes-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(64), WithDataBlockSize(0x1000), WithFileMode(0600))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	ensure.Nil(t, m.Close())
+
+	stat, err := os.Stat(tmpFileName)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, stat.Size(), int64(headerBlockSize+journalBlockSize+defaultChangeFeedSize+64*sizeOfUint32+0x1000))
+	ensure.DeepEqual(t, stat.Mode().Perm(), os.FileMode(0600))
+
+	// Reopen with different options. The layout in the header wins.
+	m, err = NewManager(tmpFileName, WithIndexSlots(128))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Set("key2", []byte("value2")))
+	size, err := m.dataBlockSize()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, size, uint64((&dataRecord{key: []byte("key"), data: []byte("value")}).size()+
+		(&dataRecord{key: []byte("key2"), data: []byte("value2")}).size()))
+
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	val, err := conf.Get("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("value"))
+	val, err = conf.Get("key2")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, val, []byte("value2"))
+
+	ensure.Nil(t, conf.Close())
+	ensure.Nil(t, m.Close())
+}
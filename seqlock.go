@@ -0,0 +1,138 @@
+package dyconf
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Files created with WithLockFreeReads have a sequence number right after the header. The writers make
+// it odd before they change anything in the file and even again once the change is complete, so a
+// reader that finds the same even number before and after reading saw no change in between. Such
+// readers read without locking the file, and retry when the number doesn't match.
+//
+// Only the reads that can use the header cache go without the lock. The first read after every change
+// finds the header changed and locks the file to rebuild the cache, so the header is never parsed, and
+// the file never remapped or reopened, without the lock.
+const (
+	sequenceOffset = headerBlockSize
+	sequenceSize   = sizeOfUint64
+
+	// maxLockFreeAttempts is the number of times a read is tried without the lock before the file is
+	// locked for it.
+	maxLockFreeAttempts = 4
+)
+
+// errListTooLong is returned by findLockFree for a list with more records than there are keys.
+var errListTooLong = errors.New("dyconf: the list has more records than there are keys")
+
+// sequence returns the sequence number in the mapped file. The file must have one.
+func (c *config) sequence() *uint64 {
+	return (*uint64)(unsafe.Pointer(&c.block[sequenceOffset]))
+}
+
+// bumpSequence bumps the sequence number of the file, if the file described by the given header has
+// one. The writers call it before and after every change. The caller must hold the write lock.
+func (c *config) bumpSequence(h *headerBlock) {
+	if h.compatFeatures&featureSequence != 0 {
+		atomic.AddUint64(c.sequence(), 1)
+	}
+}
+
+// read calls fn with the type and the value of the given key, like lookup does. It reads the file
+// without locking it if it can (see readLockFree), and locks it otherwise.
+func (c *config) read(key string, fn func(kind ValueType, value []byte) error) (bool, error) {
+	if found, ok, err := c.readLockFree(key, fn); ok {
+		return found, c.report(err)
+	}
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	return c.lookup(key, fn)
+}
+
+// readLockFree calls fn with the type and the value of the given key, read without the lock, for configs
+// created with WithLockFreeReads. The value is a slice of the mapped file that may change while fn runs,
+// so what fn did only counts if the sequence number didn't change by the time it returned. Otherwise fn is
+// called again with the value read again. fn must only copy or decode the value then, so that its result
+// depends on its last call only. It returns false for ok if the lookup has to be done with the lock
+// instead, because the header changed since it was cached, the lookup kept overlapping changes, or it
+// failed. The errors are left to the lookup with the lock to report, except those of fn.
+func (c *config) readLockFree(key string, fn func(kind ValueType, value []byte) error) (found bool, ok bool, err error) {
+	if !c.lockFree || c.acquire() != nil {
+		return false, false, nil
+	}
+	defer c.release()
+	// The other goroutines of the process are kept apart all the same, since they may remap the file.
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	hc := c.cache
+	if hc == nil || hc.h.compatFeatures&featureSequence == 0 {
+		return false, false, nil
+	}
+	sequence := c.sequence()
+	for attempt := 0; attempt < maxLockFreeAttempts; attempt++ {
+		before := atomic.LoadUint64(sequence)
+		if before&1 != 0 {
+			// A change is in progress.
+			runtime.Gosched()
+			continue
+		}
+		if !bytes.Equal(hc.raw[:], c.block[:headerBlockSize]) {
+			return false, false, nil
+		}
+		kind, value, found, err := c.findLockFree(hc, key)
+		var fnErr error
+		if err == nil && found {
+			fnErr = fn(kind, value)
+		}
+		loadFence()
+		if atomic.LoadUint64(sequence) != before {
+			continue
+		}
+		if err != nil {
+			return false, false, nil
+		}
+		return found, true, fnErr
+	}
+	return false, false, nil
+}
+
+// loadFence keeps the reads of the mapped file before it from being done after the reads after it. The
+// sequence number is loaded atomically, but an atomic load only keeps the reads after it from being done
+// before it. Without the fence, the reads of a value could be done after the sequence number is checked
+// on the processors that reorder loads, like those of arm64, and miss the change the number shows. The
+// fence is an atomic write, which orders all the memory accesses around it. Its variable is on the stack,
+// since the file of a reader is mapped read only.
+func loadFence() {
+	var fence uint32
+	atomic.AddUint32(&fence, 1)
+}
+
+// findLockFree returns the type and the value of the given key in the cached blocks. The records carry a
+// checksum, so a record that is being written isn't mistaken for a complete one. The lists being changed
+// may lead anywhere though, so the walk stops after as many records as there are keys.
+func (c *config) findLockFree(hc *headerCache, key string) (ValueType, []byte, bool, error) {
+	offset, err := hc.index.get(key)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	for n := uint64(0); offset != 0; n++ {
+		if n > hc.h.keyCount {
+			return 0, nil, false, errListTooLong
+		}
+		kind, recKey, data, next, err := hc.data.recordAt(offset)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		if string(recKey) == key {
+			return kind, data, true, nil
+		}
+		offset = next
+	}
+	return 0, nil, false, nil
+}
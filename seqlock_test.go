@@ -0,0 +1,196 @@
+package dyconf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// lookupLockFree returns the type and a copy of the value of the given key, read without the lock. It
+// returns false for ok if it couldn't be. See readLockFree.
+func lookupLockFree(c *config, key string) (kind ValueType, value []byte, found bool, ok bool) {
+	found, ok, err := c.readLockFree(key, func(k ValueType, v []byte) error {
+		kind, value = k, append([]byte(nil), v...)
+		return nil
+	})
+	return kind, value, found, ok && err == nil
+}
+
+// TestLockFreeReads tests when the reads go without the lock and how the writers bump the sequence
+// number.
+func TestLockFreeReads(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestLockFreeReads-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithLockFreeReads())
+	ensure.Nil(t, err)
+	mc := m.(*configManager)
+	h, err := mc.header()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.compatFeatures&featureSequence, featureSequence)
+	ensure.DeepEqual(t, h.journalOffset, dataOffset(headerBlockSize+sequenceSize))
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	ensure.DeepEqual(t, atomic.LoadUint64(mc.sequence()), uint64(2))
+
+	conf, err := New(tmpFileName, WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer conf.Close()
+	c := conf.(*config)
+
+	// The first read caches the header with the lock. The next ones go without it.
+	_, _, _, ok := lookupLockFree(c, "key")
+	ensure.False(t, ok)
+	value, err := conf.Get("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, value, []byte("value"))
+	kind, value, found, ok := lookupLockFree(c, "key")
+	ensure.True(t, ok)
+	ensure.True(t, found)
+	ensure.DeepEqual(t, kind, TypeBytes)
+	ensure.DeepEqual(t, value, []byte("value"))
+	_, _, found, ok = lookupLockFree(c, "missing")
+	ensure.True(t, ok)
+	ensure.False(t, found)
+
+	// A change makes the next read lock the file again.
+	ensure.Nil(t, m.SetInt64("key", 7))
+	ensure.DeepEqual(t, atomic.LoadUint64(mc.sequence()), uint64(4))
+	_, _, _, ok = lookupLockFree(c, "key")
+	ensure.False(t, ok)
+	n, err := conf.GetInt64("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, int64(7))
+	_, _, _, ok = lookupLockFree(c, "key")
+	ensure.True(t, ok)
+
+	// The reads that overlap a change lock the file.
+	atomic.AddUint64(mc.sequence(), 1)
+	_, _, _, ok = lookupLockFree(c, "key")
+	ensure.False(t, ok)
+	found, err = conf.Has("key")
+	ensure.Nil(t, err)
+	ensure.True(t, found)
+
+	// A writer that died in the middle of a change left the sequence number odd. The next one fixes it.
+	ensure.Nil(t, m.Close())
+	m, err = NewManager(tmpFileName, WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer m.Close()
+	mc = m.(*configManager)
+	ensure.DeepEqual(t, atomic.LoadUint64(mc.sequence()), uint64(6))
+
+	// The file built by Defrag has a sequence number too.
+	ensure.Nil(t, m.Defrag())
+	h, err = mc.header()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.compatFeatures&featureSequence, featureSequence)
+	ensure.Nil(t, m.Set("key", []byte("defragged")))
+	value, err = conf.Get("key")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, value, []byte("defragged"))
+	_, value, _, ok = lookupLockFree(c, "key")
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, value, []byte("defragged"))
+}
+
+// TestLockFreeReadsDisabled tests that the reads lock the file unless both the reader and the file use
+// WithLockFreeReads.
+func TestLockFreeReadsDisabled(t *testing.T) {
+	cases := []struct {
+		writerOpts []Option
+		readerOpts []Option
+	}{
+		{ // Case-0: The reader doesn't use the option.
+			writerOpts: []Option{WithLockFreeReads()},
+		},
+		{ // Case-1: The file has no sequence number.
+			readerOpts: []Option{WithLockFreeReads()},
+		},
+	}
+
+	for i, tc := range cases {
+		tmpFileName := setupTempFile(t, "TestLockFreeReadsDisabled-")
+		defer os.Remove(tmpFileName)
+		m, err := NewManager(tmpFileName, append(tc.writerOpts, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))...)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Set("key", []byte("value")), fmt.Sprintf("Case: [%d]", i))
+		conf, err := New(tmpFileName, tc.readerOpts...)
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+
+		value, err := conf.Get("key")
+		ensure.Nil(t, err, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, value, []byte("value"), fmt.Sprintf("Case: [%d]", i))
+		_, _, _, ok := lookupLockFree(conf.(*config), "key")
+		ensure.False(t, ok, fmt.Sprintf("Case: [%d]", i))
+
+		ensure.Nil(t, conf.Close(), fmt.Sprintf("Case: [%d]", i))
+		ensure.Nil(t, m.Close(), fmt.Sprintf("Case: [%d]", i))
+	}
+}
+
+// TestLockFreeReadsConcurrent tests that the reads without the lock never return a value that is being
+// changed.
+func TestLockFreeReadsConcurrent(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestLockFreeReadsConcurrent-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(4), WithDataBlockSize(minDataBlockSize), WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer m.Close()
+	values := [][]byte{bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 200)}
+	ensure.Nil(t, m.Set("key", values[0]))
+	conf, err := New(tmpFileName, WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer conf.Close()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if err := m.Set("key", values[i%2]); err != nil {
+				done <- err
+				return
+			}
+			if err := m.Set(fmt.Sprintf("other-%d", i%8), values[i%2]); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		select {
+		case err := <-done:
+			ensure.Nil(t, err)
+			return
+		default:
+		}
+		value, err := conf.Get("key")
+		ensure.Nil(t, err)
+		if !bytes.Equal(value, values[0]) && !bytes.Equal(value, values[1]) {
+			t.Fatalf("read a value that is being changed: [%q]", value)
+		}
+	}
+}
+
+// TestLockFreeReadsCorruptHeader tests that a file whose journal overlaps the sequence number is
+// rejected.
+func TestLockFreeReadsCorruptHeader(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestLockFreeReadsCorruptHeader-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithLockFreeReads())
+	ensure.Nil(t, err)
+	defer m.Close()
+	h, err := m.(*configManager).header()
+	ensure.Nil(t, err)
+	h.journalOffset = headerBlockSize
+	ensure.Nil(t, h.save())
+
+	_, err = New(tmpFileName)
+	ensure.Err(t, err, regexp.MustCompile(`dyconf: invalid header. The journal offset \[0x80\] overlaps the sequence number`))
+}
@@ -0,0 +1,215 @@
+package dyconf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ValueType is the type of a value. The typed setters, like SetInt64, save it along with the value, so
+// that the typed getters can refuse to read it as another type.
+type ValueType uint8
+
+const (
+	// TypeBytes is the type of the values saved with Set. They can be read with Get, GetView and
+	// GetString.
+	TypeBytes ValueType = iota
+	TypeString
+	TypeInt64
+	TypeUint64
+	TypeFloat64
+	TypeBool
+	TypeDuration
+	TypeTime
+)
+
+var valueTypeNames = []string{"bytes", "string", "int64", "uint64", "float64", "bool", "duration", "time"}
+
+func (t ValueType) String() string {
+	if !t.known() {
+		return fmt.Sprintf("ValueType(%d)", uint8(t))
+	}
+	return valueTypeNames[t]
+}
+
+func (t ValueType) known() bool {
+	return t <= TypeTime
+}
+
+// TypeError is returned by the typed getters when the value of the key was saved as another type. It is
+// an ErrTypeMismatch.
+type TypeError struct {
+	Key       string
+	FileName  string
+	Saved     ValueType // Type the value was saved as.
+	Requested ValueType // Type the value was read as.
+}
+
+func (e *TypeError) Error() string {
+	msg := fmt.Sprintf("dyconf: key [%s] holds a [%s] value. It cannot be read as [%s]", e.Key, e.Saved, e.Requested)
+	if e.FileName == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s. File: [%s]", msg, e.FileName)
+}
+
+// Is returns true for ErrTypeMismatch.
+func (e *TypeError) Is(target error) bool {
+	return target == ErrTypeMismatch
+}
+
+// The numbers are saved in 8 bytes, little-endian. Bools are saved in 1 byte, and times in the format of
+// time.Time.MarshalBinary.
+
+func (c *config) GetString(key string) (string, error) {
+	var ret string
+	err := c.getTyped(key, TypeString, func(data []byte) error {
+		ret = string(data)
+		return nil
+	})
+	return ret, err
+}
+
+func (c *config) GetInt64(key string) (int64, error) {
+	var ret int64
+	err := c.getTyped(key, TypeInt64, func(data []byte) error {
+		ret = int64(binary.LittleEndian.Uint64(data))
+		return nil
+	})
+	return ret, err
+}
+
+func (c *config) GetUint64(key string) (uint64, error) {
+	var ret uint64
+	err := c.getTyped(key, TypeUint64, func(data []byte) error {
+		ret = binary.LittleEndian.Uint64(data)
+		return nil
+	})
+	return ret, err
+}
+
+func (c *config) GetFloat64(key string) (float64, error) {
+	var ret float64
+	err := c.getTyped(key, TypeFloat64, func(data []byte) error {
+		ret = math.Float64frombits(binary.LittleEndian.Uint64(data))
+		return nil
+	})
+	return ret, err
+}
+
+func (c *config) GetBool(key string) (bool, error) {
+	var ret bool
+	err := c.getTyped(key, TypeBool, func(data []byte) error {
+		ret = data[0] != 0
+		return nil
+	})
+	return ret, err
+}
+
+func (c *config) GetDuration(key string) (time.Duration, error) {
+	var ret time.Duration
+	err := c.getTyped(key, TypeDuration, func(data []byte) error {
+		ret = time.Duration(binary.LittleEndian.Uint64(data))
+		return nil
+	})
+	return ret, err
+}
+
+func (c *config) GetTime(key string) (time.Time, error) {
+	var ret time.Time
+	err := c.getTyped(key, TypeTime, func(data []byte) error {
+		if err := ret.UnmarshalBinary(data); err != nil {
+			return &FileError{
+				Reason: fmt.Sprintf("dyconf: the [%s] value of the key [%s] is unreadable. error: [%s]", TypeTime, key, err.Error()),
+				Err:    ErrCorrupt,
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// getTyped calls fn with the value of the given key, after checking that it was saved as the given type
+// and that it has the size of the type. A string can also be read from an untyped value. fn may be called
+// more than once. See readLockFree.
+func (c *config) getTyped(key string, kind ValueType, fn func(data []byte) error) error {
+	found, err := c.read(key, func(saved ValueType, data []byte) error {
+		if saved != kind && !(kind == TypeString && saved == TypeBytes) {
+			return &TypeError{Key: key, Saved: saved, Requested: kind}
+		}
+		if size := valueSize(kind); size != 0 && len(data) != size {
+			return &FileError{
+				Reason: fmt.Sprintf("dyconf: the [%s] value of the key [%s] is [%d] bytes. It should be [%d]", kind, key, len(data), size),
+				Err:    ErrCorrupt,
+			}
+		}
+		return fn(data)
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.notFound
+	}
+	return nil
+}
+
+// valueSize returns the size of the values of the given type, or 0 if they vary in size.
+func valueSize(kind ValueType) int {
+	switch kind {
+	case TypeInt64, TypeUint64, TypeFloat64, TypeDuration:
+		return sizeOfUint64
+	case TypeBool:
+		return 1
+	}
+	return 0
+}
+
+func (c *configManager) SetString(key string, value string) error {
+	return c.set(key, []byte(value), TypeString)
+}
+
+func (c *configManager) SetInt64(key string, value int64) error {
+	return c.setUint64(key, uint64(value), TypeInt64)
+}
+
+func (c *configManager) SetUint64(key string, value uint64) error {
+	return c.setUint64(key, value, TypeUint64)
+}
+
+func (c *configManager) SetFloat64(key string, value float64) error {
+	return c.setUint64(key, math.Float64bits(value), TypeFloat64)
+}
+
+func (c *configManager) SetBool(key string, value bool) error {
+	data := []byte{0}
+	if value {
+		data[0] = 1
+	}
+	return c.set(key, data, TypeBool)
+}
+
+func (c *configManager) SetDuration(key string, value time.Duration) error {
+	return c.setUint64(key, uint64(value), TypeDuration)
+}
+
+func (c *configManager) SetTime(key string, value time.Time) error {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return &KeyError{
+			Key:      key,
+			FileName: c.fileName,
+			Reason:   fmt.Sprintf("has a time that cannot be saved. error: [%s]", err.Error()),
+			Err:      err,
+		}
+	}
+	return c.set(key, data, TypeTime)
+}
+
+// setUint64 sets the key to the given 8 byte value, saved as the given type.
+func (c *configManager) setUint64(key string, value uint64, kind ValueType) error {
+	data := make([]byte, sizeOfUint64)
+	binary.LittleEndian.PutUint64(data, value)
+	return c.set(key, data, kind)
+}
@@ -0,0 +1,142 @@
+package dyconf
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+// TestValuesSetGet tests that the typed values are read back as they were set, also after Defrag.
+func TestValuesSetGet(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestValuesSetGet-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+
+	// A file without typed values can still be read by older readers.
+	ensure.Nil(t, m.Set("bytes", []byte("raw")))
+	h, err := m.(*configManager).header()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.incompatFeatures&featureValueTypes, uint32(0))
+
+	now := time.Date(2017, 3, 4, 5, 6, 7, 8, time.FixedZone("X", 3600))
+	ensure.Nil(t, m.SetString("string", "some string"))
+	ensure.Nil(t, m.SetString("empty", ""))
+	ensure.Nil(t, m.SetInt64("int64", math.MinInt64))
+	ensure.Nil(t, m.SetUint64("uint64", math.MaxUint64))
+	ensure.Nil(t, m.SetFloat64("float64", -1.5))
+	ensure.Nil(t, m.SetBool("bool", true))
+	ensure.Nil(t, m.SetDuration("duration", 90*time.Second))
+	ensure.Nil(t, m.SetTime("time", now))
+	h, err = m.(*configManager).header()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.incompatFeatures&featureValueTypes, featureValueTypes)
+
+	check := func(step string) {
+		s, err := m.GetString("string")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, s, "some string", step)
+		s, err = m.GetString("empty")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, s, "", step)
+		s, err = m.GetString("bytes")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, s, "raw", step)
+		i, err := m.GetInt64("int64")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, i, int64(math.MinInt64), step)
+		u, err := m.GetUint64("uint64")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, u, uint64(math.MaxUint64), step)
+		f, err := m.GetFloat64("float64")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, f, -1.5, step)
+		b, err := m.GetBool("bool")
+		ensure.Nil(t, err, step)
+		ensure.True(t, b, step)
+		d, err := m.GetDuration("duration")
+		ensure.Nil(t, err, step)
+		ensure.DeepEqual(t, d, 90*time.Second, step)
+		tm, err := m.GetTime("time")
+		ensure.Nil(t, err, step)
+		ensure.True(t, tm.Equal(now), step, tm)
+		_, offset := tm.Zone()
+		ensure.DeepEqual(t, offset, 3600, step)
+	}
+	check("before defrag")
+	ensure.Nil(t, m.Defrag())
+	check("after defrag")
+
+	// Setting a key again can change its type.
+	ensure.Nil(t, m.SetBool("int64", false))
+	b, err := m.GetBool("int64")
+	ensure.Nil(t, err)
+	ensure.False(t, b)
+}
+
+// TestValuesTypeMismatch tests that a value can't be read as a type other than the one it was set as.
+func TestValuesTypeMismatch(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestValuesTypeMismatch-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	ensure.Nil(t, m.Set("bytes", []byte("12345678")))
+	ensure.Nil(t, m.SetInt64("int64", 42))
+	ensure.Nil(t, m.SetUint64("uint64", 42))
+
+	cases := []struct {
+		key       string
+		get       func(key string) error
+		saved     ValueType
+		requested ValueType
+	}{
+		{ // Case-0: Untyped values can only be read as strings.
+			key:       "bytes",
+			get:       func(key string) error { _, err := m.GetInt64(key); return err },
+			saved:     TypeBytes,
+			requested: TypeInt64,
+		},
+		{ // Case-1
+			key:       "int64",
+			get:       func(key string) error { _, err := m.GetString(key); return err },
+			saved:     TypeInt64,
+			requested: TypeString,
+		},
+		{ // Case-2: Values of the same size are still told apart.
+			key:       "int64",
+			get:       func(key string) error { _, err := m.GetUint64(key); return err },
+			saved:     TypeInt64,
+			requested: TypeUint64,
+		},
+		{ // Case-3
+			key:       "uint64",
+			get:       func(key string) error { _, err := m.GetDuration(key); return err },
+			saved:     TypeUint64,
+			requested: TypeDuration,
+		},
+	}
+	for i, tc := range cases {
+		err := tc.get(tc.key)
+		typeErr, ok := err.(*TypeError)
+		ensure.True(t, ok, fmt.Sprintf("Case: [%d]", i), err)
+		ensure.DeepEqual(t, typeErr, &TypeError{Key: tc.key, FileName: tmpFileName, Saved: tc.saved, Requested: tc.requested}, fmt.Sprintf("Case: [%d]", i))
+	}
+
+	// The typed values can still be read as bytes.
+	data, err := m.Get("int64")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, data, []byte{42, 0, 0, 0, 0, 0, 0, 0})
+
+	_, err = m.GetBool("missing")
+	keyErr, ok := err.(*KeyError)
+	ensure.True(t, ok, err)
+	ensure.DeepEqual(t, keyErr.Err, ErrNotFound)
+}
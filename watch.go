@@ -0,0 +1,297 @@
+package dyconf
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+)
+
+// EventType is the kind of change an Event describes.
+type EventType uint8
+
+const (
+	// EventSet means the key was added or its value changed.
+	EventSet EventType = iota + 1
+	// EventDelete means the key was deleted.
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event is a change of a watched key. Old is nil if the key was added, and New is nil if it was deleted.
+//
+// Watch checks the file whenever its generation changes. It finds the changed keys in the change feed
+// (see Config.Changes), or by reading all the watched keys if the feed doesn't go back far enough. Then
+// it compares their values with those of the last check, so a key changed several times between two
+// checks gets a single event, and none if it ends up with the value it started with.
+//
+// If watching fails, the last event sent has only Err set. The channel is closed after it, or when the
+// context is done.
+type Event struct {
+	Type       EventType
+	Key        string
+	Old        []byte
+	New        []byte
+	Generation uint64 // Generation of the file the change was seen in.
+	Err        error
+}
+
+// watchBufferSize is the number of events a watcher can send ahead of its reader.
+const watchBufferSize = 16
+
+// Watch sends the changes of the given key, and of the keys under it, on the returned channel until the
+// context is done. The keys under a key are those that start with the key followed by a dot, like
+// service.timeout under service. If keyOrPrefix is empty or ends with a dot, it is a prefix, and the
+// changes of all the keys that start with it are sent. See Event.
+//
+// The changes are waited for like Wait does, by a goroutine with a Config of its own, so the config Watch
+// is called on can still be used as before. It subscribes to the changes itself if the config was created
+// with WithNotifications. Closing the config Watch was called on stops the watch too. An event with an
+// ErrClosed error is sent then, before the channel is closed.
+func (c *config) Watch(ctx context.Context, keyOrPrefix string) <-chan Event {
+	events := make(chan Event, watchBufferSize)
+	if err := c.checkOpen(); err != nil {
+		events <- Event{Err: err}
+		close(events)
+		return events
+	}
+
+	w := &config{logger: c.logger, watchInterval: c.watchInterval}
+	if c.sub != nil {
+		sub, err := subscribe(c.fileName)
+		if err != nil {
+			events <- Event{Err: err}
+			close(events)
+			return events
+		}
+		w.sub = sub
+	}
+	if err := w.init(c.fileName); err != nil {
+		if w.sub != nil {
+			w.sub.close()
+		}
+		events <- Event{Err: err}
+		close(events)
+		return events
+	}
+	// The first state is read before returning, so that no change made after Watch returns is missed.
+	match := watchMatcher(keyOrPrefix)
+	kv, generation, err := w.watchedKeyValues(match)
+	if err != nil {
+		w.Close()
+		events <- Event{Err: err}
+		close(events)
+		return events
+	}
+	stop, cancel := context.WithCancel(ctx)
+	if err := c.addWatcher(w, cancel); err != nil {
+		cancel()
+		w.Close()
+		events <- Event{Err: err}
+		close(events)
+		return events
+	}
+	go w.watch(ctx, stop, c, match, kv, generation, events)
+	return events
+}
+
+// addWatcher keeps the function that stops the given watcher, for Close to call. It fails if the config
+// is closed already.
+func (c *config) addWatcher(w *config, cancel context.CancelFunc) error {
+	c.refMu.Lock()
+	defer c.refMu.Unlock()
+	if c.closed {
+		return c.closedError()
+	}
+	if c.watchers == nil {
+		c.watchers = make(map[*config]context.CancelFunc)
+	}
+	c.watchers[w] = cancel
+	return nil
+}
+
+// removeWatcher stops the given watcher and forgets it.
+func (c *config) removeWatcher(w *config) {
+	c.refMu.Lock()
+	defer c.refMu.Unlock()
+	if cancel, ok := c.watchers[w]; ok {
+		cancel()
+		delete(c.watchers, w)
+	}
+}
+
+// watch sends the changes of the keys match returns true for, starting from the given key-values of the
+// given generation, until the stop context is done. That is either because the given context is done, or
+// because the given parent, the config Watch was called on, was closed. The latter is sent as an
+// ErrClosed error. It closes the config and the channel when it returns.
+func (c *config) watch(ctx, stop context.Context, parent *config, match func(key string) bool, last map[string][]byte, generation uint64, events chan<- Event) {
+	defer close(events)
+	defer c.Close()
+	defer parent.removeWatcher(c)
+
+	if !c.sendChanges(stop, match, last, generation, events) || ctx.Err() != nil {
+		return
+	}
+	select {
+	case events <- Event{Err: c.closedError()}:
+	case <-ctx.Done():
+	}
+}
+
+// sendChanges sends the changes for watch. It returns true if it stopped because the context is done,
+// and false if it stopped because watching failed. The error is sent then.
+func (c *config) sendChanges(ctx context.Context, match func(key string) bool, last map[string][]byte, generation uint64, events chan<- Event) bool {
+	// The context is checked first, so that no change made after it is done is sent.
+	send := func(e Event) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		select {
+		case events <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		if _, err := c.Wait(ctx, generation); err != nil || ctx.Err() != nil {
+			if ctx.Err() != nil {
+				return true
+			}
+			send(Event{Err: err})
+			return false
+		}
+		var changes []Event
+		var err error
+		changes, generation, err = c.watchedChanges(match, last, generation)
+		if err != nil {
+			send(Event{Err: err})
+			return false
+		}
+		for _, e := range changes {
+			if !send(e) {
+				return true
+			}
+		}
+	}
+}
+
+// watchedChanges returns the changes of the keys match returns true for, made after the given generation,
+// along with the current generation. The given key-values of the keys as of that generation are updated
+// to the current ones.
+func (c *config) watchedChanges(match func(key string) bool, last map[string][]byte, since uint64) ([]Event, uint64, error) {
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return nil, 0, err
+	}
+	defer c.unlock()
+
+	changes, generation, err := c.changesNoLock(since)
+	if fileErr, ok := err.(*FileError); ok && fileErr.Err == ErrChangesLost {
+		// Compare all the keys.
+		kv, generation, err := c.keyValues(match)
+		if err != nil {
+			return nil, 0, err
+		}
+		events := diffKeyValues(last, kv, generation)
+		for key := range last {
+			delete(last, key)
+		}
+		for key, value := range kv {
+			last[key] = value
+		}
+		return events, generation, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Compare only the changed keys.
+	seen := make(map[string]bool)
+	old, kv := make(map[string][]byte), make(map[string][]byte)
+	for _, change := range changes {
+		if seen[change.Key] || !match(change.Key) {
+			continue
+		}
+		seen[change.Key] = true
+		if value, found := last[change.Key]; found {
+			old[change.Key] = value
+		}
+		var value []byte
+		found, err := c.lookup(change.Key, func(_ ValueType, data []byte) error {
+			value = make([]byte, len(data))
+			copy(value, data)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if found {
+			kv[change.Key] = value
+			last[change.Key] = value
+		} else {
+			delete(last, change.Key)
+		}
+	}
+	return diffKeyValues(old, kv, generation), generation, nil
+}
+
+// watchedKeyValues returns the key-values of the keys match returns true for, along with the generation
+// they are of.
+func (c *config) watchedKeyValues(match func(key string) bool) (map[string][]byte, uint64, error) {
+	// read lock the file
+	if err := c.rlock(); err != nil {
+		return nil, 0, err
+	}
+	defer c.unlock()
+	return c.keyValues(match)
+}
+
+// watchMatcher returns a function that returns true for the keys watched by Watch with the given key or
+// prefix.
+func watchMatcher(keyOrPrefix string) func(key string) bool {
+	if keyOrPrefix == "" || strings.HasSuffix(keyOrPrefix, ".") {
+		return func(key string) bool {
+			return strings.HasPrefix(key, keyOrPrefix)
+		}
+	}
+	prefix := keyOrPrefix + "."
+	return func(key string) bool {
+		return key == keyOrPrefix || strings.HasPrefix(key, prefix)
+	}
+}
+
+// diffKeyValues returns the events that turn the old key-values into the new ones, ordered by key.
+func diffKeyValues(old, new map[string][]byte, generation uint64) []Event {
+	var events []Event
+	for key, value := range new {
+		oldValue, found := old[key]
+		if found && bytes.Equal(oldValue, value) {
+			continue
+		}
+		events = append(events, Event{Type: EventSet, Key: key, Old: oldValue, New: value, Generation: generation})
+	}
+	for key, value := range old {
+		if _, found := new[key]; !found {
+			events = append(events, Event{Type: EventDelete, Key: key, Old: value, Generation: generation})
+		}
+	}
+	sort.Sort(eventsByKey(events))
+	return events
+}
+
+type eventsByKey []Event
+
+func (e eventsByKey) Len() int           { return len(e) }
+func (e eventsByKey) Less(i, j int) bool { return e[i].Key < e[j].Key }
+func (e eventsByKey) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -0,0 +1,201 @@
+package dyconf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+// nextEvent returns the next event of the channel, or fails the test if there is none in time.
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case e, ok := <-events:
+		ensure.True(t, ok, "the channel was closed")
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+// TestWatch tests that the changes of the watched keys are sent, and only those.
+func TestWatch(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestWatch-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	ensure.Nil(t, m.Set("service.timeout", []byte("5s")))
+	ensure.Nil(t, m.Set("service.hosts.0", []byte("a")))
+	conf, err := New(tmpFileName, WithWatchInterval(time.Millisecond))
+	ensure.Nil(t, err)
+	defer conf.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := conf.Watch(ctx, "service")
+
+	// A change of a key that is not watched is not sent.
+	ensure.Nil(t, m.Set("services", []byte("other")))
+	ensure.Nil(t, m.Set("service.timeout", []byte("10s")))
+	e := nextEvent(t, events)
+	g, err := m.Generation()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, e, Event{Type: EventSet, Key: "service.timeout", Old: []byte("5s"), New: []byte("10s"), Generation: g})
+
+	// The changes may be seen at once or one by one, so they are compared in the order of their keys.
+	ensure.Nil(t, m.Delete("service.hosts.0"))
+	ensure.Nil(t, m.Set("service", []byte("on")))
+	got := []Event{nextEvent(t, events), nextEvent(t, events)}
+	sort.Sort(eventsByKey(got))
+	for i := range got {
+		got[i].Generation = 0
+	}
+	ensure.DeepEqual(t, got, []Event{
+		{Type: EventSet, Key: "service", New: []byte("on")},
+		{Type: EventDelete, Key: "service.hosts.0", Old: []byte("a")},
+	})
+
+	// Defrag changes nothing that is watched.
+	ensure.Nil(t, m.Defrag())
+	ensure.Nil(t, m.Set("service.timeout", []byte("1s")))
+	e = nextEvent(t, events)
+	ensure.DeepEqual(t, e.Key, "service.timeout")
+	ensure.DeepEqual(t, e.Old, []byte("10s"))
+
+	// The channel is closed when the context is done.
+	cancel()
+	for range events {
+	}
+}
+
+// TestWatchClosed tests that a closed config sends the error and closes the channel.
+func TestWatchClosed(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestWatchClosed-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize))
+	ensure.Nil(t, err)
+	ensure.Nil(t, m.Close())
+
+	events := m.Watch(context.Background(), "")
+	e := nextEvent(t, events)
+	fileErr, ok := e.Err.(*FileError)
+	ensure.True(t, ok, e.Err)
+	ensure.DeepEqual(t, fileErr.Err, ErrClosed)
+	_, ok = <-events
+	ensure.False(t, ok)
+}
+
+// TestWatchStoppedByClose tests that closing the config stops its watchers. They send the error and close
+// their channels.
+func TestWatchStoppedByClose(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestWatchStoppedByClose-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithWatchInterval(time.Millisecond))
+	ensure.Nil(t, err)
+	conf, err := New(tmpFileName, WithWatchInterval(time.Millisecond))
+	ensure.Nil(t, err)
+	confEvents := conf.Watch(context.Background(), "")
+	managerEvents := m.Watch(context.Background(), "")
+	ensure.Nil(t, conf.Close())
+
+	// The watcher of the manager isn't stopped by closing another config.
+	ensure.Nil(t, m.Set("key", []byte("value")))
+	e := nextEvent(t, managerEvents)
+	ensure.DeepEqual(t, e.Key, "key")
+	ensure.Nil(t, m.Close())
+
+	for i, events := range []<-chan Event{confEvents, managerEvents} {
+		e := nextEvent(t, events)
+		fileErr, ok := e.Err.(*FileError)
+		ensure.True(t, ok, fmt.Sprintf("Case: [%d]", i), e)
+		ensure.DeepEqual(t, fileErr.Err, ErrClosed, fmt.Sprintf("Case: [%d]", i))
+		ensure.DeepEqual(t, fileErr.FileName, tmpFileName, fmt.Sprintf("Case: [%d]", i))
+		_, ok = <-events
+		ensure.False(t, ok, fmt.Sprintf("Case: [%d]", i))
+	}
+	ensure.DeepEqual(t, len(conf.(*config).watchers), 0)
+	ensure.DeepEqual(t, len(m.(*configManager).watchers), 0)
+}
+
+func TestWatchMatcher(t *testing.T) {
+	cases := []struct {
+		keyOrPrefix string
+		matching    []string
+		other       []string
+	}{
+		{ // Case-0: Empty prefix matches every key.
+			keyOrPrefix: "",
+			matching:    []string{"a", "a.b"},
+		},
+		{ // Case-1: A key matches itself and the keys under it.
+			keyOrPrefix: "a",
+			matching:    []string{"a", "a.b", "a.b.c"},
+			other:       []string{"ab", "b.a", ""},
+		},
+		{ // Case-2: A prefix ending with a dot matches the keys under it.
+			keyOrPrefix: "a.",
+			matching:    []string{"a.b"},
+			other:       []string{"a", "ab"},
+		},
+	}
+	for i, tc := range cases {
+		match := watchMatcher(tc.keyOrPrefix)
+		for _, key := range tc.matching {
+			ensure.True(t, match(key), fmt.Sprintf("Case: [%d]", i), key)
+		}
+		for _, key := range tc.other {
+			ensure.False(t, match(key), fmt.Sprintf("Case: [%d]", i), key)
+		}
+	}
+}
+
+// TestWatchFallenBehind tests that the watched keys are compared in full when the change feed doesn't go
+// back far enough.
+func TestWatchFallenBehind(t *testing.T) {
+	tmpFileName := setupTempFile(t, "TestWatchFallenBehind-")
+	defer os.Remove(tmpFileName)
+
+	m, err := NewManager(tmpFileName, WithIndexSlots(16), WithDataBlockSize(minDataBlockSize), WithChangeFeedSize(minChangeFeedSize))
+	ensure.Nil(t, err)
+	defer m.Close()
+	ensure.Nil(t, m.Set("a.deleted", []byte("v")))
+	conf, err := New(tmpFileName)
+	ensure.Nil(t, err)
+	defer conf.Close()
+	c := conf.(*config)
+
+	match := watchMatcher("a")
+	last, generation, err := c.watchedKeyValues(match)
+	ensure.Nil(t, err)
+
+	// Changes still in the feed.
+	ensure.Nil(t, m.Set("a.new", []byte("1")))
+	events, generation, err := c.watchedChanges(match, last, generation)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, events, []Event{{Type: EventSet, Key: "a.new", New: []byte("1"), Generation: generation}})
+
+	// Changes no longer in the feed.
+	ensure.Nil(t, m.Delete("a.deleted"))
+	ensure.Nil(t, m.Set("a.new", []byte("2")))
+	for i := 0; i < 32; i++ {
+		ensure.Nil(t, m.Set(fmt.Sprintf("other%d", i), []byte("v")))
+	}
+	_, _, err = c.Changes(generation)
+	ensure.NotNil(t, err)
+	events, generation, err = c.watchedChanges(match, last, generation)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, events, []Event{
+		{Type: EventDelete, Key: "a.deleted", Old: []byte("v"), Generation: generation},
+		{Type: EventSet, Key: "a.new", Old: []byte("1"), New: []byte("2"), Generation: generation},
+	})
+	ensure.DeepEqual(t, last, map[string][]byte{"a.new": []byte("2")})
+}